@@ -0,0 +1,124 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/queue"
+    "github.com/watchzap/internal/static"
+)
+
+// Runs the subcommand given after the flags
+func subcommand(args []string) error {
+    switch {
+    case len(args) == 2 && args[0] == "config" && args[1] == "print":
+        fmt.Print(cfg.String())
+        return nil
+    case len(args) == 2 && args[0] == "status":
+        return printStatus(args[1])
+    case len(args) == 2 && args[0] == "schedules" && args[1] == "list":
+        return printSchedules()
+    case len(args) == 3 && args[0] == "schedules" && args[1] == "cancel":
+        return cancelSchedule(args[2])
+    }
+
+    return fmt.Errorf("%s: %s", static.UNKNOWN_COMMAND, strings.Join(args, " "))
+}
+
+// Prints the delivery status of a message and its history
+func printStatus(arg string) error {
+    id, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil {
+        return fmt.Errorf("%s: %s", static.INVALID_ID, arg)
+    }
+
+    outbox, err := openOutbox()
+    if err != nil {
+        return err
+    }
+
+    status, err := getStatus(outbox, id)
+    if err != nil {
+        return err
+    }
+
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(tw, "ID:\t%d\n", status.ID)
+    fmt.Fprintf(tw, "Recipient:\t%s\n", status.Recipient)
+    fmt.Fprintf(tw, "Status:\t%s\n", status.Status)
+    fmt.Fprintf(tw, "Attempts:\t%d\n", status.Attempts)
+    if status.LastError != "" {
+        fmt.Fprintf(tw, "Error:\t%s\n", status.LastError)
+    }
+    if status.WhatsappID != "" {
+        fmt.Fprintf(tw, "WhatsApp ID:\t%s\n", status.WhatsappID)
+        fmt.Fprintf(tw, "Chat:\t%s\n", status.Chat)
+    }
+    fmt.Fprintln(tw, "History:")
+    for _, event := range status.History {
+        fmt.Fprintf(tw, "  %s\t%s\t%s\n", event.At.Format(time.RFC3339), event.Status, event.Error)
+    }
+
+    return tw.Flush()
+}
+
+// Prints the messages waiting for their time, the next one first
+func printSchedules() error {
+    outbox, err := openOutbox()
+    if err != nil {
+        return err
+    }
+
+    schedules, err := listSchedules(outbox)
+    if err != nil {
+        return err
+    }
+    if len(schedules) == 0 {
+        fmt.Println("No scheduled messages")
+        return nil
+    }
+
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "ID\tSend at\tRecipient\tContent")
+    for _, s := range schedules {
+        fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.ID, s.SendAt.Format(time.RFC3339), s.Recipient, s.Content)
+    }
+
+    return tw.Flush()
+}
+
+// Cancels a scheduled message so it is never sent
+func cancelSchedule(arg string) error {
+    id, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil {
+        return fmt.Errorf("%s: %s", static.INVALID_ID, arg)
+    }
+
+    outbox, err := openOutbox()
+    if err != nil {
+        return err
+    }
+
+    item, err := outbox.Cancel(id)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Cancelled message %d to %s\n", item.ID, item.Message.To())
+
+    return nil
+}
+
+// Opens the outbox for commands that only read or edit it, no worker is started
+func openOutbox() (*queue.Queue, error) {
+    db, err := database.Open(database.URI)
+    if err != nil {
+        return nil, err
+    }
+
+    return queue.New(db, cfg.MaxAttempts, cfg.RetryBackoff)
+}
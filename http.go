@@ -0,0 +1,456 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/rs/zerolog/log"
+    "gopkg.in/yaml.v3"
+
+    "github.com/watchzap/internal/jobs"
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/polls"
+    "github.com/watchzap/internal/queue"
+    "github.com/watchzap/internal/static"
+    "github.com/watchzap/internal/templates"
+)
+
+// Outcome of one message of a request
+type messageResult struct {
+    ID         int64  `json:"id"`
+    Recipient  string `json:"recipient"`
+    // Position of the attachment, from 1, when the message has an attachments list
+    Attachment int    `json:"attachment,omitempty"`
+    Status     string `json:"status"`
+    Error      string `json:"error,omitempty"`
+}
+
+// Status of a message with its history, as shown by GET /messages/{id} and the status command
+type messageStatus struct {
+    queue.Item
+    Recipient string        `json:"recipient"`
+    History   []queue.Event `json:"history"`
+}
+
+// Results of a poll sent from the outbox, as shown by GET /polls/{id}
+type pollStatus struct {
+    ID     int64  `json:"id"`
+    Status string `json:"status"`
+    polls.Results
+}
+
+// A message waiting for its time, as listed by GET /schedules and the schedules command
+type scheduledMessage struct {
+    ID        int64     `json:"id"`
+    Recipient string    `json:"recipient"`
+    Content   string    `json:"content"`
+    SendAt    time.Time `json:"send_at"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Sets up an HTTP server for receiving message requests
+func httpServe(outbox *queue.Queue) {
+    time.Sleep(time.Millisecond * 100)
+
+    log.Info().Str("function", "http").Msg("WZ: Serving HTTP server at " + cfg.Port)
+    err := http.ListenAndServe(":"+cfg.Port, newMux(outbox))
+    if err != nil {
+        log.Fatal().Err(err).Msg("WZ: Failed to serve HTTP server")
+    }
+}
+
+// Builds the HTTP routes of watchzap
+func newMux(outbox *queue.Queue) *http.ServeMux {
+    mux := http.NewServeMux()
+    // The original endpoint always waits for the messages to be sent
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        postMessages(w, r, outbox, true)
+    })
+    mux.HandleFunc("POST /messages", func(w http.ResponseWriter, r *http.Request) {
+        wait, _ := strconv.ParseBool(r.URL.Query().Get("wait"))
+        postMessages(w, r, outbox, wait)
+    })
+    mux.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, msa{"status": "error", "error": static.INVALID_ID})
+            return
+        }
+
+        status, err := getStatus(outbox, id)
+        if err != nil {
+            writeJSON(w, http.StatusNotFound, msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "message": status})
+    })
+    mux.HandleFunc("GET /polls/{id}", func(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, msa{"status": "error", "error": static.INVALID_ID})
+            return
+        }
+
+        item, err := outbox.Get(id)
+        if err != nil {
+            writeJSON(w, http.StatusNotFound, msa{"status": "error", "error": err.Error()})
+            return
+        }
+        if item.Message.Poll == nil {
+            writeJSON(w, http.StatusNotFound, msa{"status": "error", "error": static.NOT_A_POLL})
+            return
+        }
+
+        votes, err := pollStore.Votes(id)
+        if err != nil {
+            log.Error().Err(err).Msg("WZ: Error loading poll votes")
+            writeJSON(w, http.StatusInternalServerError, msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "poll": pollStatus{
+            ID:      item.ID,
+            Status:  item.Status,
+            Results: polls.Tally(*item.Message.Poll, votes),
+        }})
+    })
+    mux.HandleFunc("GET /schedules", func(w http.ResponseWriter, r *http.Request) {
+        schedules, err := listSchedules(outbox)
+        if err != nil {
+            log.Error().Err(err).Msg("WZ: Error listing scheduled messages")
+            writeJSON(w, http.StatusInternalServerError, msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "amount": len(schedules), "schedules": schedules})
+    })
+    mux.HandleFunc("DELETE /schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, msa{"status": "error", "error": static.INVALID_ID})
+            return
+        }
+
+        item, err := outbox.Cancel(id)
+        if errors.Is(err, queue.ErrNotScheduled) {
+            writeJSON(w, http.StatusConflict, msa{"status": "error", "error": err.Error()})
+            return
+        }
+        if err != nil {
+            writeJSON(w, http.StatusNotFound, msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "message": messageResult{
+            ID:        item.ID,
+            Recipient: item.Message.To(),
+            Status:    item.Status,
+        }})
+    })
+    mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+        list, err := scheduler.List()
+        if err != nil {
+            log.Error().Err(err).Msg("WZ: Error listing jobs")
+            writeJSON(w, http.StatusInternalServerError, msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "amount": len(list), "jobs": list})
+    })
+    mux.HandleFunc("GET /jobs/{name}", func(w http.ResponseWriter, r *http.Request) {
+        job, err := scheduler.Get(r.PathValue("name"))
+        if err != nil {
+            writeJSON(w, jobErrorStatus(err), msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok", "job": job})
+    })
+    mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+        job, err := readJob(w, r)
+        if err != nil {
+            writeJSON(w, readErrorStatus(err), msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        job, err = scheduler.Save(job)
+        if err != nil {
+            writeJSON(w, jobErrorStatus(err), msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusCreated, msa{"status": "ok", "job": job})
+    })
+    mux.HandleFunc("DELETE /jobs/{name}", func(w http.ResponseWriter, r *http.Request) {
+        err := scheduler.Delete(r.PathValue("name"))
+        if err != nil {
+            writeJSON(w, jobErrorStatus(err), msa{"status": "error", "error": err.Error()})
+            return
+        }
+
+        writeJSON(w, http.StatusOK, msa{"status": "ok"})
+    })
+
+    return mux
+}
+
+// Queues the messages of the request
+// With wait the response is sent once every message was sent or failed,
+// otherwise it is sent right away with the IDs to follow the messages with
+func postMessages(w http.ResponseWriter, r *http.Request, outbox *queue.Queue, wait bool) {
+    messages, files, err := readMessages(w, r)
+    if err != nil {
+        writeJSON(w, readErrorStatus(err), msa{"status": "error", "error": err.Error()})
+        return
+    }
+    // Uploaded files the outbox doesn't refer to once this returns are removed
+    defer uploads.release(files)
+
+    err = prepare(messages, "")
+    var renderErrs templates.Errors
+    if errors.As(err, &renderErrs) {
+        writeJSON(w, http.StatusUnprocessableEntity, msa{
+            "status": "error",
+            "error":  static.TEMPLATE_FAILED,
+            "errors": fieldErrors(renderErrs),
+        })
+        return
+    }
+    if err != nil {
+        writeJSON(w, http.StatusUnprocessableEntity, msa{"status": "error", "error": err.Error()})
+        return
+    }
+
+    queued, err := enqueue(messages, outbox)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error queueing messages")
+        writeJSON(w, http.StatusInternalServerError, msa{"status": "error", "error": err.Error()})
+        return
+    }
+
+    if !wait {
+        results := make([]messageResult, len(queued))
+        for i, row := range queued {
+            status := queue.StatusQueued
+            if item, err := outbox.Get(row.ID); err == nil {
+                status = item.Status
+            }
+
+            results[i] = messageResult{
+                ID:         row.ID,
+                Recipient:  row.Message.To(),
+                Attachment: row.Attachment,
+                Status:     status,
+            }
+        }
+
+        writeJSON(w, http.StatusAccepted, msa{"status": "accepted", "amount": len(results), "messages": results})
+        return
+    }
+
+    ids := make([]int64, len(queued))
+    for i, row := range queued {
+        ids[i] = row.ID
+    }
+    items, err := outbox.Wait(r.Context(), ids)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error waiting for messages")
+        writeJSON(w, http.StatusInternalServerError, msa{"status": "error", "error": err.Error()})
+        return
+    }
+
+    results := make([]messageResult, len(items))
+    failed := false
+    for i, item := range items {
+        results[i] = messageResult{
+            ID:         item.ID,
+            Recipient:  item.Message.To(),
+            Attachment: queued[i].Attachment,
+            Status:     item.Status,
+            Error:      item.LastError,
+        }
+        failed = failed || item.Status == queue.StatusFailed
+    }
+
+    if failed {
+        writeJSON(w, http.StatusInternalServerError, msa{
+            "status":   "error",
+            "error":    static.SEND_FAILED,
+            "amount":   len(results),
+            "messages": results,
+        })
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, msa{"status": "ok", "amount": len(results), "messages": results})
+}
+
+// Reads and parses the messages in the request body according to its Content-Type
+// Bodies over requestMaxSize are cut short, multipart/form-data ones included
+// Along with the messages come the files uploaded with them, which the caller releases once they are queued
+func readMessages(w http.ResponseWriter, r *http.Request) (*[]parser.Message, []string, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.RequestMaxSize)<<20)
+    defer r.Body.Close()
+
+    if isMultipart(r) {
+        messages, files, err := readMultipart(r)
+        if err != nil {
+            log.Error().Err(err).Msg("WZ: Error reading multipart request")
+            return nil, nil, err
+        }
+        if len(messages) == 0 {
+            uploads.discard(files)
+            return nil, nil, errors.New(static.EMPTY_FIELD)
+        }
+        return &messages, files, nil
+    }
+
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error reading request body")
+        return nil, nil, err
+    }
+
+    contentType := r.Header.Get("Content-Type")
+    p, err := parser.Default.ForContentType(contentType)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error checking Content-Type")
+        return nil, nil, err
+    }
+
+    messages, err := p.Read(body, requestCharset(contentType))
+    if err != nil {
+        log.Error().Err(err).Str("parser", p.Name).Msg("WZ: Error parsing request body")
+        return nil, nil, err
+    }
+    if len(messages) == 0 {
+        return nil, nil, errors.New(static.EMPTY_FIELD)
+    }
+
+    return &messages, nil, nil
+}
+
+// Maps the errors of reading a request to HTTP statuses
+func readErrorStatus(err error) int {
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) || errors.Is(err, media.ErrTooLarge) {
+        return http.StatusRequestEntityTooLarge
+    }
+
+    return http.StatusUnprocessableEntity
+}
+
+// Returns the charset of a request, the configured one when its Content-Type doesn't say
+func requestCharset(contentType string) string {
+    if charset := parser.Charset(contentType); charset != "" {
+        return charset
+    }
+
+    return cfg.Charset
+}
+
+// Lists the rendering errors of a request as {"index", "field", "error"}
+func fieldErrors(errs templates.Errors) []msa {
+    list := make([]msa, len(errs))
+    for i, err := range errs {
+        list[i] = msa{"index": err.Index, "field": err.Field, "error": err.Err.Error()}
+    }
+
+    return list
+}
+
+// Reads a job from the request body, JSON or YAML according to its Content-Type
+// Bodies over requestMaxSize are cut short like the ones of messages
+func readJob(w http.ResponseWriter, r *http.Request) (jobs.Job, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.RequestMaxSize)<<20)
+    defer r.Body.Close()
+
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return jobs.Job{}, err
+    }
+
+    // Jobs are single objects, only the formats that can hold one are accepted
+    p, err := parser.Default.ForContentType(r.Header.Get("Content-Type"))
+    if err != nil {
+        return jobs.Job{}, err
+    }
+    if p.Name != "json" && p.Name != "yaml" {
+        return jobs.Job{}, fmt.Errorf("%s: %s", static.NO_PARSER_FOUND, p.Name)
+    }
+
+    body, err = parser.Decode(body, requestCharset(r.Header.Get("Content-Type")))
+    if err != nil {
+        return jobs.Job{}, err
+    }
+
+    // JSON is valid YAML and the job has the same keys in both
+    var job jobs.Job
+    err = yaml.Unmarshal(body, &job)
+
+    return job, err
+}
+
+// Maps the errors of the scheduler to HTTP statuses
+func jobErrorStatus(err error) int {
+    switch {
+    case errors.Is(err, jobs.ErrJobNotFound):
+        return http.StatusNotFound
+    case errors.Is(err, jobs.ErrConfigJob):
+        return http.StatusConflict
+    }
+
+    return http.StatusUnprocessableEntity
+}
+
+// Writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    jsonR, _ := json.Marshal(v)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(jsonR)
+}
+
+// Lists the messages waiting for their time, the next one first
+func listSchedules(outbox *queue.Queue) ([]scheduledMessage, error) {
+    items, err := outbox.Scheduled()
+    if err != nil {
+        return nil, err
+    }
+
+    schedules := make([]scheduledMessage, len(items))
+    for i, item := range items {
+        schedules[i] = scheduledMessage{
+            ID:        item.ID,
+            Recipient: item.Message.To(),
+            Content:   item.Message.Content,
+            SendAt:    item.NextAttempt,
+            CreatedAt: item.CreatedAt,
+        }
+    }
+
+    return schedules, nil
+}
+
+// Loads a message of the outbox along with its history
+func getStatus(outbox *queue.Queue, id int64) (messageStatus, error) {
+    item, err := outbox.Get(id)
+    if err != nil {
+        return messageStatus{}, err
+    }
+
+    history, err := outbox.History(id)
+    if err != nil {
+        return messageStatus{}, err
+    }
+
+    return messageStatus{Item: item, Recipient: item.Message.To(), History: history}, nil
+}
@@ -0,0 +1,212 @@
+package alias
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/radovskyb/watcher"
+    "github.com/rs/zerolog/log"
+    "gopkg.in/yaml.v3"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// Book maps logical names to the phone numbers, JIDs or contact and group names they stand for
+// It is read from a YAML or JSON file where each name points to one target or a list of them:
+//
+//    ops-oncall:
+//      - "+55 11 99999-0001"
+//      - 5511999990002@s.whatsapp.net
+//    Finance Team: Finance
+type Book struct {
+    path string
+
+    mu      sync.RWMutex
+    aliases map[string][]string
+}
+
+// Loads the alias file at path
+func Load(path string) (*Book, error) {
+    b := &Book{path: path}
+    err := b.reload()
+    if err != nil {
+        return nil, err
+    }
+
+    return b, nil
+}
+
+// Reloads the file every time it changes until it is removed
+// A file that fails to load is logged and the previous aliases are kept
+func (b *Book) Watch(interval time.Duration) {
+    w := watcher.New()
+    w.FilterOps(watcher.Create, watcher.Write, watcher.Rename, watcher.Move)
+    go func() {
+        for {
+            select {
+            case <-w.Event:
+                err := b.reload()
+                if err != nil {
+                    log.Error().Err(err).Str("file", b.path).Msg("WZ: Could not reload aliases, keeping the previous ones")
+                    continue
+                }
+                log.Info().Str("file", b.path).Msg("WZ: Reloaded aliases")
+            case err := <-w.Error:
+                log.Error().Err(err).Str("file", b.path).Msg("WZ: Failed watching aliases")
+            case <-w.Closed:
+                return
+            }
+        }
+    }()
+
+    err := w.Add(b.path)
+    if err != nil {
+        log.Error().Err(err).Str("file", b.path).Msg("WZ: Could not watch aliases")
+        return
+    }
+    err = w.Start(interval)
+    if err != nil {
+        log.Error().Err(err).Str("file", b.path).Msg("WZ: Could not watch aliases")
+    }
+}
+
+// Returns the targets of name, matched ignoring case and surrounding spaces
+func (b *Book) Lookup(name string) ([]string, bool) {
+    if b == nil {
+        return nil, false
+    }
+
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+
+    targets, ok := b.aliases[key(name)]
+
+    return targets, ok
+}
+
+// Replaces a message sent to an alias with one message for each of its targets
+// Messages addressed by phone or JID, or to a name that isn't an alias, are returned as they are
+func (b *Book) Expand(m parser.Message) []parser.Message {
+    if m.Recipient == "" || m.Phone != "" || m.Jid != "" {
+        return []parser.Message{m}
+    }
+
+    targets, ok := b.Lookup(m.Recipient)
+    if !ok {
+        return []parser.Message{m}
+    }
+
+    messages := make([]parser.Message, len(targets))
+    for i, target := range targets {
+        messages[i] = m
+        messages[i].Recipient, messages[i].Phone, messages[i].Jid = "", "", ""
+        switch {
+        case strings.Contains(target, "@"):
+            messages[i].Jid = target
+        case isPhone(target):
+            messages[i].Phone = target
+        default:
+            messages[i].Recipient = target
+        }
+    }
+
+    return messages
+}
+
+// Reads the file again and replaces the aliases when it is valid
+func (b *Book) reload() error {
+    body, err := os.ReadFile(b.path)
+    if err != nil {
+        return err
+    }
+
+    aliases, err := parse(body)
+    if err != nil {
+        return fmt.Errorf("%s: %w", b.path, err)
+    }
+
+    b.mu.Lock()
+    b.aliases = aliases
+    b.mu.Unlock()
+
+    return nil
+}
+
+// Parses the aliases of a file, JSON being valid YAML
+func parse(body []byte) (map[string][]string, error) {
+    var raw map[string]yaml.Node
+    err := yaml.Unmarshal(body, &raw)
+    if err != nil {
+        return nil, err
+    }
+
+    aliases := make(map[string][]string, len(raw))
+    for name, node := range raw {
+        var targets []string
+        switch node.Kind {
+        case yaml.ScalarNode:
+            targets = []string{node.Value}
+        case yaml.SequenceNode:
+            err = node.Decode(&targets)
+        default:
+            err = errors.New(static.INVALID_ALIAS)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("alias %q: %w", name, err)
+        }
+
+        targets, err = validate(targets)
+        if err != nil {
+            return nil, fmt.Errorf("alias %q: %w", name, err)
+        }
+        aliases[key(name)] = targets
+    }
+
+    return aliases, nil
+}
+
+// Checks every target of an alias, so a typo is reported when the file is loaded instead of when sending
+func validate(targets []string) ([]string, error) {
+    valid := make([]string, 0, len(targets))
+    for _, target := range targets {
+        target = strings.TrimSpace(target)
+        switch {
+        case target == "":
+            continue
+        case strings.Contains(target, "@"):
+            err := parser.ValidateJid(target)
+            if err != nil {
+                return nil, err
+            }
+        case isPhone(target):
+            _, err := parser.NormalizePhone(target)
+            if err != nil {
+                return nil, err
+            }
+        }
+        valid = append(valid, target)
+    }
+    if len(valid) == 0 {
+        return nil, errors.New(static.INVALID_ALIAS)
+    }
+
+    return valid, nil
+}
+
+// Phone numbers start with + or are made of digits and separators only, anything else is a contact or group name
+func isPhone(target string) bool {
+    if strings.HasPrefix(target, "+") {
+        return true
+    }
+
+    return strings.Trim(target, "0123456789 -().") == "" && strings.ContainsAny(target, "0123456789")
+}
+
+func key(name string) string {
+    return strings.ToLower(strings.TrimSpace(name))
+}
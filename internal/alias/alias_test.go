@@ -0,0 +1,145 @@
+package alias
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+
+    "github.com/watchzap/internal/parser"
+)
+
+func writeFile(t *testing.T, path string, body string) {
+    t.Helper()
+
+    err := os.WriteFile(path, []byte(body), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestExpand(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "aliases.yaml")
+    writeFile(t, path, `
+ops-oncall:
+  - "+55 11 99999-0001"
+  - 5511999990002@s.whatsapp.net
+  - Ops
+Finance Team: Finance
+`)
+
+    book, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name     string
+        message  parser.Message
+        expected []parser.Message
+    }{
+        {
+            name:    "several targets",
+            message: parser.Message{Recipient: "ops-oncall", Content: "hi"},
+            expected: []parser.Message{
+                {Phone: "+55 11 99999-0001", Content: "hi"},
+                {Jid: "5511999990002@s.whatsapp.net", Content: "hi"},
+                {Recipient: "Ops", Content: "hi"},
+            },
+        },
+        {
+            name:     "single target ignoring case",
+            message:  parser.Message{Recipient: " finance team ", Content: "hi"},
+            expected: []parser.Message{{Recipient: "Finance", Content: "hi"}},
+        },
+        {
+            name:     "not an alias",
+            message:  parser.Message{Recipient: "Alice", Content: "hi"},
+            expected: []parser.Message{{Recipient: "Alice", Content: "hi"}},
+        },
+        {
+            name:     "phone wins over alias",
+            message:  parser.Message{Recipient: "ops-oncall", Phone: "+5511999990003", Content: "hi"},
+            expected: []parser.Message{{Recipient: "ops-oncall", Phone: "+5511999990003", Content: "hi"}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := book.Expand(tt.message)
+            if len(got) != len(tt.expected) {
+                t.Fatalf("expected %d messages, got %+v", len(tt.expected), got)
+            }
+            for i := range got {
+                if !reflect.DeepEqual(got[i], tt.expected[i]) {
+                    t.Errorf("message %d: expected %+v, got %+v", i, tt.expected[i], got[i])
+                }
+            }
+        })
+    }
+}
+
+func TestNilBookExpandsNothing(t *testing.T) {
+    var book *Book
+
+    m := parser.Message{Recipient: "ops-oncall", Content: "hi"}
+    got := book.Expand(m)
+    if len(got) != 1 || !reflect.DeepEqual(got[0], m) {
+        t.Errorf("expected the message unchanged, got %+v", got)
+    }
+}
+
+func TestLoadRejectsInvalidTargets(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+    }{
+        {name: "invalid phone", body: `oncall: "+12"`},
+        {name: "invalid JID", body: `oncall: 123@example.com`},
+        {name: "empty list", body: `oncall: []`},
+        {name: "map target", body: `oncall: {phone: "+5511999990001"}`},
+        {name: "not a map", body: `- oncall`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "aliases.yaml")
+            writeFile(t, path, tt.body)
+
+            _, err := Load(path)
+            if err == nil {
+                t.Error("expected an error")
+            }
+        })
+    }
+}
+
+func TestReloadKeepsPreviousAliasesOnError(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "aliases.json")
+    writeFile(t, path, `{"oncall": ["+5511999990001"]}`)
+
+    book, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    writeFile(t, path, `{"oncall": ["+5511999990002", "+5511999990003"]}`)
+    err = book.reload()
+    if err != nil {
+        t.Fatal(err)
+    }
+    targets, _ := book.Lookup("oncall")
+    if len(targets) != 2 {
+        t.Fatalf("expected the new targets, got %v", targets)
+    }
+
+    writeFile(t, path, `{"oncall": `)
+    err = book.reload()
+    if err == nil {
+        t.Fatal("expected the broken file to fail")
+    }
+    targets, _ = book.Lookup("oncall")
+    if len(targets) != 2 {
+        t.Errorf("expected the previous targets to be kept, got %v", targets)
+    }
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+
+    "github.com/rs/zerolog/log"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+    "golang.org/x/text/unicode/norm"
+)
+
+// A contact or group known by name
+type entry struct {
+    jid   types.JID
+    names []string
+}
+
+// Directory keeps the contacts and groups in memory so a batch of messages doesn't hit WhatsApp for every one
+// Each list is reloaded once its TTL expires or as soon as WhatsApp tells it changed
+type Directory struct {
+    messenger Messenger
+    ttl       time.Duration
+
+    mu               sync.Mutex
+    contacts         []entry
+    groups           []entry
+    contactsLoadedAt time.Time
+    groupsLoadedAt   time.Time
+    contactsStale    bool
+    groupsStale      bool
+}
+
+// Creates an empty directory, it is loaded on the first lookup
+func NewDirectory(messenger Messenger, ttl time.Duration) *Directory {
+    return &Directory{
+        messenger:     messenger,
+        ttl:           ttl,
+        contactsStale: true,
+        groupsStale:   true,
+    }
+}
+
+// Marks the lists touched by evt as stale, meant to be registered as a whatsmeow event handler
+func (d *Directory) HandleEvent(evt any) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    switch evt.(type) {
+    case *events.Contact, *events.PushName:
+        d.contactsStale = true
+    case *events.JoinedGroup, *events.GroupInfo:
+        d.groupsStale = true
+    }
+}
+
+// Returns the groups and contacts called name
+// Exact matches win, the case-insensitive and accent-stripped ones are only used when there is no exact match
+func (d *Directory) Lookup(name string) ([]types.JID, []types.JID, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    err := d.refresh()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    groups := match(d.groups, func(n string) bool { return n == name })
+    contacts := match(d.contacts, func(n string) bool { return n == name })
+    if len(groups)+len(contacts) > 0 {
+        return groups, contacts, nil
+    }
+
+    normalized := NormalizeName(name)
+    groups = match(d.groups, func(n string) bool { return NormalizeName(n) == normalized })
+    contacts = match(d.contacts, func(n string) bool { return NormalizeName(n) == normalized })
+
+    return groups, contacts, nil
+}
+
+// Reloads the lists that are stale or expired
+// A list that fails to reload keeps being used if it was loaded before, better old names than no names
+func (d *Directory) refresh() error {
+    now := time.Now()
+
+    if d.contactsStale || now.Sub(d.contactsLoadedAt) > d.ttl {
+        contacts, err := d.messenger.GetAllContacts()
+        if err != nil && d.contactsLoadedAt.IsZero() {
+            log.Error().Err(err).Msg("WZ: Failed getting contacts")
+            return err
+        }
+
+        if err != nil {
+            log.Warn().Err(err).Msg("WZ: Failed refreshing contacts, using the cached ones")
+        } else {
+            d.contacts = d.contacts[:0]
+            for j, c := range contacts {
+                d.contacts = append(d.contacts, entry{jid: j, names: []string{c.PushName, c.FullName}})
+            }
+            d.contactsLoadedAt = now
+            d.contactsStale = false
+        }
+    }
+
+    if d.groupsStale || now.Sub(d.groupsLoadedAt) > d.ttl {
+        groups, err := d.messenger.GetJoinedGroups()
+        if err != nil && d.groupsLoadedAt.IsZero() {
+            log.Error().Err(err).Msg("WZ: Failed to get joined groups")
+            return err
+        }
+
+        if err != nil {
+            log.Warn().Err(err).Msg("WZ: Failed refreshing groups, using the cached ones")
+        } else {
+            d.groups = d.groups[:0]
+            for _, g := range groups {
+                d.groups = append(d.groups, entry{jid: g.JID, names: []string{g.GroupName.Name}})
+            }
+            d.groupsLoadedAt = now
+            d.groupsStale = false
+        }
+    }
+
+    return nil
+}
+
+// Returns the JIDs of the entries with a name accepted by matches
+func match(entries []entry, matches func(string) bool) []types.JID {
+    var jids []types.JID
+    for _, e := range entries {
+        for _, n := range e.names {
+            if n != "" && matches(n) {
+                jids = append(jids, e.jid)
+                break
+            }
+        }
+    }
+
+    return jids
+}
+
+// Lowercases name, strips its accents and collapses its spaces, so "  José  Ávila" and "jose avila" are the same
+func NormalizeName(name string) string {
+    var b strings.Builder
+    for _, r := range norm.NFD.String(name) {
+        if unicode.Is(unicode.Mn, r) {
+            continue
+        }
+        b.WriteRune(unicode.ToLower(r))
+    }
+
+    return strings.Join(strings.Fields(b.String()), " ")
+}
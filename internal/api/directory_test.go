@@ -0,0 +1,113 @@
+package api
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+func TestDirectoryLookup(t *testing.T) {
+    joseJID := types.NewJID("5511999990003", types.DefaultUserServer)
+    fake := newTestFake()
+    fake.AddContact(joseJID, "José  Ávila", "")
+    directory := NewDirectory(fake, time.Hour)
+
+    tests := []struct {
+        name     string
+        expected []types.JID
+    }{
+        {name: "Alice", expected: []types.JID{aliceJID}},
+        {name: "alice smith", expected: []types.JID{aliceJID}},
+        {name: "jose avila", expected: []types.JID{joseJID}},
+        {name: " JOSÉ ÁVILA ", expected: []types.JID{joseJID}},
+        {name: "ops", expected: []types.JID{opsJID}},
+        {name: "Carol"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            groups, contacts, err := directory.Lookup(tt.name)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            found := append(groups, contacts...)
+            if len(found) != len(tt.expected) || (len(found) > 0 && found[0] != tt.expected[0]) {
+                t.Errorf("expected %v, got %v", tt.expected, found)
+            }
+        })
+    }
+}
+
+func TestDirectoryPrefersExactMatch(t *testing.T) {
+    fake := NewFake()
+    fake.AddContact(aliceJID, "Ana", "")
+    fake.AddContact(bobJID, "ana", "")
+    directory := NewDirectory(fake, time.Hour)
+
+    _, contacts, err := directory.Lookup("ana")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(contacts) != 1 || contacts[0] != bobJID {
+        t.Errorf("expected only the exact match, got %v", contacts)
+    }
+}
+
+func TestDirectoryCaches(t *testing.T) {
+    carolJID := types.NewJID("5511999990004", types.DefaultUserServer)
+    fake := newTestFake()
+    resolver := NewResolver(fake, ResolverOptions{})
+
+    _, _, err := resolver.directory.Lookup("Alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Cached lists are used without asking WhatsApp again
+    fake.AddContact(carolJID, "Carol", "")
+    _, contacts, _ := resolver.directory.Lookup("Carol")
+    if len(contacts) != 0 {
+        t.Fatalf("expected the cached contacts to be used, got %v", contacts)
+    }
+
+    // A contact event makes the next lookup reload the contacts
+    fake.Emit(&events.Contact{JID: carolJID})
+    _, contacts, _ = resolver.directory.Lookup("Carol")
+    if len(contacts) != 1 || contacts[0] != carolJID {
+        t.Fatalf("expected the contacts to be reloaded after the event, got %v", contacts)
+    }
+
+    // A failed reload keeps the cached lists
+    fake.ContactsErr = errors.New("offline")
+    fake.Emit(&events.PushName{JID: carolJID})
+    _, contacts, err = resolver.directory.Lookup("Alice")
+    if err != nil || len(contacts) != 1 {
+        t.Errorf("expected the cached contacts after a failed reload, got %v, %v", contacts, err)
+    }
+}
+
+func TestDirectoryExpires(t *testing.T) {
+    fake := newTestFake()
+    directory := NewDirectory(fake, time.Millisecond)
+
+    _, _, err := directory.Lookup("Ops")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    renamedJID := types.NewJID("120363000000000002", types.GroupServer)
+    fake.AddGroup(renamedJID, "Support")
+    time.Sleep(5 * time.Millisecond)
+
+    groups, _, err := directory.Lookup("Support")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(groups) != 1 || groups[0] != renamedJID {
+        t.Errorf("expected the groups to be reloaded after the TTL, got %v", groups)
+    }
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+    "context"
+    "crypto/sha256"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+    "go.mau.fi/whatsmeow/proto/waCommon"
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+    "google.golang.org/protobuf/proto"
+)
+
+// A message recorded by Fake.SendMessage
+type SentMessage struct {
+    To      types.JID
+    ID      types.MessageID
+    Message *waE2E.Message
+}
+
+// Fake is an in-memory Messenger
+// Contacts and groups are simulated, sent messages and uploads are recorded,
+// and failures can be injected by setting the error fields
+type Fake struct {
+    mu sync.Mutex
+
+    contacts map[types.JID]types.ContactInfo
+    groups   []*types.GroupInfo
+    sent     []SentMessage
+    uploads  [][]byte
+    handlers []whatsmeow.EventHandler
+
+    // Phone numbers on WhatsApp besides the contacts, without the + prefix
+    registered map[string]bool
+
+    // Returned by every call of the matching method when set
+    ContactsErr     error
+    GroupsErr       error
+    UploadErr       error
+    SendErr         error
+    IsOnWhatsAppErr error
+
+    // Returned by SendMessage only for the given recipient
+    SendErrFor map[types.JID]error
+}
+
+// Creates an empty Fake with no contacts or groups
+func NewFake() *Fake {
+    return &Fake{
+        contacts:   map[types.JID]types.ContactInfo{},
+        registered: map[string]bool{},
+        SendErrFor: map[types.JID]error{},
+    }
+}
+
+// Adds a contact with the given push and full name
+func (f *Fake) AddContact(jid types.JID, pushName string, fullName string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.contacts[jid] = types.ContactInfo{
+        Found:    true,
+        PushName: pushName,
+        FullName: fullName,
+    }
+}
+
+// Adds a group the fake user has joined
+func (f *Fake) AddGroup(jid types.JID, name string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.groups = append(f.groups, &types.GroupInfo{
+        JID:       jid,
+        GroupName: types.GroupName{Name: name},
+    })
+}
+
+// Registers a phone number on the fake WhatsApp without adding it to the contacts
+func (f *Fake) Register(phone string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.registered[strings.TrimPrefix(phone, "+")] = true
+}
+
+// Returns a copy of the messages sent so far
+func (f *Fake) Sent() []SentMessage {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    return append([]SentMessage(nil), f.sent...)
+}
+
+// Returns a copy of the media uploaded so far
+func (f *Fake) Uploads() [][]byte {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    return append([][]byte(nil), f.uploads...)
+}
+
+func (f *Fake) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.ContactsErr != nil {
+        return nil, f.ContactsErr
+    }
+
+    contacts := make(map[types.JID]types.ContactInfo, len(f.contacts))
+    for j, c := range f.contacts {
+        contacts[j] = c
+    }
+
+    return contacts, nil
+}
+
+func (f *Fake) GetJoinedGroups() ([]*types.GroupInfo, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.GroupsErr != nil {
+        return nil, f.GroupsErr
+    }
+
+    return append([]*types.GroupInfo(nil), f.groups...), nil
+}
+
+func (f *Fake) Upload(
+    ctx context.Context,
+    data []byte,
+    mediaType whatsmeow.MediaType,
+) (whatsmeow.UploadResponse, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.UploadErr != nil {
+        return whatsmeow.UploadResponse{}, f.UploadErr
+    }
+
+    f.uploads = append(f.uploads, append([]byte(nil), data...))
+    sum := sha256.Sum256(data)
+
+    return whatsmeow.UploadResponse{
+        URL:        fmt.Sprintf("https://fake.invalid/%s/%d", mediaType, len(f.uploads)),
+        DirectPath: fmt.Sprintf("/%s/%d", mediaType, len(f.uploads)),
+        MediaKey:   sum[:],
+        FileSHA256: sum[:],
+        FileLength: uint64(len(data)),
+    }, nil
+}
+
+func (f *Fake) SendMessage(
+    ctx context.Context,
+    to types.JID,
+    message *waE2E.Message,
+) (whatsmeow.SendResponse, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.SendErr != nil {
+        return whatsmeow.SendResponse{}, f.SendErr
+    }
+    if err := f.SendErrFor[to]; err != nil {
+        return whatsmeow.SendResponse{}, err
+    }
+
+    id := types.MessageID(fmt.Sprintf("FAKE%d", len(f.sent)+1))
+    f.sent = append(f.sent, SentMessage{To: to, ID: id, Message: message})
+
+    return whatsmeow.SendResponse{ID: id, Timestamp: time.Now()}, nil
+}
+
+func (f *Fake) AddEventHandler(handler whatsmeow.EventHandler) uint32 {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.handlers = append(f.handlers, handler)
+
+    return uint32(len(f.handlers))
+}
+
+// Hands evt to every registered handler, the way whatsmeow does for events coming from WhatsApp
+func (f *Fake) Emit(evt any) {
+    f.mu.Lock()
+    handlers := append([]whatsmeow.EventHandler(nil), f.handlers...)
+    f.mu.Unlock()
+
+    for _, handler := range handlers {
+        handler(evt)
+    }
+}
+
+func (f *Fake) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.IsOnWhatsAppErr != nil {
+        return nil, f.IsOnWhatsAppErr
+    }
+
+    res := make([]types.IsOnWhatsAppResponse, len(phones))
+    for i, phone := range phones {
+        jid := types.NewJID(strings.TrimPrefix(phone, "+"), types.DefaultUserServer)
+        _, isContact := f.contacts[jid]
+        res[i] = types.IsOnWhatsAppResponse{
+            Query: phone,
+            JID:   jid,
+            IsIn:  isContact || f.registered[jid.User],
+        }
+    }
+
+    return res, nil
+}
+
+// Builds a poll like whatsmeow does, with a fixed secret since the fake doesn't encrypt votes
+func (f *Fake) BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waE2E.Message {
+    options := make([]*waE2E.PollCreationMessage_Option, len(optionNames))
+    for i, option := range optionNames {
+        options[i] = &waE2E.PollCreationMessage_Option{OptionName: proto.String(option)}
+    }
+
+    return &waE2E.Message{
+        PollCreationMessage: &waE2E.PollCreationMessage{
+            Name:                   proto.String(name),
+            Options:                options,
+            SelectableOptionsCount: proto.Uint32(uint32(selectableOptionCount)),
+        },
+        MessageContextInfo: &waE2E.MessageContextInfo{MessageSecret: make([]byte, 32)},
+    }
+}
+
+// Builds a reaction like whatsmeow does, only to messages sent by the fake user
+func (f *Fake) BuildReaction(chat types.JID, sender types.JID, id types.MessageID, reaction string) *waE2E.Message {
+    return &waE2E.Message{
+        ReactionMessage: &waE2E.ReactionMessage{
+            Key: &waCommon.MessageKey{
+                RemoteJID: proto.String(chat.String()),
+                FromMe:    proto.Bool(true),
+                ID:        proto.String(id),
+            },
+            Text:              proto.String(reaction),
+            SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+        },
+    }
+}
+
+// The JID of the fake user, who sends every message
+var FakeOwnID = types.NewJID("5511900000000", types.DefaultUserServer)
+
+func (f *Fake) OwnID() types.JID {
+    return FakeOwnID
+}
+
+// Reads the vote of a poll update whose payload is not encrypted, see Vote
+func (f *Fake) DecryptPollVote(vote *events.Message) (*waE2E.PollVoteMessage, error) {
+    update := vote.Message.GetPollUpdateMessage()
+    if update == nil {
+        return nil, whatsmeow.ErrNotPollUpdateMessage
+    }
+
+    var msg waE2E.PollVoteMessage
+    err := proto.Unmarshal(update.GetVote().GetEncPayload(), &msg)
+    if err != nil {
+        return nil, err
+    }
+
+    return &msg, nil
+}
+
+// Builds the event of voter picking options on the poll sent with the WhatsApp ID pollID
+// The vote is left unencrypted, so only the fake can read it
+func Vote(pollID types.MessageID, chat types.JID, voter types.JID, at time.Time, options ...string) *events.Message {
+    payload, _ := proto.Marshal(&waE2E.PollVoteMessage{SelectedOptions: whatsmeow.HashPollOptions(options)})
+
+    return &events.Message{
+        Info: types.MessageInfo{
+            MessageSource: types.MessageSource{Chat: chat, Sender: voter, IsGroup: chat.Server == types.GroupServer},
+            ID:            types.MessageID(fmt.Sprintf("VOTE%d", at.UnixNano())),
+            Timestamp:     at,
+        },
+        Message: &waE2E.Message{
+            PollUpdateMessage: &waE2E.PollUpdateMessage{
+                PollCreationMessageKey: &waCommon.MessageKey{
+                    RemoteJID: proto.String(chat.String()),
+                    FromMe:    proto.Bool(true),
+                    ID:        proto.String(pollID),
+                },
+                Vote: &waE2E.PollEncValue{EncPayload: payload},
+            },
+        },
+    }
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+    "encoding/base64"
+    "fmt"
+    "strings"
+
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "google.golang.org/protobuf/proto"
+
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+)
+
+// Builds the message of a location, its content shown under the map
+func LocationMessage(m parser.Message) *waE2E.Message {
+    l := m.Location
+
+    return &waE2E.Message{
+        LocationMessage: &waE2E.LocationMessage{
+            DegreesLatitude:  l.Latitude,
+            DegreesLongitude: l.Longitude,
+            Name:             optionalString(l.Name),
+            Address:          optionalString(l.Address),
+            Comment:          optionalString(m.Content),
+        },
+    }
+}
+
+// Builds the message of a contact card
+func ContactMessage(m parser.Message) *waE2E.Message {
+    return &waE2E.Message{
+        ContactMessage: &waE2E.ContactMessage{
+            DisplayName: proto.String(m.Contact.Name),
+            Vcard:       proto.String(VCard(*m.Contact)),
+        },
+    }
+}
+
+// Builds a text message with the preview of a link, the URL being added to the content when missing from it
+// The thumbnail is scaled down like the ones of images, an unreadable one fails with a *media.SourceError
+func LinkMessage(m parser.Message) (*waE2E.Message, error) {
+    l := m.Link
+    text := m.Content
+    if !strings.Contains(text, l.URL) {
+        text = strings.TrimSpace(text + "\n" + l.URL)
+    }
+
+    msg := &waE2E.ExtendedTextMessage{
+        Text:         proto.String(text),
+        MatchedText:  proto.String(l.URL),
+        CanonicalURL: proto.String(l.URL),
+        Title:        optionalString(l.Title),
+        Description:  optionalString(l.Description),
+        PreviewType:  waE2E.ExtendedTextMessage_NONE.Enum(),
+    }
+    if l.Thumbnail != "" {
+        data, err := base64.StdEncoding.DecodeString(l.Thumbnail)
+        if err == nil {
+            var thumbnail media.Image
+            thumbnail, err = media.ParseImage(data)
+            msg.JPEGThumbnail = thumbnail.Thumbnail
+        }
+        if err != nil {
+            return nil, &media.SourceError{Source: "link thumbnail", Err: err}
+        }
+    }
+
+    return &waE2E.Message{ExtendedTextMessage: msg}, nil
+}
+
+// Returns the vCard of a contact, each phone with the waid WhatsApp uses to offer a chat with it
+func VCard(c parser.Contact) string {
+    name := vcardEscape(c.Name)
+    lines := []string{
+        "BEGIN:VCARD",
+        "VERSION:3.0",
+        fmt.Sprintf("N:;%s;;;", name),
+        "FN:" + name,
+    }
+    for _, phone := range c.Phones {
+        digits, err := parser.NormalizePhone(phone)
+        if err != nil {
+            // Validated with the message, so only a producer bypassing it gets here
+            continue
+        }
+        lines = append(lines, fmt.Sprintf("TEL;type=CELL;waid=%s:+%s", digits, digits))
+    }
+    lines = append(lines, "END:VCARD")
+
+    return strings.Join(lines, "\n")
+}
+
+// Escapes the characters vCard gives a meaning to
+func vcardEscape(value string) string {
+    return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// Returns a pointer to value, or nil when it is empty, so the field is left out of the message
+func optionalString(value string) *string {
+    if value == "" {
+        return nil
+    }
+
+    return proto.String(value)
+}
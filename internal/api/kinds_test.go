@@ -0,0 +1,111 @@
+package api
+
+import (
+    "bytes"
+    "encoding/base64"
+    "errors"
+    "image/jpeg"
+    "testing"
+    "time"
+
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+)
+
+func TestGenerateMessageKinds(t *testing.T) {
+    loader := media.NewLoader(1<<20, time.Second)
+    lat, long := -23.5613, -46.6565
+
+    msg, err := GenerateMessage(NewFake(), loader, parser.Message{
+        Kind:     parser.KindLocation,
+        Content:  "Meet here",
+        Location: &parser.Location{Latitude: &lat, Longitude: &long, Name: "MASP"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    location := msg.GetLocationMessage()
+    if location.GetDegreesLatitude() != lat || location.GetDegreesLongitude() != long ||
+        location.GetName() != "MASP" || location.GetComment() != "Meet here" || location.Address != nil {
+        t.Errorf("unexpected location %v", msg)
+    }
+
+    msg, err = GenerateMessage(NewFake(), loader, parser.Message{
+        Kind:    parser.KindContact,
+        Contact: &parser.Contact{Name: "Support", Phones: []string{"+5511988887777"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if contact := msg.GetContactMessage(); contact.GetDisplayName() != "Support" || contact.GetVcard() == "" {
+        t.Errorf("unexpected contact %v", msg)
+    }
+
+    msg, err = GenerateMessage(NewFake(), loader, parser.Message{
+        Content: "Read the news",
+        Link: &parser.Link{
+            URL:       "https://example.com/news",
+            Title:     "News",
+            Thumbnail: base64.StdEncoding.EncodeToString(png),
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    text := msg.GetExtendedTextMessage()
+    if text.GetText() != "Read the news\nhttps://example.com/news" ||
+        text.GetMatchedText() != "https://example.com/news" || text.GetTitle() != "News" || text.Description != nil {
+        t.Errorf("unexpected link %v", msg)
+    }
+    if _, err := jpeg.Decode(bytes.NewReader(text.GetJPEGThumbnail())); err != nil {
+        t.Errorf("expected a JPEG thumbnail, got %v", err)
+    }
+
+    // The URL is not repeated when the content has it already
+    msg, err = GenerateMessage(NewFake(), loader, parser.Message{
+        Content: "See https://example.com/news today",
+        Link:    &parser.Link{URL: "https://example.com/news"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if text := msg.GetExtendedTextMessage(); text.GetText() != "See https://example.com/news today" {
+        t.Errorf("unexpected text %q", text.GetText())
+    }
+
+    msg, err = GenerateMessage(NewFake(), loader, parser.Message{
+        Kind: parser.KindPoll,
+        Poll: &parser.Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}, SelectableCount: 1},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    poll := msg.GetPollCreationMessage()
+    if poll.GetName() != "Lunch?" || len(poll.GetOptions()) != 2 || poll.GetOptions()[1].GetOptionName() != "Sushi" ||
+        poll.GetSelectableOptionsCount() != 1 || msg.GetMessageContextInfo().GetMessageSecret() == nil {
+        t.Errorf("unexpected poll %v", msg)
+    }
+
+    _, err = GenerateMessage(NewFake(), loader, parser.Message{
+        Content: "hi",
+        Link:    &parser.Link{URL: "https://example.com", Thumbnail: base64.StdEncoding.EncodeToString([]byte("text"))},
+    })
+    var sourceErr *media.SourceError
+    if !errors.As(err, &sourceErr) {
+        t.Errorf("expected a source error for a thumbnail that is not an image, got %v", err)
+    }
+}
+
+func TestVCard(t *testing.T) {
+    card := VCard(parser.Contact{Name: "Silva, Ana; Support", Phones: []string{"+55 (11) 98888-7777", "+14155550100"}})
+    expected := "BEGIN:VCARD\n" +
+        "VERSION:3.0\n" +
+        `N:;Silva\, Ana\; Support;;;` + "\n" +
+        `FN:Silva\, Ana\; Support` + "\n" +
+        "TEL;type=CELL;waid=5511988887777:+5511988887777\n" +
+        "TEL;type=CELL;waid=14155550100:+14155550100\n" +
+        "END:VCARD"
+    if card != expected {
+        t.Errorf("expected\n%s\ngot\n%s", expected, card)
+    }
+}
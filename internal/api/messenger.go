@@ -0,0 +1,28 @@
+package api
+
+import (
+    "context"
+
+    "go.mau.fi/whatsmeow"
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+// Messenger is everything watchzap needs from WhatsApp
+// Whatsapp implements it on top of whatsmeow and Fake keeps everything in memory for tests
+type Messenger interface {
+    GetAllContacts() (map[types.JID]types.ContactInfo, error)
+    GetJoinedGroups() ([]*types.GroupInfo, error)
+    Upload(ctx context.Context, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+    SendMessage(ctx context.Context, to types.JID, message *waE2E.Message) (whatsmeow.SendResponse, error)
+    AddEventHandler(handler whatsmeow.EventHandler) uint32
+    IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error)
+    BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waE2E.Message
+    BuildReaction(chat types.JID, sender types.JID, id types.MessageID, reaction string) *waE2E.Message
+    DecryptPollVote(vote *events.Message) (*waE2E.PollVoteMessage, error)
+    OwnID() types.JID
+}
+
+var _ Messenger = (*Whatsapp)(nil)
+var _ Messenger = (*Fake)(nil)
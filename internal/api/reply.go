@@ -0,0 +1,112 @@
+package api
+
+import (
+    "strings"
+    "unicode"
+    "unicode/utf8"
+
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/types"
+    "google.golang.org/protobuf/proto"
+
+    "github.com/watchzap/internal/parser"
+)
+
+// Builds the copy of a message shown above the replies to it
+// Attachments are not uploaded again, so quoted media shows as its caption, or its file name without one
+func QuotedMessage(m parser.Message) *waE2E.Message {
+    switch m.MessageKind() {
+    case parser.KindLocation:
+        return LocationMessage(m)
+    case parser.KindContact:
+        return ContactMessage(m)
+    case parser.KindPoll:
+        options := make([]*waE2E.PollCreationMessage_Option, len(m.Poll.Options))
+        for i, option := range m.Poll.Options {
+            options[i] = &waE2E.PollCreationMessage_Option{OptionName: proto.String(option)}
+        }
+        return &waE2E.Message{
+            PollCreationMessage: &waE2E.PollCreationMessage{
+                Name:                   proto.String(m.Poll.Question),
+                Options:                options,
+                SelectableOptionsCount: proto.Uint32(uint32(m.Poll.SelectableCount)),
+            },
+        }
+    }
+
+    text := m.Content
+    if text == "" && m.HasAttachment() {
+        text = Filename(m, m.Mimetype)
+    }
+
+    return &waE2E.Message{Conversation: proto.String(text)}
+}
+
+// Returns text with the mention of jid written as @ and its number, which WhatsApp shows as the name of the person
+// Where text has @ and the mention as it was given it is replaced, otherwise the mention is added at the end
+// Only whole words are replaced, so a mention of Bob leaves @Bobby alone
+func MentionText(text string, mention string, jid types.JID) string {
+    tag := "@" + jid.User
+    text = replaceWord(text, "@"+mention, tag)
+    // Removing the tag changes nothing when text doesn't have it as a whole word
+    if replaceWord(text, tag, "") == text {
+        text = strings.TrimSpace(text + " " + tag)
+    }
+
+    return text
+}
+
+// Replaces the occurrences of old in text that are not followed by a letter, digit or underscore
+func replaceWord(text string, old string, new string) string {
+    var b strings.Builder
+    for {
+        i := strings.Index(text, old)
+        if i < 0 {
+            break
+        }
+
+        end := i + len(old)
+        next, _ := utf8.DecodeRuneInString(text[end:])
+        b.WriteString(text[:i])
+        if end < len(text) && (unicode.IsLetter(next) || unicode.IsDigit(next) || next == '_') {
+            b.WriteString(old)
+        } else {
+            b.WriteString(new)
+        }
+        text = text[end:]
+    }
+    b.WriteString(text)
+
+    return b.String()
+}
+
+// Sets the context of msg, the message it replies to and who it mentions
+// Plain text has no context, so it becomes an extended text message
+func SetContextInfo(msg *waE2E.Message, info *waE2E.ContextInfo) *waE2E.Message {
+    switch {
+    case msg.Conversation != nil:
+        return &waE2E.Message{
+            ExtendedTextMessage: &waE2E.ExtendedTextMessage{Text: msg.Conversation, ContextInfo: info},
+        }
+    case msg.ExtendedTextMessage != nil:
+        msg.ExtendedTextMessage.ContextInfo = info
+    case msg.ImageMessage != nil:
+        msg.ImageMessage.ContextInfo = info
+    case msg.VideoMessage != nil:
+        msg.VideoMessage.ContextInfo = info
+    case msg.AudioMessage != nil:
+        msg.AudioMessage.ContextInfo = info
+    case msg.DocumentMessage != nil:
+        msg.DocumentMessage.ContextInfo = info
+    case msg.StickerMessage != nil:
+        msg.StickerMessage.ContextInfo = info
+    case msg.LocationMessage != nil:
+        msg.LocationMessage.ContextInfo = info
+    case msg.ContactMessage != nil:
+        msg.ContactMessage.ContextInfo = info
+    case msg.PollCreationMessage != nil:
+        msg.PollCreationMessage.ContextInfo = info
+    }
+
+    return msg
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+    "testing"
+
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "google.golang.org/protobuf/proto"
+
+    "github.com/watchzap/internal/parser"
+)
+
+func TestQuotedMessage(t *testing.T) {
+    lat, long := -23.5613, -46.6565
+
+    quoted := QuotedMessage(parser.Message{Recipient: "Ops", Content: "Disk full"})
+    if quoted.GetConversation() != "Disk full" {
+        t.Errorf("unexpected quote of text %v", quoted)
+    }
+    quoted = QuotedMessage(parser.Message{Recipient: "Ops", AttachmentPath: "/media/chart.png"})
+    if quoted.GetConversation() != "chart.png" {
+        t.Errorf("expected a quoted attachment without caption to show its file name, got %v", quoted)
+    }
+    quoted = QuotedMessage(parser.Message{
+        Kind:     parser.KindLocation,
+        Location: &parser.Location{Latitude: &lat, Longitude: &long},
+    })
+    if quoted.GetLocationMessage().GetDegreesLatitude() != lat {
+        t.Errorf("unexpected quote of location %v", quoted)
+    }
+    quoted = QuotedMessage(parser.Message{
+        Kind: parser.KindPoll,
+        Poll: &parser.Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}},
+    })
+    // Only the poll itself is quoted, its secret stays with the sent poll
+    if poll := quoted.GetPollCreationMessage(); poll.GetName() != "Lunch?" || len(poll.GetOptions()) != 2 ||
+        quoted.MessageContextInfo != nil {
+        t.Errorf("unexpected quote of poll %v", quoted)
+    }
+}
+
+func TestMentionText(t *testing.T) {
+    tests := []struct {
+        text     string
+        mention  string
+        expected string
+    }{
+        {text: "@Alice the disk is full", mention: "Alice", expected: "@5511999990001 the disk is full"},
+        {text: "cc @+5511999990001", mention: "+5511999990001", expected: "cc @5511999990001"},
+        {text: "The disk is full", mention: "Alice", expected: "The disk is full @5511999990001"},
+        {text: "", mention: "Alice", expected: "@5511999990001"},
+        // Longer names starting with the mention are other people
+        {text: "@Alice and @Alicia", mention: "Alice", expected: "@5511999990001 and @Alicia"},
+        {text: "@Alicia, @Alice_2", mention: "Alice", expected: "@Alicia, @Alice_2 @5511999990001"},
+        {text: "@Alice, @Alice!", mention: "Alice", expected: "@5511999990001, @5511999990001!"},
+        {text: "cc @55119999900012", mention: "Bob", expected: "cc @55119999900012 @5511999990001"},
+    }
+    for _, tt := range tests {
+        if text := MentionText(tt.text, tt.mention, aliceJID); text != tt.expected {
+            t.Errorf("%q: expected %q, got %q", tt.text, tt.expected, text)
+        }
+    }
+}
+
+func TestSetContextInfo(t *testing.T) {
+    info := &waE2E.ContextInfo{StanzaID: proto.String("FAKE1")}
+
+    msg := SetContextInfo(&waE2E.Message{Conversation: proto.String("hi")}, info)
+    if msg.Conversation != nil || msg.GetExtendedTextMessage().GetText() != "hi" ||
+        msg.GetExtendedTextMessage().GetContextInfo() != info {
+        t.Errorf("expected text to become an extended text message, got %v", msg)
+    }
+
+    msg = SetContextInfo(&waE2E.Message{ImageMessage: &waE2E.ImageMessage{Caption: proto.String("chart")}}, info)
+    if msg.GetImageMessage().GetContextInfo() != info {
+        t.Errorf("expected the image to get the context, got %v", msg)
+    }
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/rs/zerolog/log"
+    "go.mau.fi/whatsmeow/types"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// Policies deciding what happens when a name matches more than one contact or group
+const (
+    // Rejects the message
+    PolicyStrict = "strict"
+    // Picks the group if exactly one group matches, otherwise behaves like strict
+    PolicyPreferGroup = "prefer-group"
+    // Picks the contact if exactly one contact matches, otherwise behaves like strict
+    PolicyPreferContact = "prefer-contact"
+    // Picks the first match, groups before contacts and each sorted by JID
+    PolicyFirst = "first"
+)
+
+// Checks that policy is one of the known recipient policies
+func ValidatePolicy(policy string) error {
+    switch policy {
+    case PolicyStrict, PolicyPreferGroup, PolicyPreferContact, PolicyFirst:
+        return nil
+    }
+
+    return fmt.Errorf("%s: %q", static.INVALID_POLICY, policy)
+}
+
+// RecipientError is returned when a message has nobody to go to, retrying won't change that
+type RecipientError struct {
+    Reason    string
+    Recipient string
+    // Every JID matching the recipient when it is ambiguous
+    Candidates []types.JID
+}
+
+func (e *RecipientError) Error() string {
+    if len(e.Candidates) == 0 {
+        return e.Reason + ": " + e.Recipient
+    }
+
+    candidates := make([]string, len(e.Candidates))
+    for i, c := range e.Candidates {
+        candidates[i] = c.String()
+    }
+
+    return fmt.Sprintf("%s: %s (candidates: %s)", e.Reason, e.Recipient, strings.Join(candidates, ", "))
+}
+
+// Settings of a Resolver
+type ResolverOptions struct {
+    // Asks WhatsApp whether a phone number is registered before sending to it
+    CheckRegistered bool
+    // What to do when a name matches several contacts or groups, strict when empty
+    Policy string
+    // How long the contacts and groups are kept in memory, 10 minutes when zero
+    DirectoryTTL time.Duration
+}
+
+// Resolver finds the JID a message is meant for
+type Resolver struct {
+    messenger Messenger
+    options   ResolverOptions
+    directory *Directory
+}
+
+// Creates a resolver looking contacts and groups up through messenger
+// The directory is kept up to date with the contact and group events of messenger
+func NewResolver(messenger Messenger, options ResolverOptions) *Resolver {
+    if options.Policy == "" {
+        options.Policy = PolicyStrict
+    }
+    if options.DirectoryTTL == 0 {
+        options.DirectoryTTL = 10 * time.Minute
+    }
+
+    directory := NewDirectory(messenger, options.DirectoryTTL)
+    messenger.AddEventHandler(directory.HandleEvent)
+
+    return &Resolver{
+        messenger: messenger,
+        options:   options,
+        directory: directory,
+    }
+}
+
+// Returns the JID m should be sent to
+// An explicit jid wins over phone, and the recipient name is only looked up when neither is set
+func (r *Resolver) Resolve(m parser.Message) (types.JID, error) {
+    switch {
+    case m.Jid != "":
+        return r.resolveJid(m.Jid)
+    case m.Phone != "":
+        return r.resolvePhone(m.Phone)
+    }
+
+    return r.resolveName(m.Recipient)
+}
+
+// Returns the JID of someone mentioned in a message, by phone number with the + prefix or else by contact name
+// Groups can't be mentioned, so names are only matched against the contacts
+func (r *Resolver) ResolveMention(mention string) (types.JID, error) {
+    if strings.HasPrefix(mention, "+") {
+        return r.resolvePhone(mention)
+    }
+
+    _, contacts, err := r.directory.Lookup(mention)
+    if err != nil {
+        return types.JID{}, err
+    }
+
+    return r.pick(mention, nil, contacts)
+}
+
+func (r *Resolver) resolveJid(jid string) (types.JID, error) {
+    err := parser.ValidateJid(jid)
+    if err != nil {
+        return types.JID{}, &RecipientError{Reason: static.INVALID_JID, Recipient: jid}
+    }
+
+    parsed, err := types.ParseJID(jid)
+    if err != nil {
+        return types.JID{}, &RecipientError{Reason: static.INVALID_JID, Recipient: jid}
+    }
+
+    return parsed, nil
+}
+
+func (r *Resolver) resolvePhone(phone string) (types.JID, error) {
+    digits, err := parser.NormalizePhone(phone)
+    if err != nil {
+        return types.JID{}, &RecipientError{Reason: static.INVALID_PHONE, Recipient: phone}
+    }
+
+    if !r.options.CheckRegistered {
+        return types.NewJID(digits, types.DefaultUserServer), nil
+    }
+
+    res, err := r.messenger.IsOnWhatsApp([]string{"+" + digits})
+    if err != nil {
+        log.Error().Err(err).Str("phone", phone).Msg("WZ: Failed checking phone registration")
+        return types.JID{}, err
+    }
+
+    // WhatsApp answers with the canonical JID, which may differ from the number asked for
+    for _, r := range res {
+        if r.IsIn {
+            return r.JID, nil
+        }
+    }
+
+    return types.JID{}, &RecipientError{Reason: static.NOT_ON_WHATSAPP, Recipient: phone}
+}
+
+func (r *Resolver) resolveName(name string) (types.JID, error) {
+    groups, contacts, err := r.directory.Lookup(name)
+    if err != nil {
+        return types.JID{}, err
+    }
+
+    return r.pick(name, groups, contacts)
+}
+
+// Chooses among the groups and contacts matching name according to the policy
+// Sending to the wrong person is worse than not sending, so anything unclear is rejected
+func (r *Resolver) pick(name string, groups []types.JID, contacts []types.JID) (types.JID, error) {
+    sortJIDs(groups)
+    sortJIDs(contacts)
+    candidates := append(append([]types.JID{}, groups...), contacts...)
+
+    switch {
+    case len(candidates) == 0:
+        return types.JID{}, &RecipientError{Reason: static.RECIPIENT_NOT_FOUND, Recipient: name}
+    case len(candidates) == 1:
+        return candidates[0], nil
+    case r.options.Policy == PolicyFirst:
+        return candidates[0], nil
+    case r.options.Policy == PolicyPreferGroup && len(groups) == 1:
+        return groups[0], nil
+    case r.options.Policy == PolicyPreferContact && len(contacts) == 1:
+        return contacts[0], nil
+    case r.options.Policy == PolicyPreferGroup && len(groups) == 0 && len(contacts) == 1:
+        return contacts[0], nil
+    case r.options.Policy == PolicyPreferContact && len(contacts) == 0 && len(groups) == 1:
+        return groups[0], nil
+    }
+
+    log.Warn().
+        Str("recipient", name).
+        Str("policy", r.options.Policy).
+        Int("candidates", len(candidates)).
+        Msg("WZ: Ambiguous recipient")
+
+    return types.JID{}, &RecipientError{
+        Reason:     static.AMBIGUOUS_RECIPIENT,
+        Recipient:  name,
+        Candidates: candidates,
+    }
+}
+
+func sortJIDs(jids []types.JID) {
+    sort.Slice(jids, func(i, j int) bool {
+        return jids[i].String() < jids[j].String()
+    })
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+    "errors"
+    "testing"
+
+    "go.mau.fi/whatsmeow/types"
+
+    "github.com/watchzap/internal/parser"
+)
+
+var (
+    aliceJID = types.NewJID("5511999990001", types.DefaultUserServer)
+    bobJID   = types.NewJID("5511999990002", types.DefaultUserServer)
+    opsJID   = types.NewJID("120363000000000001", types.GroupServer)
+)
+
+func newTestFake() *Fake {
+    fake := NewFake()
+    fake.AddContact(aliceJID, "Alice", "Alice Smith")
+    fake.AddContact(bobJID, "Bob", "")
+    fake.AddGroup(opsJID, "Ops")
+
+    return fake
+}
+
+func TestResolve(t *testing.T) {
+    tests := []struct {
+        name            string
+        message         parser.Message
+        checkRegistered bool
+        expected        types.JID
+        recipientErr    bool
+    }{
+        {
+            name:     "contact push name",
+            message:  parser.Message{Recipient: "Alice"},
+            expected: aliceJID,
+        },
+        {
+            name:     "contact full name",
+            message:  parser.Message{Recipient: "Alice Smith"},
+            expected: aliceJID,
+        },
+        {
+            name:     "group name",
+            message:  parser.Message{Recipient: "Ops"},
+            expected: opsJID,
+        },
+        {
+            name:         "unknown name",
+            message:      parser.Message{Recipient: "Carol"},
+            recipientErr: true,
+        },
+        {
+            name:     "phone not in contacts",
+            message:  parser.Message{Phone: "+1 (555) 010-0000"},
+            expected: types.NewJID("15550100000", types.DefaultUserServer),
+        },
+        {
+            name:     "phone wins over name",
+            message:  parser.Message{Recipient: "Alice", Phone: "+5511999990002"},
+            expected: bobJID,
+        },
+        {
+            name:     "jid wins over phone",
+            message:  parser.Message{Phone: "+5511999990002", Jid: opsJID.String()},
+            expected: opsJID,
+        },
+        {
+            name:         "invalid jid",
+            message:      parser.Message{Jid: "alice@example.com"},
+            recipientErr: true,
+        },
+        {
+            name:            "registered phone",
+            message:         parser.Message{Phone: "+5511999990001"},
+            checkRegistered: true,
+            expected:        aliceJID,
+        },
+        {
+            name:            "unregistered phone",
+            message:         parser.Message{Phone: "+15550100000"},
+            checkRegistered: true,
+            recipientErr:    true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            jid, err := NewResolver(newTestFake(), ResolverOptions{CheckRegistered: tt.checkRegistered}).Resolve(tt.message)
+
+            var recipientErr *RecipientError
+            if tt.recipientErr {
+                if !errors.As(err, &recipientErr) {
+                    t.Fatalf("expected a recipient error, got %v", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if jid != tt.expected {
+                t.Errorf("expected %v, got %v", tt.expected, jid)
+            }
+        })
+    }
+}
+
+func TestResolveLookupFailure(t *testing.T) {
+    fake := newTestFake()
+    fake.GroupsErr = errors.New("offline")
+
+    _, err := NewResolver(fake, ResolverOptions{}).Resolve(parser.Message{Recipient: "Alice"})
+
+    var recipientErr *RecipientError
+    if err == nil || errors.As(err, &recipientErr) {
+        t.Errorf("expected a retryable error, got %v", err)
+    }
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+    carolJID := types.NewJID("5511999990003", types.DefaultUserServer)
+    otherCarolJID := types.NewJID("5511999990004", types.DefaultUserServer)
+    carolGroupJID := types.NewJID("120363000000000002", types.GroupServer)
+    opsContactJID := types.NewJID("5511999990005", types.DefaultUserServer)
+
+    fake := newTestFake()
+    fake.AddContact(carolJID, "Carol", "")
+    fake.AddContact(otherCarolJID, "", "Carol")
+    fake.AddGroup(carolGroupJID, "Carol")
+    fake.AddContact(opsContactJID, "Ops", "")
+
+    tests := []struct {
+        policy    string
+        recipient string
+        expected  types.JID
+        ambiguous bool
+    }{
+        {policy: PolicyStrict, recipient: "Ops", ambiguous: true},
+        {policy: PolicyStrict, recipient: "Alice", expected: aliceJID},
+        {policy: PolicyPreferGroup, recipient: "Ops", expected: opsJID},
+        {policy: PolicyPreferContact, recipient: "Ops", expected: opsContactJID},
+        {policy: PolicyPreferGroup, recipient: "Carol", expected: carolGroupJID},
+        {policy: PolicyPreferContact, recipient: "Carol", ambiguous: true},
+        {policy: PolicyFirst, recipient: "Carol", expected: carolGroupJID},
+        {policy: PolicyFirst, recipient: "Ops", expected: opsJID},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.policy+" "+tt.recipient, func(t *testing.T) {
+            resolver := NewResolver(fake, ResolverOptions{Policy: tt.policy})
+
+            // Run a few times, map iteration order must not matter
+            for i := 0; i < 10; i++ {
+                jid, err := resolver.Resolve(parser.Message{Recipient: tt.recipient})
+                if tt.ambiguous {
+                    var recipientErr *RecipientError
+                    if !errors.As(err, &recipientErr) || len(recipientErr.Candidates) < 2 {
+                        t.Fatalf("expected an ambiguous recipient error, got %v", err)
+                    }
+                    continue
+                }
+
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if jid != tt.expected {
+                    t.Fatalf("expected %v, got %v", tt.expected, jid)
+                }
+            }
+        })
+    }
+}
+
+func TestResolveMention(t *testing.T) {
+    fake := newTestFake()
+    fake.AddContact(types.NewJID("5511999990005", types.DefaultUserServer), "Ops", "")
+    resolver := NewResolver(fake, ResolverOptions{Policy: PolicyPreferGroup})
+
+    tests := []struct {
+        mention  string
+        expected types.JID
+    }{
+        {mention: "Alice Smith", expected: aliceJID},
+        {mention: "+55 11 99999-0002", expected: bobJID},
+        // A group of the same name doesn't count, whatever the policy
+        {mention: "Ops", expected: types.NewJID("5511999990005", types.DefaultUserServer)},
+    }
+    for _, tt := range tests {
+        jid, err := resolver.ResolveMention(tt.mention)
+        if err != nil || jid != tt.expected {
+            t.Errorf("%s: expected %v, got %v, %v", tt.mention, tt.expected, jid, err)
+        }
+    }
+
+    for _, mention := range []string{"Carol", "+123"} {
+        _, err := resolver.ResolveMention(mention)
+        var recipientErr *RecipientError
+        if !errors.As(err, &recipientErr) {
+            t.Errorf("%s: expected a recipient error, got %v", mention, err)
+        }
+    }
+}
+
+func TestAmbiguousErrorListsCandidates(t *testing.T) {
+    err := &RecipientError{
+        Reason:     "Ambiguous recipient",
+        Recipient:  "Ops",
+        Candidates: []types.JID{opsJID, aliceJID},
+    }
+
+    expected := "Ambiguous recipient: Ops (candidates: 120363000000000001@g.us, 5511999990001@s.whatsapp.net)"
+    if err.Error() != expected {
+        t.Errorf("expected %q, got %q", expected, err.Error())
+    }
+}
@@ -5,7 +5,11 @@ import (
     "errors"
     "fmt"
     "go.mau.fi/whatsmeow/proto/waE2E"
+    "mime"
+    "net/url"
     "os"
+    "path"
+    "path/filepath"
     "strings"
 
     "github.com/gabriel-vasile/mimetype"
@@ -15,9 +19,13 @@ import (
     "go.mau.fi/whatsmeow"
     waProto "go.mau.fi/whatsmeow/binary/proto"
     "go.mau.fi/whatsmeow/store/sqlstore"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
     waLog "go.mau.fi/whatsmeow/util/log"
     "google.golang.org/protobuf/proto"
 
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/media"
     "github.com/watchzap/internal/parser"
     "github.com/watchzap/internal/static"
 )
@@ -38,7 +46,7 @@ func NewWhatsapp(debug bool) (*Whatsapp, error) {
         clientLog = waLog.Stdout("Client", "DEBUG", true)
     }
 
-    container, err := sqlstore.New("sqlite3", "file:zap.db?_foreign_keys=on", dbLog)
+    container, err := sqlstore.New("sqlite3", database.URI, dbLog)
     if err != nil {
         return nil, err
     }
@@ -93,35 +101,154 @@ func (w *Whatsapp) Login() error {
     return nil
 }
 
-func (w *Whatsapp) GenerateMessage(
+// Returns every contact stored for the logged in device
+func (w *Whatsapp) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+    return w.Client.Store.Contacts.GetAllContacts()
+}
+
+// Returns the groups the logged in user takes part in
+func (w *Whatsapp) GetJoinedGroups() ([]*types.GroupInfo, error) {
+    return w.Client.GetJoinedGroups()
+}
+
+// Uploads media to the WhatsApp servers
+func (w *Whatsapp) Upload(
+    ctx context.Context,
+    data []byte,
+    mediaType whatsmeow.MediaType,
+) (whatsmeow.UploadResponse, error) {
+    return w.Client.Upload(ctx, data, mediaType)
+}
+
+// Sends a message to a contact or group
+func (w *Whatsapp) SendMessage(
+    ctx context.Context,
+    to types.JID,
+    message *waE2E.Message,
+) (whatsmeow.SendResponse, error) {
+    return w.Client.SendMessage(ctx, to, message)
+}
+
+// Registers a handler for the events emitted by whatsmeow, like receipts
+func (w *Whatsapp) AddEventHandler(handler whatsmeow.EventHandler) uint32 {
+    return w.Client.AddEventHandler(handler)
+}
+
+// Checks which of the phone numbers, in international format with the + prefix, are registered on WhatsApp
+func (w *Whatsapp) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error) {
+    return w.Client.IsOnWhatsApp(phones)
+}
+
+// Builds a poll, with the secret its votes are encrypted with
+// The secret is stored by SendMessage, which is what lets DecryptPollVote read the votes later
+func (w *Whatsapp) BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waE2E.Message {
+    return w.Client.BuildPollCreation(name, optionNames, selectableOptionCount)
+}
+
+// Builds a reaction to the message id of chat, sent by sender or by us when sender is empty
+func (w *Whatsapp) BuildReaction(
+    chat types.JID,
+    sender types.JID,
+    id types.MessageID,
+    reaction string,
+) *waE2E.Message {
+    return w.Client.BuildReaction(chat, sender, id, reaction)
+}
+
+// Decrypts a vote on one of our polls, vote being the message carrying the poll update
+func (w *Whatsapp) DecryptPollVote(vote *events.Message) (*waE2E.PollVoteMessage, error) {
+    return w.Client.DecryptPollVote(vote)
+}
+
+// Returns the JID of the logged in user, empty before logging in
+func (w *Whatsapp) OwnID() types.JID {
+    if w.Client.Store.ID == nil {
+        return types.EmptyJID
+    }
+
+    return w.Client.Store.ID.ToNonAD()
+}
+
+// Builds the WhatsApp message for m, by its kind, uploading its attachment through messenger when there is one
+// The attachment is read by loader into a single buffer that is handed to the upload as is, it is not streamed
+// since the pinned whatsmeow only uploads byte slices, so memory is bounded by mediaMaxSize instead
+// Voice notes, GIFs and stickers must be in the format WhatsApp plays, otherwise a *media.SourceError is returned
+func GenerateMessage(
+    messenger Messenger,
+    loader *media.Loader,
     m parser.Message,
 ) (*waProto.Message, error) {
-    if m.Attachment == "" {
+    switch m.MessageKind() {
+    case parser.KindLocation:
+        return LocationMessage(m), nil
+    case parser.KindContact:
+        return ContactMessage(m), nil
+    case parser.KindPoll:
+        return messenger.BuildPollCreation(m.Poll.Question, m.Poll.Options, m.Poll.SelectableCount), nil
+    }
+    if m.Link != nil {
+        return LinkMessage(m)
+    }
+    if !m.HasAttachment() {
         return &waProto.Message{Conversation: proto.String(m.Content)}, nil
     }
 
-    decodedAttachment, err := static.DecodeBase64(m.Attachment)
+    data, err := loader.Load(context.Background(), MediaSource(m))
     if err != nil {
         return nil, err
     }
 
-    mimeType := mimetype.Detect([]byte(decodedAttachment)).String()
+    mimeType := Mimetype(m, data)
+    sendAs := SendAs(m, mimeType)
+
+    // Checked before uploading, a file of the wrong format would be sent for nothing
+    // Images and videos only get their preview and size when they can be read, and are sent without them otherwise
+    var picture media.Image
+    var video media.Mp4
+    var voice media.Opus
+    var sticker media.Webp
+    switch sendAs {
+    case parser.SendAsImage:
+        picture, _ = media.ParseImage(data)
+    case parser.SendAsVideo:
+        video, _ = media.ParseMp4(data)
+    case parser.SendAsVoice:
+        voice, err = media.ParseOpus(data)
+        mimeType = voiceMimetype
+    case parser.SendAsSticker:
+        sticker, err = media.ParseWebp(data)
+        mimeType = "image/webp"
+    case parser.SendAsGif:
+        if baseMimetype(mimeType) != "video/mp4" {
+            err = errors.New(static.GIF_NOT_MP4)
+        }
+        video, _ = media.ParseMp4(data)
+    case parser.SendAsAudio:
+        // Only Opus has its duration read, other audio is sent without one
+        voice, _ = media.ParseOpus(data)
+    }
+    if err != nil {
+        return nil, &media.SourceError{Source: MediaSource(m).String(), Err: err}
+    }
 
-    uploadRes, err := w.Client.Upload(
+    uploadRes, err := messenger.Upload(
         context.Background(),
-        []byte(decodedAttachment),
-        w.GetMediaType(mimeType),
+        data,
+        GetMediaType(sendAs),
     )
     if err != nil {
         return nil, err
     }
 
-    switch {
-    case strings.Contains(mimeType, "image"):
+    switch sendAs {
+    case parser.SendAsImage:
         return &waE2E.Message{
             ImageMessage: &waE2E.ImageMessage{
                 Caption:       proto.String(m.Content),
                 Mimetype:      proto.String(mimeType),
+                Width:         optionalSize(picture.Width),
+                Height:        optionalSize(picture.Height),
+                JPEGThumbnail: picture.Thumbnail,
                 URL:           &uploadRes.URL,
                 DirectPath:    &uploadRes.DirectPath,
                 MediaKey:      uploadRes.MediaKey,
@@ -130,23 +257,31 @@ func (w *Whatsapp) GenerateMessage(
                 FileLength:    &uploadRes.FileLength,
             },
         }, nil
-    case strings.Contains(mimeType, "audio"):
-        return &waE2E.Message{
-            AudioMessage: &waE2E.AudioMessage{
-                Mimetype:      proto.String(mimeType),
-                URL:           &uploadRes.URL,
-                DirectPath:    &uploadRes.DirectPath,
-                MediaKey:      uploadRes.MediaKey,
-                FileEncSHA256: uploadRes.FileEncSHA256,
-                FileSHA256:    uploadRes.FileSHA256,
-                FileLength:    &uploadRes.FileLength,
-            },
-        }, nil
-    case strings.Contains(mimeType, "video"):
+    case parser.SendAsAudio, parser.SendAsVoice:
+        audio := &waE2E.AudioMessage{
+            Mimetype:      proto.String(mimeType),
+            URL:           &uploadRes.URL,
+            DirectPath:    &uploadRes.DirectPath,
+            MediaKey:      uploadRes.MediaKey,
+            FileEncSHA256: uploadRes.FileEncSHA256,
+            FileSHA256:    uploadRes.FileSHA256,
+            FileLength:    &uploadRes.FileLength,
+            Seconds:       optionalSize(int(voice.Seconds())),
+        }
+        if sendAs == parser.SendAsVoice {
+            audio.PTT = proto.Bool(true)
+            audio.Waveform = voice.Waveform
+        }
+        return &waE2E.Message{AudioMessage: audio}, nil
+    case parser.SendAsVideo, parser.SendAsGif:
         return &waE2E.Message{
             VideoMessage: &waE2E.VideoMessage{
                 Caption:       proto.String(m.Content),
+                GifPlayback:   proto.Bool(sendAs == parser.SendAsGif),
                 Mimetype:      proto.String(mimeType),
+                Seconds:       optionalSize(int(video.Seconds())),
+                Width:         optionalSize(video.Width),
+                Height:        optionalSize(video.Height),
                 URL:           &uploadRes.URL,
                 DirectPath:    &uploadRes.DirectPath,
                 MediaKey:      uploadRes.MediaKey,
@@ -155,10 +290,13 @@ func (w *Whatsapp) GenerateMessage(
                 FileLength:    &uploadRes.FileLength,
             },
         }, nil
-    case strings.Contains(mimeType, "application"):
+    case parser.SendAsSticker:
         return &waE2E.Message{
-            DocumentMessage: &waE2E.DocumentMessage{
+            StickerMessage: &waE2E.StickerMessage{
                 Mimetype:      proto.String(mimeType),
+                Width:         proto.Uint32(uint32(sticker.Width)),
+                Height:        proto.Uint32(uint32(sticker.Height)),
+                IsAnimated:    proto.Bool(sticker.Animated),
                 URL:           &uploadRes.URL,
                 DirectPath:    &uploadRes.DirectPath,
                 MediaKey:      uploadRes.MediaKey,
@@ -169,20 +307,138 @@ func (w *Whatsapp) GenerateMessage(
         }, nil
     }
 
-    return nil, errors.New(static.INTERNAL_SERVER_ERROR)
+    // Anything else is a document, so no file is ever refused for its type
+    fileName := Filename(m, mimeType)
+    return &waE2E.Message{
+        DocumentMessage: &waE2E.DocumentMessage{
+            Caption:       proto.String(m.Content),
+            FileName:      proto.String(fileName),
+            Title:         proto.String(fileName),
+            Mimetype:      proto.String(mimeType),
+            URL:           &uploadRes.URL,
+            DirectPath:    &uploadRes.DirectPath,
+            MediaKey:      uploadRes.MediaKey,
+            FileEncSHA256: uploadRes.FileEncSHA256,
+            FileSHA256:    uploadRes.FileSHA256,
+            FileLength:    &uploadRes.FileLength,
+        },
+    }, nil
+}
+
+// Returns where the attachment of m comes from
+func MediaSource(m parser.Message) media.Source {
+    return media.Source{Data: m.Attachment, Path: m.AttachmentPath, URL: m.AttachmentURL}
+}
+
+// Office formats are zip files underneath, and the system list of extensions often doesn't know them
+var extensionTypes = map[string]string{
+    ".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+    ".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+    ".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+    ".odt":  "application/vnd.oasis.opendocument.text",
+    ".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+    ".odp":  "application/vnd.oasis.opendocument.presentation",
+}
+
+// Returns the media type of the attachment of m
+// The mimetype of the message wins, otherwise the content is sniffed, and when that only finds a generic container
+// like zip or plain text the extension of the file name is trusted instead
+func Mimetype(m parser.Message, data []byte) string {
+    if m.Mimetype != "" {
+        return m.Mimetype
+    }
+
+    detected := mimetype.Detect(data)
+    generic := detected.Is("application/octet-stream") || detected.Is("application/zip") ||
+        detected.Is("text/plain") || detected.Is("application/x-ole-storage")
+    if ext := strings.ToLower(path.Ext(sourceName(m))); generic && ext != "" {
+        if byExt, ok := extensionTypes[ext]; ok {
+            return byExt
+        }
+        if byExt := mime.TypeByExtension(ext); byExt != "" {
+            return byExt
+        }
+    }
+
+    return detected.String()
+}
+
+// Returns a pointer to n, or nil when it is unknown, so the field is left out of the message
+func optionalSize(n int) *uint32 {
+    if n <= 0 {
+        return nil
+    }
+
+    return proto.Uint32(uint32(n))
+}
+
+// Media type WhatsApp gives the voice notes it records
+const voiceMimetype = "audio/ogg; codecs=opus"
+
+// Returns the media type without its parameters, like charset
+func baseMimetype(mimeType string) string {
+    return strings.TrimSpace(strings.Split(mimeType, ";")[0])
+}
+
+// Returns how the attachment of m is sent, its send_as or else the kind matching its media type
+func SendAs(m parser.Message, mimeType string) string {
+    if m.SendAs != "" {
+        return m.SendAs
+    }
+
+    switch {
+    case strings.HasPrefix(mimeType, "image/"):
+        return parser.SendAsImage
+    case strings.HasPrefix(mimeType, "video/"):
+        return parser.SendAsVideo
+    case strings.HasPrefix(mimeType, "audio/"):
+        return parser.SendAsAudio
+    }
+
+    return parser.SendAsDocument
+}
+
+// Returns the name shown for the attachment of m
+// Without a filename the one of its path or URL is used, and as a last resort attachment with the usual extension
+func Filename(m parser.Message, mimeType string) string {
+    if name := sourceName(m); name != "" {
+        return name
+    }
+
+    name := "attachment"
+    if known := mimetype.Lookup(baseMimetype(mimeType)); known != nil {
+        name += known.Extension()
+    }
+
+    return name
 }
 
-// Gets whatsmeow.MediaType based on the mimeType
-func (w *Whatsapp) GetMediaType(mimeType string) whatsmeow.MediaType {
+// Returns the filename of m, or the last element of its path or URL
+func sourceName(m parser.Message) string {
     switch {
-    case strings.Contains(mimeType, "image"):
+    case m.Filename != "":
+        return m.Filename
+    case m.AttachmentPath != "":
+        return filepath.Base(m.AttachmentPath)
+    case m.AttachmentURL != "":
+        u, err := url.Parse(m.AttachmentURL)
+        if err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+            return path.Base(u.Path)
+        }
+    }
+
+    return ""
+}
+
+// Gets whatsmeow.MediaType based on how the attachment is sent, stickers being uploaded like images
+func GetMediaType(sendAs string) whatsmeow.MediaType {
+    switch sendAs {
+    case parser.SendAsImage, parser.SendAsSticker:
         return whatsmeow.MediaImage
-    case strings.Contains(mimeType, "audio"):
+    case parser.SendAsAudio, parser.SendAsVoice:
         return whatsmeow.MediaAudio
-    case strings.Contains(mimeType, "video"):
+    case parser.SendAsVideo, parser.SendAsGif:
         return whatsmeow.MediaVideo
-    case strings.Contains(mimeType, "application"):
-        return whatsmeow.MediaDocument
     }
 
     return whatsmeow.MediaDocument
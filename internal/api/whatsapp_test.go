@@ -0,0 +1,264 @@
+package api
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/base64"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// 1x1 transparent PNG
+var png, _ = base64.StdEncoding.DecodeString(
+    "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg==",
+)
+
+func zipFile(t *testing.T) []byte {
+    t.Helper()
+
+    var buf bytes.Buffer
+    w := zip.NewWriter(&buf)
+    f, err := w.Create("notes.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte("hello"))
+    w.Close()
+
+    return buf.Bytes()
+}
+
+func TestGenerateMessageMedia(t *testing.T) {
+    dir := t.TempDir()
+    files := map[string][]byte{
+        "notes.txt":   []byte("plain text notes\n"),
+        "report.docx": zipFile(t),
+        "logo.png":    png,
+    }
+    // Fixtures of the media package, for the formats it checks
+    for _, name := range []string{"voice.ogg", "animated.webp", "clip.mp4", "photo.jpg"} {
+        data, err := os.ReadFile(filepath.Join("..", "media", "testdata", name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        files[name] = data
+    }
+    for name, data := range files {
+        err := os.WriteFile(filepath.Join(dir, name), data, 0o644)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    tests := []struct {
+        name      string
+        m         parser.Message
+        sendAs    string
+        mediaType whatsmeow.MediaType
+        mimetype  string
+        filename  string
+        // Of images
+        width uint32
+    }{
+        {
+            name:      "image",
+            m:         parser.Message{Content: "logo", AttachmentPath: filepath.Join(dir, "logo.png")},
+            sendAs:    parser.SendAsImage,
+            mediaType: whatsmeow.MediaImage,
+            mimetype:  "image/png",
+            width:     1,
+        },
+        {
+            name:      "photo",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "photo.jpg")},
+            sendAs:    parser.SendAsImage,
+            mediaType: whatsmeow.MediaImage,
+            mimetype:  "image/jpeg",
+            width:     320,
+        },
+        {
+            name:      "video",
+            m:         parser.Message{Content: "clip", AttachmentPath: filepath.Join(dir, "clip.mp4")},
+            sendAs:    parser.SendAsVideo,
+            mediaType: whatsmeow.MediaVideo,
+            mimetype:  "video/mp4",
+        },
+        {
+            name:      "text is a document",
+            m:         parser.Message{Content: "notes", AttachmentPath: filepath.Join(dir, "notes.txt")},
+            sendAs:    parser.SendAsDocument,
+            mediaType: whatsmeow.MediaDocument,
+            mimetype:  "text/plain; charset=utf-8",
+            filename:  "notes.txt",
+        },
+        {
+            name:      "docx by extension",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "report.docx")},
+            sendAs:    parser.SendAsDocument,
+            mediaType: whatsmeow.MediaDocument,
+            mimetype:  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+            filename:  "report.docx",
+        },
+        {
+            name:      "image sent as document with a filename",
+            m: parser.Message{
+                Attachment: base64.StdEncoding.EncodeToString(png),
+                Filename:   "Logo.png",
+                SendAs:     "document",
+            },
+            sendAs:    parser.SendAsDocument,
+            mediaType: whatsmeow.MediaDocument,
+            mimetype:  "image/png",
+            filename:  "Logo.png",
+        },
+        {
+            name:      "explicit mimetype",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "notes.txt"), Mimetype: "text/csv"},
+            sendAs:    parser.SendAsDocument,
+            mediaType: whatsmeow.MediaDocument,
+            mimetype:  "text/csv",
+            filename:  "notes.txt",
+        },
+        {
+            name:      "unnamed document",
+            m:         parser.Message{Attachment: base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n"))},
+            sendAs:    parser.SendAsDocument,
+            mediaType: whatsmeow.MediaDocument,
+            mimetype:  "application/pdf",
+            filename:  "attachment.pdf",
+        },
+        {
+            name:      "sticker",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "animated.webp"), SendAs: "sticker"},
+            sendAs:    parser.SendAsSticker,
+            mediaType: whatsmeow.MediaImage,
+            mimetype:  "image/webp",
+        },
+        {
+            name:      "voice note",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "voice.ogg"), SendAs: "voice"},
+            sendAs:    parser.SendAsVoice,
+            mediaType: whatsmeow.MediaAudio,
+            mimetype:  "audio/ogg; codecs=opus",
+        },
+        {
+            name:      "opus audio has its duration",
+            m:         parser.Message{AttachmentPath: filepath.Join(dir, "voice.ogg")},
+            sendAs:    parser.SendAsAudio,
+            mediaType: whatsmeow.MediaAudio,
+            mimetype:  "audio/ogg",
+        },
+        {
+            name:      "gif",
+            m: parser.Message{
+                Content:        "dancing",
+                AttachmentPath: filepath.Join(dir, "clip.mp4"),
+                SendAs:         "gif",
+            },
+            sendAs:    parser.SendAsGif,
+            mediaType: whatsmeow.MediaVideo,
+            mimetype:  "video/mp4",
+        },
+    }
+
+    loader := media.NewLoader(1<<20, time.Second)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake := NewFake()
+            msg, err := GenerateMessage(fake, loader, tt.m)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // The fake puts the media type of the upload in its path
+            var directPath string
+            switch tt.sendAs {
+            case parser.SendAsImage:
+                image := msg.GetImageMessage()
+                directPath = image.GetDirectPath()
+                if image.GetMimetype() != tt.mimetype || image.GetCaption() != tt.m.Content {
+                    t.Errorf("unexpected image %v", msg)
+                }
+                if image.GetWidth() != tt.width || len(image.GetJPEGThumbnail()) == 0 {
+                    t.Errorf("expected a thumbnail and a width of %d, got %v", tt.width, msg)
+                }
+            case parser.SendAsSticker:
+                sticker := msg.GetStickerMessage()
+                directPath = sticker.GetDirectPath()
+                if sticker.GetMimetype() != tt.mimetype || sticker.GetWidth() != 512 || !sticker.GetIsAnimated() {
+                    t.Errorf("unexpected sticker %v", msg)
+                }
+            case parser.SendAsVoice, parser.SendAsAudio:
+                audio := msg.GetAudioMessage()
+                directPath = audio.GetDirectPath()
+                if audio.GetMimetype() != tt.mimetype || audio.GetSeconds() != 2 {
+                    t.Errorf("expected %s of 2 seconds, got %v", tt.mimetype, msg)
+                }
+                voice := tt.sendAs == parser.SendAsVoice
+                if audio.GetPTT() != voice || (len(audio.GetWaveform()) == 64) != voice {
+                    t.Errorf("expected a voice note %v, got %v", voice, msg)
+                }
+            case parser.SendAsGif, parser.SendAsVideo:
+                video := msg.GetVideoMessage()
+                directPath = video.GetDirectPath()
+                gif := tt.sendAs == parser.SendAsGif
+                if video.GetMimetype() != tt.mimetype || video.GetGifPlayback() != gif ||
+                    video.GetCaption() != tt.m.Content {
+                    t.Errorf("unexpected video %v", msg)
+                }
+                if video.GetSeconds() != 5 || video.GetWidth() != 640 || video.GetHeight() != 360 {
+                    t.Errorf("expected 5 seconds of 640x360, got %v", msg)
+                }
+            case parser.SendAsDocument:
+                doc := msg.GetDocumentMessage()
+                directPath = doc.GetDirectPath()
+                if doc.GetMimetype() != tt.mimetype || doc.GetFileName() != tt.filename ||
+                    doc.GetTitle() != tt.filename {
+                    t.Errorf("expected %s named %s, got %v", tt.mimetype, tt.filename, msg)
+                }
+                if doc.GetCaption() != tt.m.Content {
+                    t.Errorf("expected caption %q, got %q", tt.m.Content, doc.GetCaption())
+                }
+            }
+            if !strings.HasPrefix(directPath, "/"+string(tt.mediaType)+"/") {
+                t.Errorf("expected an upload as %s, got %q", tt.mediaType, directPath)
+            }
+        })
+    }
+}
+
+func TestGenerateMessageWrongFormat(t *testing.T) {
+    logo := base64.StdEncoding.EncodeToString(png)
+    tests := []struct {
+        sendAs string
+        err    string
+    }{
+        {parser.SendAsVoice, static.NOT_OPUS},
+        {parser.SendAsSticker, static.NOT_WEBP},
+        {parser.SendAsGif, static.GIF_NOT_MP4},
+    }
+
+    loader := media.NewLoader(1<<20, time.Second)
+    for _, tt := range tests {
+        fake := NewFake()
+        _, err := GenerateMessage(fake, loader, parser.Message{Attachment: logo, SendAs: tt.sendAs})
+
+        // The queue gives up on source errors instead of retrying
+        var sourceErr *media.SourceError
+        if !errors.As(err, &sourceErr) || !strings.Contains(err.Error(), tt.err) {
+            t.Errorf("%s: expected a source error %q, got %v", tt.sendAs, tt.err, err)
+        }
+        if len(fake.Uploads()) > 0 {
+            t.Errorf("%s: expected no upload, got %d", tt.sendAs, len(fake.Uploads()))
+        }
+    }
+}
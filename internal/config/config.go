@@ -0,0 +1,187 @@
+package config
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "strconv"
+    "time"
+
+    "gopkg.in/yaml.v3"
+
+    "github.com/watchzap/internal/jobs"
+    "github.com/watchzap/internal/static"
+)
+
+// Name of the config file looked up in the working directory when no path is given
+const DefaultFile = "watchzap.yaml"
+
+// Environment variable holding the config file path
+const PathEnv = "WATCHZAP_CONFIG"
+
+// Config holds every option of watchzap
+// The yaml tag is both the key in the config file and the name of the command-line flag,
+// the env tag is the environment variable overriding it
+type Config struct {
+    Debug        bool   `yaml:"debug" env:"WATCHZAP_DEBUG"`
+    RemoveOnSend bool   `yaml:"removeOnSend" env:"WATCHZAP_REMOVE_ON_SEND"`
+    Mode         string `yaml:"mode" env:"WATCHZAP_MODE"`
+    Folder       string `yaml:"folder" env:"WATCHZAP_FOLDER"`
+    Port         string `yaml:"port" env:"WATCHZAP_PORT"`
+    MsgLimit     int    `yaml:"msgLimit" env:"WATCHZAP_MSG_LIMIT"`
+    TimeLimit    int    `yaml:"timeLimit" env:"WATCHZAP_TIME_LIMIT"`
+
+    MaxAttempts  int           `yaml:"maxAttempts" env:"WATCHZAP_MAX_ATTEMPTS"`
+    RetryBackoff time.Duration `yaml:"retryBackoff" env:"WATCHZAP_RETRY_BACKOFF"`
+    Webhook      string        `yaml:"webhook" env:"WATCHZAP_WEBHOOK"`
+
+    CheckRegistered bool          `yaml:"checkRegistered" env:"WATCHZAP_CHECK_REGISTERED"`
+    RecipientPolicy string        `yaml:"recipientPolicy" env:"WATCHZAP_RECIPIENT_POLICY"`
+    DirectoryTTL    time.Duration `yaml:"directoryTTL" env:"WATCHZAP_DIRECTORY_TTL"`
+    Aliases         string        `yaml:"aliases" env:"WATCHZAP_ALIASES"`
+    Templates       string        `yaml:"templates" env:"WATCHZAP_TEMPLATES"`
+    Charset         string        `yaml:"charset" env:"WATCHZAP_CHARSET"`
+
+    MediaRoot      string        `yaml:"mediaRoot" env:"WATCHZAP_MEDIA_ROOT"`
+    MediaMaxSize   int           `yaml:"mediaMaxSize" env:"WATCHZAP_MEDIA_MAX_SIZE"`
+    MediaTimeout   time.Duration `yaml:"mediaTimeout" env:"WATCHZAP_MEDIA_TIMEOUT"`
+    RequestMaxSize int           `yaml:"requestMaxSize" env:"WATCHZAP_REQUEST_MAX_SIZE"`
+
+    CatchUp string     `yaml:"catchUp" env:"WATCHZAP_CATCH_UP"`
+    Jobs    []jobs.Job `yaml:"jobs"`
+}
+
+// Returns the configuration used when nothing else is set
+func Default() Config {
+    return Config{
+        MsgLimit:     4,
+        TimeLimit:    5,
+        MaxAttempts:  5,
+        RetryBackoff: 2 * time.Second,
+
+        RecipientPolicy: "strict",
+        DirectoryTTL:    10 * time.Minute,
+
+        MediaMaxSize:   100,
+        MediaTimeout:   30 * time.Second,
+        RequestMaxSize: 200,
+
+        CatchUp: jobs.CatchUpSkip,
+    }
+}
+
+// Finds the config file to load
+// The -config flag wins over WATCHZAP_CONFIG, if neither is set watchzap.yaml is used when it exists
+func Path(flagPath string) string {
+    if flagPath != "" {
+        return flagPath
+    }
+
+    if envPath := os.Getenv(PathEnv); envPath != "" {
+        return envPath
+    }
+
+    if _, err := os.Stat(DefaultFile); err == nil {
+        return DefaultFile
+    }
+
+    return ""
+}
+
+// Loads the options from the YAML file at path on top of the current values
+// Options missing from the file are left untouched
+func (c *Config) LoadFile(path string) error {
+    body, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    err = yaml.Unmarshal(body, c)
+    if err != nil {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+
+    return nil
+}
+
+// Overrides the options that have their environment variable set
+func (c *Config) LoadEnv() error {
+    v := reflect.ValueOf(c).Elem()
+    t := v.Type()
+
+    for i := 0; i < t.NumField(); i++ {
+        name := t.Field(i).Tag.Get("env")
+        if name == "" {
+            continue
+        }
+
+        value, ok := os.LookupEnv(name)
+        if !ok {
+            continue
+        }
+
+        err := setField(v.Field(i), value)
+        if err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+        }
+    }
+
+    return nil
+}
+
+// Copies the options named in names from src, used to apply only the flags the user actually set
+func (c *Config) Merge(src Config, names map[string]bool) {
+    dst := reflect.ValueOf(c).Elem()
+    from := reflect.ValueOf(src)
+    t := dst.Type()
+
+    for i := 0; i < t.NumField(); i++ {
+        if names[t.Field(i).Tag.Get("yaml")] {
+            dst.Field(i).Set(from.Field(i))
+        }
+    }
+}
+
+// Returns the configuration as YAML
+func (c Config) String() string {
+    body, err := yaml.Marshal(c)
+    if err != nil {
+        return err.Error()
+    }
+
+    return string(body)
+}
+
+// Parses value into the field according to its kind
+func setField(field reflect.Value, value string) error {
+    if field.Type() == reflect.TypeOf(time.Duration(0)) {
+        d, err := time.ParseDuration(value)
+        if err != nil {
+            return err
+        }
+        field.SetInt(int64(d))
+        return nil
+    }
+
+    switch field.Kind() {
+    case reflect.String:
+        field.SetString(value)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return err
+        }
+        field.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return err
+        }
+        field.SetInt(n)
+    default:
+        return errors.New(static.UNSUPPORTED_OPTION)
+    }
+
+    return nil
+}
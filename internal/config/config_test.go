@@ -0,0 +1,225 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/watchzap/internal/static"
+)
+
+func writeFile(t *testing.T, body string) string {
+    t.Helper()
+
+    path := filepath.Join(t.TempDir(), DefaultFile)
+    err := os.WriteFile(path, []byte(body), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return path
+}
+
+func TestPrecedence(t *testing.T) {
+    file := "port: \"8080\"\nmaxAttempts: 3\nretryBackoff: 1m\ndebug: true\n"
+
+    tests := []struct {
+        name     string
+        file     string
+        env      map[string]string
+        flags    Config
+        set      map[string]bool
+        expected Config
+    }{
+        {
+            name:     "defaults",
+            expected: Config{MaxAttempts: 5, RetryBackoff: 2 * time.Second},
+        },
+        {
+            name:     "file over defaults",
+            file:     file,
+            expected: Config{Port: "8080", MaxAttempts: 3, RetryBackoff: time.Minute, Debug: true},
+        },
+        {
+            name: "env over file",
+            file: file,
+            env: map[string]string{
+                "WATCHZAP_PORT":          "9090",
+                "WATCHZAP_RETRY_BACKOFF": "30s",
+                "WATCHZAP_DEBUG":         "false",
+            },
+            expected: Config{Port: "9090", MaxAttempts: 3, RetryBackoff: 30 * time.Second},
+        },
+        {
+            name:     "flags over env",
+            file:     file,
+            env:      map[string]string{"WATCHZAP_PORT": "9090", "WATCHZAP_MAX_ATTEMPTS": "4"},
+            flags:    Config{Port: "7070", MaxAttempts: 9, Debug: false},
+            set:      map[string]bool{"port": true, "debug": true},
+            expected: Config{Port: "7070", MaxAttempts: 4, RetryBackoff: time.Minute},
+        },
+        {
+            // Flags keep their defaults in the flags config, those must not hide the other layers
+            name:     "flags that were not set",
+            file:     file,
+            flags:    Default(),
+            set:      map[string]bool{},
+            expected: Config{Port: "8080", MaxAttempts: 3, RetryBackoff: time.Minute, Debug: true},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for name, value := range tt.env {
+                t.Setenv(name, value)
+            }
+
+            c := Default()
+            if tt.file != "" {
+                err := c.LoadFile(writeFile(t, tt.file))
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            err := c.LoadEnv()
+            if err != nil {
+                t.Fatal(err)
+            }
+            c.Merge(tt.flags, tt.set)
+
+            got := Config{Port: c.Port, MaxAttempts: c.MaxAttempts, RetryBackoff: c.RetryBackoff, Debug: c.Debug}
+            if !reflect.DeepEqual(got, tt.expected) {
+                t.Errorf("expected %+v, got %+v", tt.expected, got)
+            }
+        })
+    }
+}
+
+func TestLoadFile(t *testing.T) {
+    c := Default()
+    err := c.LoadFile(writeFile(t, "mode: http\njobs:\n  - name: standup\n    schedule: \"0 9 * * 1-5\"\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Mode != "http" || len(c.Jobs) != 1 || c.Jobs[0].Name != "standup" {
+        t.Errorf("expected the options of the file, got %+v", c)
+    }
+    if c.MediaMaxSize != 100 || c.RecipientPolicy != "strict" {
+        t.Errorf("expected the options missing from the file to keep their defaults, got %+v", c)
+    }
+
+    path := writeFile(t, "maxAttempts: many\n")
+    err = c.LoadFile(path)
+    if err == nil || !strings.Contains(err.Error(), path) {
+        t.Errorf("expected an error naming the file, got %v", err)
+    }
+
+    err = c.LoadFile(filepath.Join(t.TempDir(), "missing.yaml"))
+    if !os.IsNotExist(err) {
+        t.Errorf("expected a missing file to fail, got %v", err)
+    }
+}
+
+func TestLoadEnvErrors(t *testing.T) {
+    tests := []struct {
+        name  string
+        value string
+    }{
+        {name: "WATCHZAP_MSG_LIMIT", value: "four"},
+        {name: "WATCHZAP_DEBUG", value: "maybe"},
+        {name: "WATCHZAP_RETRY_BACKOFF", value: "2"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv(tt.name, tt.value)
+
+            c := Default()
+            err := c.LoadEnv()
+            if err == nil || !strings.HasPrefix(err.Error(), tt.name+": ") {
+                t.Errorf("expected an error naming %s, got %v", tt.name, err)
+            }
+        })
+    }
+}
+
+func TestSetField(t *testing.T) {
+    tests := []struct {
+        name     string
+        field    string
+        value    string
+        expected any
+        err      bool
+    }{
+        {name: "string", field: "Port", value: "8080", expected: "8080"},
+        {name: "int", field: "MsgLimit", value: "10", expected: 10},
+        {name: "bool", field: "Debug", value: "true", expected: true},
+        {name: "bool as number", field: "CheckRegistered", value: "1", expected: true},
+        {name: "duration", field: "DirectoryTTL", value: "1h30m", expected: 90 * time.Minute},
+        {name: "bad int", field: "MsgLimit", value: "1.5", err: true},
+        {name: "bad bool", field: "Debug", value: "yes", err: true},
+        {name: "duration without unit", field: "MediaTimeout", value: "30", err: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := Default()
+            field := reflect.ValueOf(&c).Elem().FieldByName(tt.field)
+            err := setField(field, tt.value)
+            if tt.err {
+                if err == nil {
+                    t.Errorf("expected %q to fail, got %v", tt.value, field.Interface())
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if field.Interface() != tt.expected {
+                t.Errorf("expected %v, got %v", tt.expected, field.Interface())
+            }
+        })
+    }
+
+    c := Default()
+    err := setField(reflect.ValueOf(&c).Elem().FieldByName("Jobs"), "standup")
+    if err == nil || err.Error() != static.UNSUPPORTED_OPTION {
+        t.Errorf("expected lists to be unsupported, got %v", err)
+    }
+}
+
+func TestPath(t *testing.T) {
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Chdir(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Chdir(wd) })
+
+    t.Setenv(PathEnv, "")
+    if path := Path(""); path != "" {
+        t.Errorf("expected no config file, got %q", path)
+    }
+
+    err = os.WriteFile(DefaultFile, nil, 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if path := Path(""); path != DefaultFile {
+        t.Errorf("expected %s, got %q", DefaultFile, path)
+    }
+
+    t.Setenv(PathEnv, "env.yaml")
+    if path := Path(""); path != "env.yaml" {
+        t.Errorf("expected the env path, got %q", path)
+    }
+    if path := Path("flag.yaml"); path != "flag.yaml" {
+        t.Errorf("expected the flag path, got %q", path)
+    }
+}
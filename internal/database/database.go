@@ -0,0 +1,76 @@
+package database
+
+import (
+    "database/sql"
+    "fmt"
+
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// Path of the database shared with the whatsmeow device store
+const URI = "file:zap.db?_foreign_keys=on&_busy_timeout=5000"
+
+// Opens the database at uri and brings the watchzap tables up to date
+func Open(uri string) (*sql.DB, error) {
+    db, err := sql.Open("sqlite3", uri)
+    if err != nil {
+        return nil, err
+    }
+
+    // SQLite only has one writer, let database/sql queue our statements instead of failing with SQLITE_BUSY
+    db.SetMaxOpenConns(1)
+
+    err = Migrate(db)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return db, nil
+}
+
+// Applies the migrations that have not been applied yet, in order
+func Migrate(db *sql.DB) error {
+    _, err := db.Exec("CREATE TABLE IF NOT EXISTS watchzap_version (version INTEGER NOT NULL)")
+    if err != nil {
+        return err
+    }
+
+    var version int
+    err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM watchzap_version").Scan(&version)
+    if err != nil {
+        return err
+    }
+
+    for i := version; i < len(migrations); i++ {
+        tx, err := db.Begin()
+        if err != nil {
+            return err
+        }
+
+        _, err = tx.Exec(migrations[i])
+        if err != nil {
+            tx.Rollback()
+            return fmt.Errorf("migration %d: %w", i+1, err)
+        }
+
+        _, err = tx.Exec("DELETE FROM watchzap_version")
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+
+        _, err = tx.Exec("INSERT INTO watchzap_version (version) VALUES (?)", i+1)
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+
+        err = tx.Commit()
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
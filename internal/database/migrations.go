@@ -0,0 +1,61 @@
+package database
+
+// Schema changes of the watchzap tables, never edit an entry once released, append a new one instead
+var migrations = []string{
+    // 1: outbound message queue
+    `CREATE TABLE watchzap_outbox (
+        id              INTEGER PRIMARY KEY AUTOINCREMENT,
+        message         TEXT    NOT NULL,
+        status          TEXT    NOT NULL,
+        attempts        INTEGER NOT NULL DEFAULT 0,
+        last_error      TEXT    NOT NULL DEFAULT '',
+        next_attempt_at INTEGER NOT NULL,
+        created_at      INTEGER NOT NULL,
+        updated_at      INTEGER NOT NULL
+    );
+    CREATE INDEX watchzap_outbox_due ON watchzap_outbox (status, next_attempt_at);`,
+
+    // 2: delivery tracking
+    `ALTER TABLE watchzap_outbox ADD COLUMN whatsapp_id TEXT NOT NULL DEFAULT '';
+    ALTER TABLE watchzap_outbox ADD COLUMN chat TEXT NOT NULL DEFAULT '';
+    CREATE INDEX watchzap_outbox_whatsapp_id ON watchzap_outbox (whatsapp_id);
+    CREATE TABLE watchzap_outbox_history (
+        id         INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id INTEGER NOT NULL REFERENCES watchzap_outbox (id) ON DELETE CASCADE,
+        status     TEXT    NOT NULL,
+        error      TEXT    NOT NULL DEFAULT '',
+        at         INTEGER NOT NULL
+    );
+    CREATE INDEX watchzap_outbox_history_message ON watchzap_outbox_history (message_id);`,
+
+    // 3: recurring jobs
+    `CREATE TABLE watchzap_jobs (
+        name       TEXT    PRIMARY KEY,
+        schedule   TEXT    NOT NULL,
+        timezone   TEXT    NOT NULL DEFAULT '',
+        catch_up   TEXT    NOT NULL DEFAULT '',
+        message    TEXT    NOT NULL,
+        source     TEXT    NOT NULL,
+        last_run   INTEGER NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    );`,
+
+    // 4: ordered attachments
+    `ALTER TABLE watchzap_outbox ADD COLUMN after_id INTEGER NOT NULL DEFAULT 0;`,
+
+    // 5: poll votes, the latest one of each voter
+    `CREATE TABLE watchzap_poll_votes (
+        message_id INTEGER NOT NULL REFERENCES watchzap_outbox (id) ON DELETE CASCADE,
+        voter      TEXT    NOT NULL,
+        options    TEXT    NOT NULL,
+        voted_at   INTEGER NOT NULL,
+        PRIMARY KEY (message_id, voter)
+    );`,
+
+    // 6: how far readers of the outbox history, like the webhook, got
+    `CREATE TABLE watchzap_history_cursors (
+        name       TEXT    PRIMARY KEY,
+        history_id INTEGER NOT NULL
+    );`,
+}
@@ -0,0 +1,466 @@
+package jobs
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/robfig/cron/v3"
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// What to do with the runs that were missed while watchzap was down
+const (
+    // Missed runs are dropped, the job resumes at its next run
+    CatchUpSkip = "skip"
+    // Only the latest missed run is sent
+    CatchUpOnce = "once"
+    // Every missed run is sent, up to maxCatchUp
+    CatchUpAll = "all"
+)
+
+// Where a job was defined
+const (
+    SourceConfig = "config"
+    SourceAPI    = "api"
+)
+
+// A run later than this is a missed run, handled by the catch-up policy
+const grace = time.Minute
+
+// Most missed runs sent by CatchUpAll, so a job running every minute doesn't flood after a week down
+const maxCatchUp = 100
+
+// Longest the scheduler sleeps before looking at the jobs again when nothing wakes it up
+const idleWait = time.Minute
+
+// Columns read by scanJob
+const jobColumns = "name, schedule, timezone, catch_up, message, source, last_run"
+
+// Standard five field cron expressions, plus descriptors like @daily and @every 1h
+var cronParser = cron.NewParser(
+    cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// Job sends a message every time its cron schedule fires
+type Job struct {
+    Name string `json:"name" yaml:"name"`
+    // Cron expression like "0 9 * * 1-5"
+    Schedule string `json:"schedule" yaml:"schedule"`
+    // IANA timezone the schedule is read in, like America/Sao_Paulo, the local one when empty
+    Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+    // Catch-up policy of the job, the configured default when empty
+    CatchUp string         `json:"catch_up,omitempty" yaml:"catch_up,omitempty"`
+    Message parser.Message `json:"message" yaml:"message"`
+
+    // Filled in by the scheduler
+    Source  string    `json:"source,omitempty" yaml:"-"`
+    LastRun time.Time `json:"last_run,omitempty" yaml:"-"`
+    NextRun time.Time `json:"next_run,omitempty" yaml:"-"`
+}
+
+// Checks that the job can be scheduled and its message sent
+func (j Job) Validate() error {
+    if j.Name == "" {
+        return fmt.Errorf("%s: name", static.EMPTY_FIELD)
+    }
+
+    _, err := j.schedule()
+    if err != nil {
+        return err
+    }
+
+    err = ValidateCatchUp(j.CatchUp)
+    if err != nil {
+        return err
+    }
+
+    err = j.Message.Validate()
+    if err != nil {
+        return fmt.Errorf("message: %w", err)
+    }
+
+    return nil
+}
+
+// Checks that policy is a known catch-up policy, empty meaning the default one
+func ValidateCatchUp(policy string) error {
+    switch policy {
+    case "", CatchUpSkip, CatchUpOnce, CatchUpAll:
+        return nil
+    }
+
+    return fmt.Errorf("%s: %s", static.INVALID_CATCH_UP, policy)
+}
+
+// Parses the schedule in the timezone of the job
+func (j Job) schedule() (cron.Schedule, error) {
+    loc := time.Local
+    if j.Timezone != "" {
+        var err error
+        loc, err = time.LoadLocation(j.Timezone)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", static.INVALID_TIMEZONE, j.Timezone)
+        }
+    }
+
+    s, err := cronParser.Parse(j.Schedule)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", static.INVALID_SCHEDULE, err)
+    }
+
+    return inLocation{s, loc}, nil
+}
+
+// Evaluates a schedule in a fixed timezone, so 0 9 * * * means 9:00 there whatever the server runs in
+type inLocation struct {
+    cron.Schedule
+    loc *time.Location
+}
+
+func (s inLocation) Next(t time.Time) time.Time {
+    return s.Schedule.Next(t.In(s.loc))
+}
+
+var (
+    // Returned when editing a job that only the config file can change
+    ErrConfigJob = errors.New(static.CONFIG_JOB)
+    // Returned when there is no job with the given name
+    ErrJobNotFound = errors.New(static.JOB_NOT_FOUND)
+    // Wrapped by the errors of jobs whose message can't be decoded, like after a manual edit of the database
+    ErrUnreadable = errors.New(static.UNREADABLE_MESSAGE)
+)
+
+// Scheduler keeps the recurring jobs in SQLite and dispatches their runs when due
+// The last run of every job is stored, so runs missed while watchzap was down can be caught up
+type Scheduler struct {
+    db       *sql.DB
+    catchUp  string
+    dispatch func(Job, time.Time) error
+    wake     chan struct{}
+}
+
+// Creates a scheduler on top of db, which must already be migrated
+// dispatch is called with the job and the time of the run, catchUp is the policy of jobs without one
+func New(db *sql.DB, catchUp string, dispatch func(Job, time.Time) error) *Scheduler {
+    if catchUp == "" {
+        catchUp = CatchUpSkip
+    }
+
+    return &Scheduler{
+        db:       db,
+        catchUp:  catchUp,
+        dispatch: dispatch,
+        wake:     make(chan struct{}, 1),
+    }
+}
+
+// Replaces the jobs of the config file with jobs, keeping the last run of the ones still there
+func (s *Scheduler) Sync(jobs []Job) error {
+    names := map[string]bool{}
+    for _, job := range jobs {
+        if names[job.Name] {
+            return fmt.Errorf("%s: %s", static.DUPLICATE_JOB, job.Name)
+        }
+        names[job.Name] = true
+
+        err := s.save(job, SourceConfig)
+        if err != nil {
+            return fmt.Errorf("job %q: %w", job.Name, err)
+        }
+    }
+
+    existing, err := s.List()
+    if err != nil {
+        return err
+    }
+    for _, job := range existing {
+        if job.Source == SourceConfig && !names[job.Name] {
+            _, err := s.db.Exec("DELETE FROM watchzap_jobs WHERE name = ?", job.Name)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    s.notify()
+
+    return nil
+}
+
+// Creates or replaces a job defined through the API
+// Jobs of the config file can't be replaced, they would come back on the next start
+func (s *Scheduler) Save(job Job) (Job, error) {
+    current, err := s.Get(job.Name)
+    if err == nil && current.Source == SourceConfig {
+        return Job{}, fmt.Errorf("%w: %s", ErrConfigJob, job.Name)
+    }
+
+    err = s.save(job, SourceAPI)
+    if err != nil {
+        return Job{}, err
+    }
+    s.notify()
+
+    return s.Get(job.Name)
+}
+
+// Deletes a job defined through the API
+func (s *Scheduler) Delete(name string) error {
+    job, err := s.Get(name)
+    if err != nil {
+        return err
+    }
+    if job.Source == SourceConfig {
+        return fmt.Errorf("%w: %s", ErrConfigJob, name)
+    }
+
+    _, err = s.db.Exec("DELETE FROM watchzap_jobs WHERE name = ?", name)
+
+    return err
+}
+
+// Returns the job called name
+func (s *Scheduler) Get(name string) (Job, error) {
+    row := s.db.QueryRow("SELECT "+jobColumns+" FROM watchzap_jobs WHERE name = ?", name)
+
+    job, err := scanJob(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, name)
+    }
+
+    return job, err
+}
+
+// Returns every job by name
+// Jobs whose message can't be read are logged and left out, so they don't stop the others
+func (s *Scheduler) List() ([]Job, error) {
+    rows, err := s.db.Query("SELECT " + jobColumns + " FROM watchzap_jobs ORDER BY name")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    jobs := []Job{}
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if errors.Is(err, ErrUnreadable) {
+            log.Error().Err(err).Str("job", job.Name).Msg("WZ: Skipping job that can't be read")
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, job)
+    }
+
+    return jobs, rows.Err()
+}
+
+// Dispatches the runs of the jobs as they are due until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+    for {
+        wait := s.tick(time.Now())
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-s.wake:
+        case <-time.After(wait):
+        }
+    }
+}
+
+// Dispatches the runs due at now and returns how long until the next one
+func (s *Scheduler) tick(now time.Time) time.Duration {
+    jobs, err := s.List()
+    if err != nil {
+        log.Error().Err(err).Str("function", "jobs").Msg("WZ: Failed reading the jobs")
+        return idleWait
+    }
+
+    wait := idleWait
+    for _, job := range jobs {
+        runs := job.due(now)
+        if len(runs) > 0 {
+            s.runAll(job, pick(runs, now, job.policy(s.catchUp)))
+
+            // The last run is recorded even if dispatching failed, otherwise it would be retried forever
+            job.LastRun = runs[len(runs)-1]
+            _, err := s.db.Exec(
+                "UPDATE watchzap_jobs SET last_run = ? WHERE name = ?",
+                job.LastRun.UnixMilli(),
+                job.Name,
+            )
+            if err != nil {
+                log.Error().Err(err).Str("job", job.Name).Msg("WZ: Failed saving the last run of job")
+            }
+        }
+
+        next := job.next(now)
+        if !next.IsZero() {
+            wait = min(wait, next.Sub(now))
+        }
+    }
+
+    return max(wait, 0)
+}
+
+func (s *Scheduler) runAll(job Job, runs []time.Time) {
+    for _, run := range runs {
+        err := s.dispatch(job, run)
+        if err != nil {
+            log.Error().Err(err).Str("job", job.Name).Time("run", run).Msg("WZ: Failed running job")
+            continue
+        }
+        log.Info().Str("job", job.Name).Time("run", run).Msg("WZ: Ran job")
+    }
+}
+
+// Inserts or updates job, a new job starts counting its runs from now
+func (s *Scheduler) save(job Job, source string) error {
+    err := job.Validate()
+    if err != nil {
+        return err
+    }
+
+    body, err := json.Marshal(job.Message)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UnixMilli()
+    _, err = s.db.Exec(
+        `INSERT INTO watchzap_jobs (name, schedule, timezone, catch_up, message, source, last_run, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (name) DO UPDATE SET schedule = excluded.schedule, timezone = excluded.timezone,
+        catch_up = excluded.catch_up, message = excluded.message, source = excluded.source,
+        updated_at = excluded.updated_at`,
+        job.Name,
+        job.Schedule,
+        job.Timezone,
+        job.CatchUp,
+        string(body),
+        source,
+        now,
+        now,
+        now,
+    )
+
+    return err
+}
+
+// Wakes the scheduler up without blocking
+func (s *Scheduler) notify() {
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (j Job) policy(fallback string) string {
+    if j.CatchUp == "" {
+        return fallback
+    }
+
+    return j.CatchUp
+}
+
+// Returns the runs after the last one up to now, oldest first, keeping only the latest maxCatchUp
+func (j Job) due(now time.Time) []time.Time {
+    schedule, err := j.schedule()
+    if err != nil {
+        return nil
+    }
+
+    var runs []time.Time
+    for t := schedule.Next(j.catchUpFrom(schedule, now)); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+        runs = append(runs, t)
+        if len(runs) > maxCatchUp {
+            runs = runs[1:]
+        }
+    }
+
+    return runs
+}
+
+// Returns the time to look for missed runs from, the last run or a later time with maxCatchUp runs before now
+// Walking every run missed since the last one would take ages for a frequent job after a long downtime,
+// so the start moves back from now, twice as far each time, until it has enough runs or reaches the last run
+func (j Job) catchUpFrom(schedule cron.Schedule, now time.Time) time.Time {
+    for d := time.Minute; d > 0 && now.Add(-d).After(j.LastRun); d *= 2 {
+        from := now.Add(-d)
+        n := 0
+        for t := schedule.Next(from); !t.IsZero() && !t.After(now) && n < maxCatchUp; t = schedule.Next(t) {
+            n++
+        }
+        if n == maxCatchUp {
+            return from
+        }
+    }
+
+    return j.LastRun
+}
+
+// Returns the first run after now, zero if there is none
+func (j Job) next(now time.Time) time.Time {
+    schedule, err := j.schedule()
+    if err != nil {
+        return time.Time{}
+    }
+
+    return schedule.Next(now)
+}
+
+// Chooses the runs to dispatch, those within grace of now are on time and always dispatched
+func pick(runs []time.Time, now time.Time, policy string) []time.Time {
+    var missed, onTime []time.Time
+    for _, run := range runs {
+        if now.Sub(run) > grace {
+            missed = append(missed, run)
+        } else {
+            onTime = append(onTime, run)
+        }
+    }
+
+    switch {
+    case policy == CatchUpAll:
+        return runs
+    case policy == CatchUpOnce && len(missed) > 0:
+        return append(missed[len(missed)-1:], onTime...)
+    }
+
+    return onTime
+}
+
+type scanner interface {
+    Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (Job, error) {
+    var job Job
+    var body string
+    var lastRun int64
+
+    err := row.Scan(&job.Name, &job.Schedule, &job.Timezone, &job.CatchUp, &body, &job.Source, &lastRun)
+    if err != nil {
+        return Job{}, err
+    }
+
+    job.LastRun = time.UnixMilli(lastRun)
+    job.NextRun = job.next(time.Now())
+
+    // The rest of the job is still returned, so the error can name it
+    err = json.Unmarshal([]byte(body), &job.Message)
+    if err != nil {
+        return job, fmt.Errorf("%w: %w", ErrUnreadable, err)
+    }
+
+    return job, nil
+}
@@ -0,0 +1,274 @@
+package jobs
+
+import (
+    "database/sql"
+    "errors"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/parser"
+)
+
+func newScheduler(t *testing.T, catchUp string, runs *[]time.Time) (*Scheduler, *sql.DB) {
+    t.Helper()
+
+    db, err := database.Open("file:" + filepath.Join(t.TempDir(), "zap.db") + "?_foreign_keys=on")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+
+    return New(db, catchUp, func(job Job, at time.Time) error {
+        *runs = append(*runs, at)
+        return nil
+    }), db
+}
+
+func standup(name string) Job {
+    return Job{
+        Name:     name,
+        Schedule: "0 9 * * *",
+        Timezone: "America/Sao_Paulo",
+        Message:  parser.Message{Recipient: "Team", Content: "Standup!"},
+    }
+}
+
+func TestJobValidate(t *testing.T) {
+    tests := []struct {
+        name  string
+        edit  func(j *Job)
+        valid bool
+    }{
+        {name: "valid", edit: func(j *Job) {}, valid: true},
+        {name: "descriptor", edit: func(j *Job) { j.Schedule = "@weekly" }, valid: true},
+        {name: "no name", edit: func(j *Job) { j.Name = "" }},
+        {name: "invalid schedule", edit: func(j *Job) { j.Schedule = "every day" }},
+        {name: "seconds field", edit: func(j *Job) { j.Schedule = "0 0 9 * * *" }},
+        {name: "invalid timezone", edit: func(j *Job) { j.Timezone = "Mars/Olympus" }},
+        {name: "invalid catch-up", edit: func(j *Job) { j.CatchUp = "later" }},
+        {name: "no content", edit: func(j *Job) { j.Message.Content = "" }},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            job := standup("standup")
+            tt.edit(&job)
+
+            err := job.Validate()
+            if tt.valid && err != nil {
+                t.Errorf("expected the job to be valid, got %v", err)
+            }
+            if !tt.valid && err == nil {
+                t.Error("expected the job to be invalid")
+            }
+        })
+    }
+}
+
+func TestJobTimezone(t *testing.T) {
+    job := standup("standup")
+
+    // 9:00 in São Paulo is 12:00 UTC
+    next := job.next(time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC))
+    expected := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+    if !next.Equal(expected) {
+        t.Errorf("expected the next run at %v, got %v", expected, next.UTC())
+    }
+}
+
+func TestCatchUp(t *testing.T) {
+    now := time.Date(2024, 7, 4, 12, 0, 30, 0, time.UTC)
+    lastRun := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        policy   string
+        expected []time.Time
+    }{
+        {
+            policy:   CatchUpSkip,
+            expected: []time.Time{now.Add(-30 * time.Second)},
+        },
+        {
+            policy:   CatchUpOnce,
+            expected: []time.Time{lastRun.AddDate(0, 0, 2), now.Add(-30 * time.Second)},
+        },
+        {
+            policy: CatchUpAll,
+            expected: []time.Time{
+                lastRun.AddDate(0, 0, 1),
+                lastRun.AddDate(0, 0, 2),
+                now.Add(-30 * time.Second),
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.policy, func(t *testing.T) {
+            var runs []time.Time
+            scheduler, db := newScheduler(t, tt.policy, &runs)
+
+            err := scheduler.Sync([]Job{standup("standup")})
+            if err != nil {
+                t.Fatal(err)
+            }
+            _, err = db.Exec("UPDATE watchzap_jobs SET last_run = ?", lastRun.UnixMilli())
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            scheduler.tick(now)
+            if len(runs) != len(tt.expected) {
+                t.Fatalf("expected runs %v, got %v", tt.expected, runs)
+            }
+            for i := range runs {
+                if !runs[i].Equal(tt.expected[i]) {
+                    t.Errorf("run %d: expected %v, got %v", i, tt.expected[i], runs[i])
+                }
+            }
+
+            // Every run is dispatched only once
+            scheduler.tick(now.Add(time.Minute))
+            if len(runs) != len(tt.expected) {
+                t.Errorf("expected no more runs, got %v", runs)
+            }
+        })
+    }
+}
+
+func TestJobCatchUpOverridesDefault(t *testing.T) {
+    var runs []time.Time
+    scheduler, db := newScheduler(t, CatchUpSkip, &runs)
+
+    job := standup("standup")
+    job.CatchUp = CatchUpOnce
+    _, err := scheduler.Save(job)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = db.Exec("UPDATE watchzap_jobs SET last_run = ?", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC).UnixMilli())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    scheduler.tick(time.Date(2024, 7, 4, 0, 0, 0, 0, time.UTC))
+    if len(runs) != 1 {
+        t.Errorf("expected the latest missed run only, got %v", runs)
+    }
+}
+
+func TestSchedulerSources(t *testing.T) {
+    var runs []time.Time
+    scheduler, _ := newScheduler(t, CatchUpSkip, &runs)
+
+    err := scheduler.Sync([]Job{standup("standup"), standup("report")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = scheduler.Save(standup("reminder"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = scheduler.Save(standup("standup"))
+    if !errors.Is(err, ErrConfigJob) {
+        t.Errorf("expected config jobs not to be replaced through the API, got %v", err)
+    }
+    err = scheduler.Delete("report")
+    if !errors.Is(err, ErrConfigJob) {
+        t.Errorf("expected config jobs not to be deleted through the API, got %v", err)
+    }
+    err = scheduler.Delete("missing")
+    if !errors.Is(err, ErrJobNotFound) {
+        t.Errorf("expected a missing job not to be found, got %v", err)
+    }
+
+    // Jobs removed from the config file are removed, the API ones stay
+    err = scheduler.Sync([]Job{standup("standup")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    list, err := scheduler.List()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 2 || list[0].Name != "reminder" || list[0].Source != SourceAPI || list[1].Name != "standup" {
+        t.Errorf("expected the reminder and standup jobs, got %+v", list)
+    }
+
+    err = scheduler.Sync([]Job{standup("standup"), standup("standup")})
+    if err == nil {
+        t.Error("expected duplicated job names to fail")
+    }
+}
+
+func TestSchedulerSkipsUnreadableJobs(t *testing.T) {
+    var runs []time.Time
+    scheduler, db := newScheduler(t, CatchUpAll, &runs)
+
+    err := scheduler.Sync([]Job{standup("broken"), standup("standup")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Like a row edited by hand, or written before a field changed its type
+    _, err = db.Exec(`UPDATE watchzap_jobs SET message = '{"reply_to": "one"}' WHERE name = 'broken'`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = db.Exec("UPDATE watchzap_jobs SET last_run = ?", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC).UnixMilli())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    jobs, err := scheduler.List()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(jobs) != 1 || jobs[0].Name != "standup" {
+        t.Errorf("expected only the readable job, got %+v", jobs)
+    }
+    _, err = scheduler.Get("broken")
+    if !errors.Is(err, ErrUnreadable) {
+        t.Errorf("expected the broken job to be unreadable, got %v", err)
+    }
+
+    scheduler.tick(time.Date(2024, 7, 1, 12, 0, 30, 0, time.UTC))
+    if len(runs) != 1 {
+        t.Errorf("expected the readable job to run, got %v", runs)
+    }
+}
+
+func TestDueAfterLongDowntime(t *testing.T) {
+    now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name    string
+        lastRun time.Time
+        runs    int
+    }{
+        {name: "a year of runs every second", lastRun: now.AddDate(-1, 0, 0), runs: maxCatchUp},
+        {name: "never run", lastRun: time.Time{}, runs: maxCatchUp},
+        {name: "exactly maxCatchUp runs", lastRun: now.Add(-maxCatchUp * time.Second), runs: maxCatchUp},
+        {name: "fewer runs", lastRun: now.Add(-10 * time.Second), runs: 10},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            job := Job{Name: "tick", Schedule: "@every 1s", LastRun: tt.lastRun}
+
+            start := time.Now()
+            runs := job.due(now)
+            if time.Since(start) > time.Second {
+                t.Errorf("expected the runs quickly, took %v", time.Since(start))
+            }
+            if len(runs) != tt.runs || !runs[len(runs)-1].Equal(now) {
+                t.Fatalf("expected %d runs up to now, got %d ending at %v", tt.runs, len(runs), runs[len(runs)-1])
+            }
+            for i := 1; i < len(runs); i++ {
+                if runs[i].Sub(runs[i-1]) != time.Second {
+                    t.Fatalf("expected consecutive runs, got %v and %v", runs[i-1], runs[i])
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,85 @@
+package media
+
+import (
+    "bytes"
+    "errors"
+    "image"
+    "image/color"
+    "image/jpeg"
+
+    _ "image/gif"
+    _ "image/png"
+
+    "golang.org/x/image/draw"
+    _ "golang.org/x/image/webp"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Returned for images none of the decoders can read
+var ErrNotImage = errors.New(static.NOT_IMAGE)
+
+// Longest side of a thumbnail, WhatsApp blurs and stretches it until the full image is downloaded
+const thumbnailSize = 72
+
+// Largest image a thumbnail is made of, in pixels, decoding takes 4 bytes for each of them, about 48 MB here
+// That covers phone photos, while compressed images can be tiny and still claim a huge size,
+// so larger ones are sent without a thumbnail
+const maxThumbnailPixels = 12_000_000
+
+// What an image needs besides its content
+type Image struct {
+    Width  int
+    Height int
+    // Small JPEG shown while the image is downloaded
+    Thumbnail []byte
+}
+
+// Reads the size of a JPEG, PNG, GIF or WebP image and makes its thumbnail, unless it is over maxThumbnailPixels
+// GIFs are read from their first frame, and transparent parts are drawn on white since JPEG has no transparency
+func ParseImage(data []byte) (Image, error) {
+    config, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return Image{}, ErrNotImage
+    }
+
+    parsed := Image{Width: config.Width, Height: config.Height}
+    if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+        return parsed, nil
+    }
+
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return Image{}, ErrNotImage
+    }
+    parsed.Thumbnail, err = Thumbnail(img)
+    if err != nil {
+        return Image{}, err
+    }
+
+    return parsed, nil
+}
+
+// Returns a JPEG of img scaled down to fit in thumbnailSize, keeping its proportions
+func Thumbnail(img image.Image) ([]byte, error) {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    if width == 0 || height == 0 {
+        return nil, ErrNotImage
+    }
+
+    scale := min(1, float64(thumbnailSize)/float64(max(width, height)))
+    rect := image.Rect(0, 0, max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1))
+
+    thumb := image.NewRGBA(rect)
+    draw.Draw(thumb, rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+    draw.CatmullRom.Scale(thumb, rect, img, bounds, draw.Over, nil)
+
+    var buf bytes.Buffer
+    err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 75})
+    if err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+package media
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "image/jpeg"
+    "os"
+    "testing"
+)
+
+func TestParseImage(t *testing.T) {
+    tests := []struct {
+        file   string
+        width  int
+        height int
+        // Size of the thumbnail, the longest side being at most 72
+        thumbWidth  int
+        thumbHeight int
+    }{
+        {"testdata/photo.jpg", 320, 240, 72, 54},
+        {"testdata/logo.png", 100, 200, 36, 72},
+        {"testdata/dot.gif", 16, 8, 16, 8},
+        {"testdata/photo.webp", 150, 100, 72, 48},
+    }
+
+    for _, tt := range tests {
+        data, err := os.ReadFile(tt.file)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        img, err := ParseImage(data)
+        if err != nil {
+            t.Fatalf("%s: %v", tt.file, err)
+        }
+        if img.Width != tt.width || img.Height != tt.height {
+            t.Errorf("%s: expected %dx%d, got %dx%d", tt.file, tt.width, tt.height, img.Width, img.Height)
+        }
+
+        thumb, err := jpeg.Decode(bytes.NewReader(img.Thumbnail))
+        if err != nil {
+            t.Fatalf("%s: thumbnail is not a JPEG: %v", tt.file, err)
+        }
+        size := thumb.Bounds().Size()
+        if size.X != tt.thumbWidth || size.Y != tt.thumbHeight {
+            t.Errorf("%s: expected a %dx%d thumbnail, got %v", tt.file, tt.thumbWidth, tt.thumbHeight, size)
+        }
+    }
+
+    _, err := ParseImage([]byte("%PDF-1.4 not an image"))
+    if !errors.Is(err, ErrNotImage) {
+        t.Errorf("expected ErrNotImage, got %v", err)
+    }
+}
+
+func TestThumbnailTransparency(t *testing.T) {
+    data, err := os.ReadFile("testdata/logo.png")
+    if err != nil {
+        t.Fatal(err)
+    }
+    img, err := ParseImage(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The left half of the logo is transparent, so it has to come out white rather than black
+    thumb, err := jpeg.Decode(bytes.NewReader(img.Thumbnail))
+    if err != nil {
+        t.Fatal(err)
+    }
+    r, g, b, _ := thumb.At(2, 36).RGBA()
+    if r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+        t.Errorf("expected white where the image is transparent, got %d %d %d", r>>8, g>>8, b>>8)
+    }
+}
+
+func TestParseImageTooLarge(t *testing.T) {
+    logo, err := os.ReadFile("testdata/logo.png")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The headers claim sizes the pixels are not there for, so decoding them fails
+    tests := []struct {
+        name    string
+        width   uint32
+        height  uint32
+        decoded bool
+    }{
+        {name: "the largest decoded", width: 4000, height: maxThumbnailPixels / 4000, decoded: true},
+        {name: "one row over", width: 4000, height: maxThumbnailPixels/4000 + 1},
+        // Would take 40 GB to decode
+        {name: "huge", width: 100000, height: 100000},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            data := bytes.Clone(logo)
+            binary.BigEndian.PutUint32(data[16:], tt.width)
+            binary.BigEndian.PutUint32(data[20:], tt.height)
+            binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+            img, err := ParseImage(data)
+            if tt.decoded {
+                if !errors.Is(err, ErrNotImage) {
+                    t.Errorf("expected the image to be decoded, and fail for its missing pixels, got %v", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if img.Width != int(tt.width) || img.Height != int(tt.height) || img.Thumbnail != nil {
+                t.Errorf("expected the size without a thumbnail, got %dx%d with %d bytes", img.Width, img.Height,
+                    len(img.Thumbnail))
+            }
+        })
+    }
+}
@@ -0,0 +1,205 @@
+package media
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Returned, wrapped, for attachments over the size limit
+var ErrTooLarge = errors.New(static.MEDIA_TOO_LARGE)
+
+// Where an attachment comes from, only one of the fields is set
+type Source struct {
+    // Base64 encoded content
+    Data string
+    // Absolute path of a file, already checked by ResolvePath
+    Path string
+    // http or https URL downloaded when the message is sent
+    URL string
+}
+
+// Returns whether there is an attachment at all
+func (s Source) IsZero() bool {
+    return s.Data == "" && s.Path == "" && s.URL == ""
+}
+
+// Describes the source for logs and errors, without dumping base64 content
+func (s Source) String() string {
+    switch {
+    case s.Path != "":
+        return s.Path
+    case s.URL != "":
+        return s.URL
+    case s.Data != "":
+        return "base64"
+    }
+
+    return ""
+}
+
+// SourceError is returned when an attachment cannot be read and retrying won't change that,
+// like a missing file, an attachment over the size limit or a URL answering 404
+type SourceError struct {
+    Source string
+    Err    error
+}
+
+func (e *SourceError) Error() string {
+    return fmt.Sprintf("%s: %v", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+    return e.Err
+}
+
+// Loader reads attachments into memory, once, so they can be uploaded
+// whatsmeow only uploads byte slices, so attachments can't be streamed and MaxSize is what bounds memory
+type Loader struct {
+    // Largest attachment accepted, in bytes
+    MaxSize int64
+    client  *http.Client
+}
+
+// Creates a loader refusing attachments over maxSize bytes and downloads taking longer than timeout
+func NewLoader(maxSize int64, timeout time.Duration) *Loader {
+    return &Loader{
+        MaxSize: maxSize,
+        client:  &http.Client{Timeout: timeout},
+    }
+}
+
+// Returns the content of the attachment
+// Every source is read straight into a single buffer, base64 included, so a large attachment is held only once
+func (l *Loader) Load(ctx context.Context, src Source) ([]byte, error) {
+    switch {
+    case src.Path != "":
+        return l.loadFile(src.Path)
+    case src.URL != "":
+        return l.loadURL(ctx, src.URL)
+    }
+
+    return l.loadBase64(src.Data)
+}
+
+func (l *Loader) loadBase64(data string) ([]byte, error) {
+    decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+    decoded, err := l.read("base64", decoder, int64(base64.StdEncoding.DecodedLen(len(data))))
+
+    // Unlike a file or a download, broken base64 is never going to read fine
+    var sourceErr *SourceError
+    if err != nil && !errors.As(err, &sourceErr) {
+        return nil, &SourceError{Source: "base64", Err: err}
+    }
+
+    return decoded, err
+}
+
+func (l *Loader) loadFile(path string) ([]byte, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, &SourceError{Source: path, Err: err}
+    }
+    defer f.Close()
+
+    stat, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if !stat.Mode().IsRegular() {
+        return nil, &SourceError{Source: path, Err: errors.New(static.NOT_A_FILE)}
+    }
+    if stat.Size() > l.MaxSize {
+        return nil, &SourceError{Source: path, Err: ErrTooLarge}
+    }
+
+    return l.read(path, f, stat.Size())
+}
+
+func (l *Loader) loadURL(ctx context.Context, url string) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, &SourceError{Source: url, Err: err}
+    }
+
+    res, err := l.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+
+    // Server errors may go away, anything else the producer has to fix
+    if res.StatusCode >= http.StatusInternalServerError {
+        return nil, fmt.Errorf("%s: %s: %s", static.MEDIA_FETCH_FAILED, url, res.Status)
+    }
+    if res.StatusCode != http.StatusOK {
+        return nil, &SourceError{Source: url, Err: fmt.Errorf("%s: %s", static.MEDIA_FETCH_FAILED, res.Status)}
+    }
+    if res.ContentLength > l.MaxSize {
+        return nil, &SourceError{Source: url, Err: ErrTooLarge}
+    }
+
+    return l.read(url, res.Body, res.ContentLength)
+}
+
+// Reads r into a buffer of the expected size, or growing when it is unknown (-1), stopping past the size limit
+func (l *Loader) read(name string, r io.Reader, size int64) ([]byte, error) {
+    buf := bytes.NewBuffer(make([]byte, 0, min(max(size, 0), l.MaxSize)+bytes.MinRead))
+    _, err := buf.ReadFrom(io.LimitReader(r, l.MaxSize+1))
+    if err != nil {
+        return nil, err
+    }
+
+    return l.checkSize(name, buf.Bytes())
+}
+
+func (l *Loader) checkSize(name string, data []byte) ([]byte, error) {
+    if int64(len(data)) > l.MaxSize {
+        return nil, &SourceError{Source: name, Err: ErrTooLarge}
+    }
+
+    return data, nil
+}
+
+// Returns the absolute path of the attachment at path, relative paths being relative to dir
+// The result has its symbolic links resolved and must be inside root, so ../ or a link can't reach other files
+func ResolvePath(root string, dir string, path string) (string, error) {
+    if !filepath.IsAbs(path) {
+        path = filepath.Join(dir, path)
+    }
+
+    realRoot, err := realPath(root)
+    if err != nil {
+        return "", err
+    }
+    realFile, err := realPath(path)
+    if err != nil {
+        return "", err
+    }
+
+    rel, err := filepath.Rel(realRoot, realFile)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("%s: %s", static.OUTSIDE_MEDIA_ROOT, path)
+    }
+
+    return realFile, nil
+}
+
+func realPath(path string) (string, error) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return "", err
+    }
+
+    return filepath.EvalSymlinks(abs)
+}
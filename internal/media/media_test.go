@@ -0,0 +1,133 @@
+package media
+
+import (
+    "context"
+    "encoding/base64"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLoad(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "report.pdf")
+    err := os.WriteFile(path, []byte("%PDF-1.4 report"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/photo.png":
+            w.Write([]byte("png bytes"))
+        case "/broken":
+            w.WriteHeader(http.StatusBadGateway)
+        case "/big":
+            // No Content-Length, so the limit has to be enforced while reading
+            w.(http.Flusher).Flush()
+            w.Write([]byte(strings.Repeat("x", 64)))
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    defer server.Close()
+
+    loader := NewLoader(32, time.Second)
+    tests := []struct {
+        name      string
+        src       Source
+        expected  string
+        permanent bool
+    }{
+        {name: "base64", src: Source{Data: base64.StdEncoding.EncodeToString([]byte("hello"))}, expected: "hello"},
+        {name: "file", src: Source{Path: path}, expected: "%PDF-1.4 report"},
+        {name: "url", src: Source{URL: server.URL + "/photo.png"}, expected: "png bytes"},
+        {name: "broken base64", src: Source{Data: "not base64!"}, permanent: true},
+        {name: "base64 too large", src: Source{Data: base64.StdEncoding.EncodeToString(make([]byte, 33))}, permanent: true},
+        {name: "missing file", src: Source{Path: filepath.Join(dir, "missing.pdf")}, permanent: true},
+        {name: "folder", src: Source{Path: dir}, permanent: true},
+        {name: "url not found", src: Source{URL: server.URL + "/missing.png"}, permanent: true},
+        {name: "url too large", src: Source{URL: server.URL + "/big"}, permanent: true},
+        {name: "url server error", src: Source{URL: server.URL + "/broken"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            data, err := loader.Load(context.Background(), tt.src)
+            if tt.expected != "" {
+                if err != nil || string(data) != tt.expected {
+                    t.Fatalf("expected %q, got %q: %v", tt.expected, data, err)
+                }
+                return
+            }
+
+            var sourceErr *SourceError
+            if err == nil {
+                t.Fatalf("expected an error, got %q", data)
+            }
+            if errors.As(err, &sourceErr) != tt.permanent {
+                t.Errorf("expected permanent to be %v, got %v", tt.permanent, err)
+            }
+        })
+    }
+}
+
+func TestResolvePath(t *testing.T) {
+    root := t.TempDir()
+    err := os.MkdirAll(filepath.Join(root, "reports"), 0o755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"reports/july.pdf", "logo.png"} {
+        err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0o644)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    outside := filepath.Join(t.TempDir(), "secret.txt")
+    err = os.WriteFile(outside, []byte("x"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Symlink(outside, filepath.Join(root, "link.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    realRoot, err := filepath.EvalSymlinks(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        dir      string
+        path     string
+        expected string
+    }{
+        {dir: root, path: "reports/july.pdf", expected: filepath.Join(realRoot, "reports", "july.pdf")},
+        {dir: filepath.Join(root, "reports"), path: "../logo.png", expected: filepath.Join(realRoot, "logo.png")},
+        {dir: root, path: filepath.Join(root, "logo.png"), expected: filepath.Join(realRoot, "logo.png")},
+        {dir: root, path: "../secret.txt"},
+        {dir: root, path: outside},
+        {dir: root, path: "link.txt"},
+        {dir: root, path: "missing.png"},
+    }
+    for _, tt := range tests {
+        path, err := ResolvePath(root, tt.dir, tt.path)
+        if tt.expected == "" {
+            if err == nil {
+                t.Errorf("%s: expected an error, got %s", tt.path, path)
+            }
+            continue
+        }
+        if err != nil || path != tt.expected {
+            t.Errorf("%s: expected %s, got %q: %v", tt.path, tt.expected, path, err)
+        }
+    }
+}
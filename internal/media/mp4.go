@@ -0,0 +1,146 @@
+package media
+
+import (
+    "encoding/binary"
+    "errors"
+    "math"
+    "time"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Returned for videos whose MP4 boxes can't be read
+var ErrNotMp4 = errors.New(static.NOT_MP4)
+
+// What a video needs besides its content
+type Mp4 struct {
+    Duration time.Duration
+    Width    int
+    Height   int
+}
+
+// Returns the duration rounded up to whole seconds, as WhatsApp shows it
+func (v Mp4) Seconds() uint32 {
+    return uint32(math.Ceil(v.Duration.Seconds()))
+}
+
+// An MP4 box, data being its content after the header
+type mp4Box struct {
+    kind string
+    data []byte
+}
+
+// Reads the duration and size of an MP4 video from its headers, without decoding it
+// The duration is the one of the movie header, and the size the one of the first track that has one,
+// sound tracks having none
+func ParseMp4(data []byte) (Mp4, error) {
+    top, err := mp4Boxes(data)
+    if err != nil {
+        return Mp4{}, err
+    }
+    if len(top) == 0 || top[0].kind != "ftyp" {
+        return Mp4{}, ErrNotMp4
+    }
+
+    // The movie box is at the end of files that were not prepared for streaming
+    moov, ok := findBox(top, "moov")
+    if !ok {
+        return Mp4{}, ErrNotMp4
+    }
+    boxes, err := mp4Boxes(moov.data)
+    if err != nil {
+        return Mp4{}, err
+    }
+
+    var video Mp4
+    mvhd, ok := findBox(boxes, "mvhd")
+    if !ok {
+        return Mp4{}, ErrNotMp4
+    }
+    video.Duration, err = mvhdDuration(mvhd.data)
+    if err != nil {
+        return Mp4{}, err
+    }
+
+    for _, trak := range boxes {
+        if trak.kind != "trak" {
+            continue
+        }
+        children, err := mp4Boxes(trak.data)
+        if err != nil {
+            return Mp4{}, err
+        }
+        tkhd, ok := findBox(children, "tkhd")
+        // Width and height are 16.16 fixed point numbers closing the box
+        if !ok || len(tkhd.data) < 8 {
+            return Mp4{}, ErrNotMp4
+        }
+        size := tkhd.data[len(tkhd.data)-8:]
+        width, height := int(binary.BigEndian.Uint32(size)>>16), int(binary.BigEndian.Uint32(size[4:])>>16)
+        if width > 0 && height > 0 {
+            video.Width, video.Height = width, height
+            break
+        }
+    }
+
+    return video, nil
+}
+
+// Reads the time scale and duration of a movie header, 32 bits wide in version 0 and 64 in version 1
+func mvhdDuration(data []byte) (time.Duration, error) {
+    var timescale, duration uint64
+    switch {
+    case len(data) >= 20 && data[0] == 0:
+        timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+        duration = uint64(binary.BigEndian.Uint32(data[16:]))
+    case len(data) >= 32 && data[0] == 1:
+        timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+        duration = binary.BigEndian.Uint64(data[24:])
+    default:
+        return 0, ErrNotMp4
+    }
+    if timescale == 0 {
+        return 0, ErrNotMp4
+    }
+
+    return time.Duration(duration) * time.Second / time.Duration(timescale), nil
+}
+
+// Splits data into the boxes it holds
+// A box starts with its size and type, the size being 1 when a 64 bit size follows and 0 for the last box of the file
+func mp4Boxes(data []byte) ([]mp4Box, error) {
+    var boxes []mp4Box
+    for len(data) > 0 {
+        if len(data) < 8 {
+            return nil, ErrNotMp4
+        }
+        size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+        switch size {
+        case 0:
+            size = uint64(len(data))
+        case 1:
+            if len(data) < 16 {
+                return nil, ErrNotMp4
+            }
+            size, header = binary.BigEndian.Uint64(data[8:]), 16
+        }
+        if size < header || size > uint64(len(data)) {
+            return nil, ErrNotMp4
+        }
+
+        boxes = append(boxes, mp4Box{kind: string(data[4:8]), data: data[header:size]})
+        data = data[size:]
+    }
+
+    return boxes, nil
+}
+
+func findBox(boxes []mp4Box, kind string) (mp4Box, bool) {
+    for _, box := range boxes {
+        if box.kind == kind {
+            return box, true
+        }
+    }
+
+    return mp4Box{}, false
+}
@@ -0,0 +1,60 @@
+package media
+
+import (
+    "encoding/binary"
+    "errors"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestParseMp4(t *testing.T) {
+    // 4.5 seconds, with a sound track before the 640x360 video one and the movie box at the end
+    data, err := os.ReadFile("testdata/clip.mp4")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    video, err := ParseMp4(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := Mp4{Duration: 4500 * time.Millisecond, Width: 640, Height: 360}
+    if video != want {
+        t.Errorf("expected %+v, got %+v", want, video)
+    }
+    if video.Seconds() != 5 {
+        t.Errorf("expected 5 seconds, got %d", video.Seconds())
+    }
+
+    _, err = ParseMp4(data[:len(data)-4])
+    if !errors.Is(err, ErrNotMp4) {
+        t.Errorf("expected ErrNotMp4 for a truncated file, got %v", err)
+    }
+
+    _, err = ParseMp4([]byte("RIFF\x00\x00\x00\x00AVI LIST"))
+    if !errors.Is(err, ErrNotMp4) {
+        t.Errorf("expected ErrNotMp4 for an AVI, got %v", err)
+    }
+}
+
+func TestMvhdDuration(t *testing.T) {
+    // Version 1 headers have 64 bit times
+    v1 := make([]byte, 32)
+    v1[0] = 1
+    binary.BigEndian.PutUint32(v1[20:], 90000)
+    binary.BigEndian.PutUint64(v1[24:], 90000*60)
+
+    duration, err := mvhdDuration(v1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if duration != time.Minute {
+        t.Errorf("expected a minute, got %v", duration)
+    }
+
+    _, err = mvhdDuration(make([]byte, 20))
+    if !errors.Is(err, ErrNotMp4) {
+        t.Errorf("expected ErrNotMp4 without a time scale, got %v", err)
+    }
+}
@@ -0,0 +1,130 @@
+package media
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "math"
+    "time"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Returned for voice notes that are not Ogg files with Opus audio
+var ErrNotOpus = errors.New(static.NOT_OPUS)
+
+// Opus samples are always counted at 48 kHz, whatever the rate of the original audio
+const opusRate = 48000
+
+// Number of bars WhatsApp draws for a voice note
+const waveformLen = 64
+
+// What a voice note needs besides its content
+type Opus struct {
+    Duration time.Duration
+    // Loudness from 0 to 100 in 64 steps
+    Waveform []byte
+}
+
+// Returns the duration rounded up to whole seconds, as WhatsApp shows it
+func (o Opus) Seconds() uint32 {
+    return uint32(math.Ceil(o.Duration.Seconds()))
+}
+
+// A packet of an Ogg stream, start being the offset of its first byte in the file
+type oggPacket struct {
+    start int
+    size  int
+}
+
+// Reads an Ogg Opus file, checking its pages and headers
+// The duration comes from the granule position of the last page, less the samples the decoder skips at the start
+// Decoding the audio would need a native library, so the waveform is drawn from the size of the packets,
+// which the variable bitrate of Opus makes grow with loudness
+func ParseOpus(data []byte) (Opus, error) {
+    var packets []oggPacket
+    var granule int64
+    size, start := 0, -1
+    for off := 0; off < len(data); {
+        if len(data)-off < 27 || !bytes.Equal(data[off:off+4], []byte("OggS")) {
+            return Opus{}, ErrNotOpus
+        }
+        // -1 marks pages where no packet ends
+        if g := int64(binary.LittleEndian.Uint64(data[off+6:])); g > granule {
+            granule = g
+        }
+
+        segments := int(data[off+26])
+        body := off + 27 + segments
+        if body > len(data) {
+            return Opus{}, ErrNotOpus
+        }
+        for _, n := range data[off+27 : body] {
+            if body+int(n) > len(data) {
+                return Opus{}, ErrNotOpus
+            }
+            if start < 0 {
+                start = body
+            }
+            size += int(n)
+            body += int(n)
+            // Packets go on in the next segment, possibly on the next page, after a full one
+            if n < 255 {
+                packets = append(packets, oggPacket{start: start, size: size})
+                size, start = 0, -1
+            }
+        }
+        off = body
+    }
+
+    // The identification header goes first, then the comments, then the audio
+    if len(packets) < 2 || !hasPrefix(data, packets[0], "OpusHead", 19) || !hasPrefix(data, packets[1], "OpusTags", 8) {
+        return Opus{}, ErrNotOpus
+    }
+    preSkip := int64(binary.LittleEndian.Uint16(data[packets[0].start+10:]))
+
+    audio := make([]int, 0, len(packets)-2)
+    for _, p := range packets[2:] {
+        audio = append(audio, p.size)
+    }
+
+    return Opus{
+        Duration: time.Duration(max(granule-preSkip, 0)) * time.Second / opusRate,
+        Waveform: waveform(audio),
+    }, nil
+}
+
+// Returns whether the packet starts with prefix and is at least size bytes long
+func hasPrefix(data []byte, p oggPacket, prefix string, size int) bool {
+    return p.size >= size && p.start+size <= len(data) && bytes.HasPrefix(data[p.start:], []byte(prefix))
+}
+
+// Averages the sizes of the packets over 64 steps, scaled so the loudest step is 100
+func waveform(sizes []int) []byte {
+    if len(sizes) == 0 {
+        return nil
+    }
+
+    levels := make([]float64, waveformLen)
+    peak := 0.0
+    for i := range levels {
+        from := i * len(sizes) / waveformLen
+        to := max((i+1)*len(sizes)/waveformLen, from+1)
+
+        sum := 0
+        for _, size := range sizes[from:to] {
+            sum += size
+        }
+        levels[i] = float64(sum) / float64(to-from)
+        peak = max(peak, levels[i])
+    }
+
+    bars := make([]byte, waveformLen)
+    for i, level := range levels {
+        if peak > 0 {
+            bars[i] = byte(math.Round(level / peak * 100))
+        }
+    }
+
+    return bars
+}
@@ -0,0 +1,49 @@
+package media
+
+import (
+    "errors"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestParseOpus(t *testing.T) {
+    // 100 packets of 20 ms, quiet for the first and last quarter and loud in between
+    data, err := os.ReadFile("testdata/voice.ogg")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    opus, err := ParseOpus(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if opus.Duration != 2*time.Second || opus.Seconds() != 2 {
+        t.Errorf("expected 2s, got %v", opus.Duration)
+    }
+    if len(opus.Waveform) != 64 {
+        t.Fatalf("expected 64 bars, got %d", len(opus.Waveform))
+    }
+    if opus.Waveform[0] > 5 || opus.Waveform[32] != 100 || opus.Waveform[63] > 5 {
+        t.Errorf("expected quiet, loud then quiet, got %v", opus.Waveform)
+    }
+
+    // Cut in the middle of a page
+    _, err = ParseOpus(data[:len(data)-10])
+    if !errors.Is(err, ErrNotOpus) {
+        t.Errorf("expected ErrNotOpus for a truncated file, got %v", err)
+    }
+
+    // An Ogg file with other audio
+    vorbis := append([]byte{}, data...)
+    copy(vorbis[28:], "\x01vorbis\x00")
+    _, err = ParseOpus(vorbis)
+    if !errors.Is(err, ErrNotOpus) {
+        t.Errorf("expected ErrNotOpus for vorbis, got %v", err)
+    }
+
+    _, err = ParseOpus([]byte("ID3\x04 an mp3"))
+    if !errors.Is(err, ErrNotOpus) {
+        t.Errorf("expected ErrNotOpus for an mp3, got %v", err)
+    }
+}
@@ -0,0 +1,55 @@
+package media
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Returned for stickers that are not WebP images
+var ErrNotWebp = errors.New(static.NOT_WEBP)
+
+// What a sticker needs besides its content
+type Webp struct {
+    Width    int
+    Height   int
+    Animated bool
+}
+
+// Reads the header of a WebP image
+// The first chunk tells the format: VP8 for lossy, VP8L for lossless and VP8X for the extended one,
+// the only one that can be animated
+func ParseWebp(data []byte) (Webp, error) {
+    if len(data) < 20 || !bytes.Equal(data[0:4], []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WEBP")) {
+        return Webp{}, ErrNotWebp
+    }
+    chunk, payload := string(data[12:16]), data[20:]
+
+    switch {
+    case chunk == "VP8 " && len(payload) >= 10 && bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}):
+        return Webp{
+            Width:  int(binary.LittleEndian.Uint16(payload[6:]) & 0x3fff),
+            Height: int(binary.LittleEndian.Uint16(payload[8:]) & 0x3fff),
+        }, nil
+    case chunk == "VP8L" && len(payload) >= 5 && payload[0] == 0x2f:
+        bits := binary.LittleEndian.Uint32(payload[1:])
+        return Webp{
+            Width:  int(bits&0x3fff) + 1,
+            Height: int(bits>>14&0x3fff) + 1,
+        }, nil
+    case chunk == "VP8X" && len(payload) >= 10:
+        return Webp{
+            Width:    int(uint24(payload[4:])) + 1,
+            Height:   int(uint24(payload[7:])) + 1,
+            Animated: payload[0]&0x02 != 0,
+        }, nil
+    }
+
+    return Webp{}, ErrNotWebp
+}
+
+func uint24(b []byte) uint32 {
+    return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,37 @@
+package media
+
+import (
+    "errors"
+    "os"
+    "testing"
+)
+
+func TestParseWebp(t *testing.T) {
+    tests := []struct {
+        file string
+        want Webp
+    }{
+        {"testdata/sticker.webp", Webp{Width: 1, Height: 1}},
+        {"testdata/photo.webp", Webp{Width: 150, Height: 100}},
+        {"testdata/animated.webp", Webp{Width: 512, Height: 512, Animated: true}},
+    }
+
+    for _, tt := range tests {
+        data, err := os.ReadFile(tt.file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got, err := ParseWebp(data)
+        if err != nil {
+            t.Fatalf("%s: %v", tt.file, err)
+        }
+        if got != tt.want {
+            t.Errorf("%s: expected %+v, got %+v", tt.file, tt.want, got)
+        }
+    }
+
+    _, err := ParseWebp([]byte("\x89PNG\r\n\x1a\n not a webp"))
+    if !errors.Is(err, ErrNotWebp) {
+        t.Errorf("expected ErrNotWebp, got %v", err)
+    }
+}
@@ -0,0 +1,230 @@
+package parser
+
+import (
+    "bytes"
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "strings"
+
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Prefix of the header columns holding template variables, like vars.amount
+const varsPrefix = "vars."
+
+// Fields of Message that can be set from a CSV column, by their json name
+var csvFields = func() map[string]int {
+    fields := map[string]int{}
+    t := reflect.TypeOf(Message{})
+    for i := 0; i < t.NumField(); i++ {
+        if t.Field(i).Type.Kind() != reflect.String {
+            continue
+        }
+
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        fields[name] = i
+    }
+
+    return fields
+}()
+
+// A CSV error pointing at the offending cell, rows and columns start at 1 and the header is row 1
+type CsvError struct {
+    Row    int
+    Column int
+    Err    error
+}
+
+func (e *CsvError) Error() string {
+    if e.Column == 0 {
+        return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+    }
+
+    return fmt.Sprintf("row %d, column %d: %v", e.Row, e.Column, e.Err)
+}
+
+func (e *CsvError) Unwrap() error {
+    return e.Err
+}
+
+func init() {
+    Register(Parser{
+        Name:       "csv",
+        Extensions: []string{".csv"},
+        MimeTypes:  []string{"text/csv", "application/csv"},
+        Parse:      CsvParser,
+    })
+}
+
+// Parses a spreadsheet export with a header row naming the message fields
+// Columns are matched to the json names of the fields and vars.<name> columns fill the template variables,
+// the delimiter is , or ; whichever the header uses, and quoted cells may span several lines
+func CsvParser(body []byte) ([]Message, error) {
+    r := csv.NewReader(bytes.NewReader(body))
+    r.Comma = delimiter(body)
+
+    header, err := r.Read()
+    if errors.Is(err, io.EOF) {
+        return []Message{}, nil
+    }
+    if err != nil {
+        return nil, csvError(1, err)
+    }
+
+    columns, err := csvColumns(header)
+    if err != nil {
+        log.Warn().Err(err).Str("parser", "csv").Msg("WZ: Invalid CSV header")
+        return nil, err
+    }
+
+    var messages []Message
+    for row := 2; ; row++ {
+        record, err := r.Read()
+        if errors.Is(err, io.EOF) {
+            break
+        }
+        if err != nil {
+            err = csvError(row, err)
+            log.Warn().
+                Err(err).
+                Str("parser", "csv").
+                Msg("WZ: The file is not in the specified format. See README for more information")
+            return nil, err
+        }
+        if isBlank(record) {
+            continue
+        }
+
+        m, err := csvMessage(columns, record, row)
+        if err != nil {
+            log.Warn().Err(err).Str("parser", "csv").Msg("WZ: Invalid message")
+            return nil, err
+        }
+        messages = append(messages, m)
+    }
+
+    return messages, nil
+}
+
+// Where a column of the file goes, either a field of Message or a template variable
+type csvColumn struct {
+    field int
+    name  string
+    isVar bool
+}
+
+// Maps the header to the message fields, rejecting unknown and repeated columns
+func csvColumns(header []string) ([]csvColumn, error) {
+    columns := make([]csvColumn, len(header))
+    seen := map[string]bool{}
+    for i, name := range header {
+        name = strings.TrimSpace(name)
+        lower := strings.ToLower(name)
+
+        switch field, ok := csvFields[lower]; {
+        case strings.HasPrefix(lower, varsPrefix) && len(name) > len(varsPrefix):
+            columns[i] = csvColumn{name: name[len(varsPrefix):], isVar: true}
+        case ok:
+            columns[i] = csvColumn{field: field, name: lower}
+        default:
+            return nil, &CsvError{Row: 1, Column: i + 1, Err: fmt.Errorf("%s: %s", static.UNKNOWN_COLUMN, name)}
+        }
+
+        if seen[lower] {
+            return nil, &CsvError{Row: 1, Column: i + 1, Err: fmt.Errorf("%s: %s", static.DUPLICATE_COLUMN, name)}
+        }
+        seen[lower] = true
+    }
+
+    return columns, nil
+}
+
+// Builds the message of a row, checking every cell before the message as a whole
+func csvMessage(columns []csvColumn, record []string, row int) (Message, error) {
+    var m Message
+    v := reflect.ValueOf(&m).Elem()
+    for i, column := range columns {
+        value := record[i]
+        if column.isVar {
+            if m.Vars == nil {
+                m.Vars = map[string]any{}
+            }
+            m.Vars[column.name] = value
+            continue
+        }
+
+        // Only the content keeps its spaces, a stray space around a phone or name is never meant
+        if column.name != "content" {
+            value = strings.TrimSpace(value)
+        }
+
+        err := checkField(column.name, value)
+        if err != nil {
+            return Message{}, &CsvError{Row: row, Column: i + 1, Err: err}
+        }
+        v.Field(column.field).SetString(value)
+    }
+
+    err := m.Validate()
+    if err != nil {
+        return Message{}, &CsvError{Row: row, Err: err}
+    }
+
+    return m, nil
+}
+
+// Picks ; or , by counting them in the header, outside quotes, defaulting to ,
+func delimiter(body []byte) rune {
+    commas, semicolons := 0, 0
+    quoted := false
+    for _, b := range body {
+        switch {
+        case b == '"':
+            quoted = !quoted
+        case quoted:
+        case b == '\n':
+            if semicolons > commas {
+                return ';'
+            }
+            return ','
+        case b == ',':
+            commas++
+        case b == ';':
+            semicolons++
+        }
+    }
+
+    if semicolons > commas {
+        return ';'
+    }
+
+    return ','
+}
+
+// Converts the errors of encoding/csv, which count lines and characters, to the row being read
+func csvError(row int, err error) error {
+    var parseErr *csv.ParseError
+    if errors.As(err, &parseErr) && !errors.Is(parseErr.Err, csv.ErrFieldCount) {
+        err = fmt.Errorf("%w at line %d, character %d", parseErr.Err, parseErr.Line, parseErr.Column)
+    } else if parseErr != nil {
+        err = parseErr.Err
+    }
+
+    return &CsvError{Row: row, Err: err}
+}
+
+// Reports whether every cell of the record is empty, like the trailing ;;; rows of spreadsheets
+func isBlank(record []string) bool {
+    for _, cell := range record {
+        if strings.TrimSpace(cell) != "" {
+            return false
+        }
+    }
+
+    return true
+}
@@ -0,0 +1,112 @@
+package parser
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+)
+
+// Parses body the way watchzap does, decoding it first
+func readCsv(body string) ([]Message, error) {
+    p, err := Default.ForFile("messages.csv")
+    if err != nil {
+        return nil, err
+    }
+
+    return p.Read([]byte(body), "")
+}
+
+func TestCsvParser(t *testing.T) {
+    tests := []struct {
+        name     string
+        body     string
+        expected []Message
+    }{
+        {
+            name: "comma",
+            body: "recipient,content\nAlice,Hello\nBob,\"Hi, Bob\"\n",
+            expected: []Message{
+                {Recipient: "Alice", Content: "Hello"},
+                {Recipient: "Bob", Content: "Hi, Bob"},
+            },
+        },
+        {
+            name: "semicolon with BOM and CRLF",
+            body: "\xef\xbb\xbfRecipient;Phone;Content\r\n;+55 11 99999-0001;Olá, tudo bem?\r\n",
+            expected: []Message{
+                {Phone: "+55 11 99999-0001", Content: "Olá, tudo bem?"},
+            },
+        },
+        {
+            name: "quoted multiline content",
+            body: "recipient;content\nAlice;\"First line\nsecond line with \"\"quotes\"\"\"\n",
+            expected: []Message{
+                {Recipient: "Alice", Content: "First line\nsecond line with \"quotes\""},
+            },
+        },
+        {
+            name: "template vars and blank rows",
+            body: "recipient,template,vars.amount,send_at\nAlice,invoice_due,120,2030-01-01T08:00:00Z\n,,,\n",
+            expected: []Message{
+                {
+                    Recipient: "Alice",
+                    Template:  "invoice_due",
+                    Vars:      map[string]any{"amount": "120"},
+                    SendAt:    "2030-01-01T08:00:00Z",
+                },
+            },
+        },
+        {
+            name: "header only",
+            body: "recipient,content\n",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            messages, err := readCsv(tt.body)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(messages) != len(tt.expected) {
+                t.Fatalf("expected %d messages, got %+v", len(tt.expected), messages)
+            }
+            for i, m := range messages {
+                if !reflect.DeepEqual(m, tt.expected[i]) {
+                    t.Errorf("message %d: expected %+v, got %+v", i, tt.expected[i], m)
+                }
+            }
+        })
+    }
+}
+
+func TestCsvParserErrors(t *testing.T) {
+    tests := []struct {
+        name   string
+        body   string
+        row    int
+        column int
+    }{
+        {name: "unknown column", body: "recipient,message\nAlice,hi\n", row: 1, column: 2},
+        {name: "repeated column", body: "recipient,content,Content\nAlice,hi,hi\n", row: 1, column: 3},
+        {name: "invalid phone", body: "content;phone\nhi;+55\n", row: 2, column: 2},
+        {name: "invalid send_at", body: "recipient,content,send_at\nAlice,hi,tomorrow\n", row: 2, column: 3},
+        {name: "missing content", body: "recipient,content\nAlice,hi\nBob,\n", row: 3},
+        {name: "missing field", body: "recipient,content\nAlice,hi\nBob\n", row: 3},
+        {name: "broken quotes", body: "recipient,content\nAlice,\"hi\" there\n", row: 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := readCsv(tt.body)
+
+            var csvErr *CsvError
+            if !errors.As(err, &csvErr) {
+                t.Fatalf("expected a CSV error, got %v", err)
+            }
+            if csvErr.Row != tt.row || csvErr.Column != tt.column {
+                t.Errorf("expected row %d, column %d, got %v", tt.row, tt.column, err)
+            }
+        })
+    }
+}
@@ -0,0 +1,149 @@
+package parser
+
+import (
+    "bytes"
+    "fmt"
+    "mime"
+    "strings"
+    "unicode/utf8"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/charmap"
+    "golang.org/x/text/encoding/htmlindex"
+    "golang.org/x/text/encoding/unicode"
+    "golang.org/x/text/encoding/unicode/utf32"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Byte order marks, the UTF-32 ones first since UTF-32LE starts like UTF-16LE
+var boms = []struct {
+    bom      []byte
+    encoding encoding.Encoding
+}{
+    {[]byte{0xff, 0xfe, 0x00, 0x00}, utf32.UTF32(utf32.LittleEndian, utf32.IgnoreBOM)},
+    {[]byte{0x00, 0x00, 0xfe, 0xff}, utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM)},
+    {[]byte{0xef, 0xbb, 0xbf}, unicode.UTF8},
+    {[]byte{0xff, 0xfe}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+    {[]byte{0xfe, 0xff}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+}
+
+// How many bytes are looked at to guess the encoding of a body without BOM
+const sniffLen = 1024
+
+// Converts body to UTF-8
+// A byte order mark always wins, then the charset hint when given, like the charset of a Content-Type,
+// and otherwise the encoding is guessed: UTF-8 when valid, UTF-16 or UTF-32 when the zero bytes of ASCII text give
+// them away, and Windows-1252 as the last resort, the way old Windows tools export text
+func Decode(body []byte, charset string) ([]byte, error) {
+    for _, b := range boms {
+        if bytes.HasPrefix(body, b.bom) {
+            return decodeWith(b.encoding, body[len(b.bom):])
+        }
+    }
+
+    if charset != "" {
+        enc, err := lookupCharset(charset)
+        if err != nil {
+            return nil, err
+        }
+        if enc == unicode.UTF8 && !utf8.Valid(body) {
+            return nil, fmt.Errorf("%s: %s", static.INVALID_ENCODING, charset)
+        }
+        return decodeWith(enc, body)
+    }
+
+    return decodeWith(sniff(body), body)
+}
+
+// Returns the charset parameter of a Content-Type header, empty when there is none
+func Charset(contentType string) string {
+    _, params, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        return ""
+    }
+
+    return params["charset"]
+}
+
+// Checks that charset is known, empty meaning detected
+func ValidateCharset(charset string) error {
+    if charset == "" {
+        return nil
+    }
+
+    _, err := lookupCharset(charset)
+
+    return err
+}
+
+// Finds the encoding of a charset name, accepting the WHATWG names and labels plus UTF-32
+func lookupCharset(charset string) (encoding.Encoding, error) {
+    switch strings.ToLower(strings.TrimSpace(charset)) {
+    case "utf-8", "utf8":
+        return unicode.UTF8, nil
+    case "utf-32", "utf-32le":
+        return utf32.UTF32(utf32.LittleEndian, utf32.IgnoreBOM), nil
+    case "utf-32be":
+        return utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM), nil
+    }
+
+    enc, err := htmlindex.Get(charset)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", static.UNKNOWN_CHARSET, charset)
+    }
+
+    return enc, nil
+}
+
+// Guesses the encoding of a body without BOM
+// Messages are mostly ASCII, which UTF-16 and UTF-32 store with zero bytes in fixed positions
+func sniff(body []byte) encoding.Encoding {
+    sample := body[:min(len(body), sniffLen)]
+    if bytes.IndexByte(sample, 0) < 0 {
+        if utf8.Valid(body) {
+            return unicode.UTF8
+        }
+        return charmap.Windows1252
+    }
+
+    var zeros [4]int
+    for i, b := range sample {
+        if b == 0 {
+            zeros[i%4]++
+        }
+    }
+
+    // Each position needs most of its bytes to be zero to count, a stray NUL proves nothing
+    quarter := len(sample) / 4
+    mostly := func(n int) bool { return n > quarter*3/4 }
+    switch {
+    case len(body)%4 == 0 && mostly(zeros[1]) && mostly(zeros[2]) && mostly(zeros[3]) && !mostly(zeros[0]):
+        return utf32.UTF32(utf32.LittleEndian, utf32.IgnoreBOM)
+    case len(body)%4 == 0 && mostly(zeros[0]) && mostly(zeros[1]) && mostly(zeros[2]) && !mostly(zeros[3]):
+        return utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM)
+    case mostly(zeros[1]) && mostly(zeros[3]) && !mostly(zeros[0]):
+        return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+    case mostly(zeros[0]) && mostly(zeros[2]) && !mostly(zeros[1]):
+        return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+    }
+
+    return unicode.UTF8
+}
+
+// Converts body from enc to UTF-8, UTF-8 itself is only checked since it can't be told apart from garbage otherwise
+func decodeWith(enc encoding.Encoding, body []byte) ([]byte, error) {
+    if enc == unicode.UTF8 {
+        if !utf8.Valid(body) {
+            return nil, fmt.Errorf("%s: utf-8", static.INVALID_ENCODING)
+        }
+        return body, nil
+    }
+
+    decoded, err := enc.NewDecoder().Bytes(body)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", static.INVALID_ENCODING, err)
+    }
+
+    return decoded, nil
+}
@@ -0,0 +1,119 @@
+package parser
+
+import (
+    "strings"
+    "testing"
+    "unicode/utf16"
+
+    "github.com/watchzap/internal/static"
+)
+
+func utf16Bytes(s string, bigEndian bool) []byte {
+    var b []byte
+    for _, u := range utf16.Encode([]rune(s)) {
+        if bigEndian {
+            b = append(b, byte(u>>8), byte(u))
+        } else {
+            b = append(b, byte(u), byte(u>>8))
+        }
+    }
+
+    return b
+}
+
+func utf32Bytes(s string, bigEndian bool) []byte {
+    var b []byte
+    for _, r := range s {
+        if bigEndian {
+            b = append(b, byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+        } else {
+            b = append(b, byte(r), byte(r>>8), byte(r>>16), byte(r>>24))
+        }
+    }
+
+    return b
+}
+
+func TestDecode(t *testing.T) {
+    const text = `[{"recipient": "Zé", "content": "Olá, ação!"}]`
+
+    tests := []struct {
+        name    string
+        body    []byte
+        charset string
+    }{
+        {name: "utf-8", body: []byte(text)},
+        {name: "utf-8 odd length", body: []byte(text + " ")},
+        {name: "utf-8 bom", body: append([]byte{0xef, 0xbb, 0xbf}, text...)},
+        {name: "utf-16le", body: utf16Bytes(text, false)},
+        {name: "utf-16be", body: utf16Bytes(text, true)},
+        {name: "utf-16le bom", body: append([]byte{0xff, 0xfe}, utf16Bytes(text, false)...)},
+        {name: "utf-16be bom", body: append([]byte{0xfe, 0xff}, utf16Bytes(text, true)...)},
+        {name: "utf-32le", body: utf32Bytes(text, false)},
+        {name: "utf-32le bom", body: append([]byte{0xff, 0xfe, 0x00, 0x00}, utf32Bytes(text, false)...)},
+        {name: "utf-32be bom", body: append([]byte{0x00, 0x00, 0xfe, 0xff}, utf32Bytes(text, true)...)},
+        {name: "utf-16le hint", body: utf16Bytes(text, false), charset: "UTF-16LE"},
+        {name: "latin1 hint", body: []byte("[{\"recipient\": \"Z\xe9\", \"content\": \"Ol\xe1, a\xe7\xe3o!\"}]"), charset: "iso-8859-1"},
+        {name: "windows-1252 guess", body: []byte("[{\"recipient\": \"Z\xe9\", \"content\": \"Ol\xe1, a\xe7\xe3o!\"}]")},
+        {name: "bom beats hint", body: append([]byte{0xff, 0xfe}, utf16Bytes(text, false)...), charset: "utf-8"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            decoded, err := Decode(tt.body, tt.charset)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got := strings.TrimSuffix(string(decoded), " "); got != text {
+                t.Errorf("expected %q, got %q", text, got)
+            }
+        })
+    }
+}
+
+func TestDecodeErrors(t *testing.T) {
+    _, err := Decode([]byte("hi"), "klingon")
+    if err == nil || !strings.Contains(err.Error(), "klingon") {
+        t.Errorf("expected an unknown charset error, got %v", err)
+    }
+
+    _, err = Decode([]byte("Ol\xe1"), "utf-8")
+    if err == nil {
+        t.Error("expected invalid UTF-8 to be rejected when the charset says utf-8")
+    }
+
+    _, err = Decode([]byte("\xef\xbb\xbfOl\xe1"), "")
+    if err == nil || !strings.Contains(err.Error(), static.INVALID_ENCODING) {
+        t.Errorf("expected invalid UTF-8 after a UTF-8 BOM to be rejected, got %v", err)
+    }
+}
+
+func TestCharset(t *testing.T) {
+    if got := Charset("application/json; charset=UTF-16LE"); got != "UTF-16LE" {
+        t.Errorf("expected UTF-16LE, got %q", got)
+    }
+    if got := Charset("text/yaml"); got != "" {
+        t.Errorf("expected no charset, got %q", got)
+    }
+}
+
+func TestParsersShareEncodings(t *testing.T) {
+    bodies := map[string]string{
+        "m.json": `[{"recipient": "Zé", "content": "Olá"}]`,
+        "m.yaml": "- recipient: Zé\n  content: Olá\n",
+        "m.csv":  "recipient,content\nZé,Olá\n",
+    }
+    for path, body := range bodies {
+        p, err := Default.ForFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        messages, err := p.Read(append([]byte{0xff, 0xfe}, utf16Bytes(body, false)...), "")
+        if err != nil {
+            t.Fatalf("%s: %v", path, err)
+        }
+        if len(messages) != 1 || messages[0].Recipient != "Zé" || messages[0].Content != "Olá" {
+            t.Errorf("%s: unexpected messages %+v", path, messages)
+        }
+    }
+}
@@ -3,25 +3,25 @@ package parser
 import (
     "bytes"
     "encoding/json"
-    "errors"
 
     "github.com/rs/zerolog/log"
-
-    "github.com/watchzap/internal/static"
 )
 
-func JsonParser(body []byte) (*[]Message, error) {
-    var messages []Message
+func init() {
+    Register(Parser{
+        Name:       "json",
+        Extensions: []string{".json"},
+        MimeTypes:  []string{"application/json", "text/json"},
+        Parse:      JsonParser,
+    })
+}
 
-    decodedBody, err := DecodeUTF16(body)
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Could not decode body")
-        return nil, err
-    }
+func JsonParser(body []byte) ([]Message, error) {
+    var messages []Message
 
-    r := bytes.NewReader(decodedBody)
+    r := bytes.NewReader(body)
     decoder := json.NewDecoder(r)
-    err = decoder.Decode(&messages)
+    err := decoder.Decode(&messages)
     if err != nil {
         log.Warn().
             Err(err).
@@ -30,15 +30,14 @@ func JsonParser(body []byte) (*[]Message, error) {
         return nil, err
     }
 
-    for i, m := range messages {
-        if m.Recipient == "" || m.Content == "" {
-            log.Error().
-                Str("parser", "json").
-                Int("index", i).
-                Msg("WZ: Recipient or Content fields are empty")
-            return nil, errors.New(static.EMPTY_FIELD)
-        }
+    err = validate(messages)
+    if err != nil {
+        log.Error().
+            Err(err).
+            Str("parser", "json").
+            Msg("WZ: Invalid message")
+        return nil, err
     }
 
-    return &messages, nil
+    return messages, nil
 }
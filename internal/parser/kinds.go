@@ -0,0 +1,242 @@
+package parser
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "slices"
+    "strings"
+
+    "github.com/watchzap/internal/static"
+)
+
+// What a message is
+const (
+    // Text or media, the default
+    KindText = "text"
+    // A place on the map, from Location
+    KindLocation = "location"
+    // A contact card, from Contact
+    KindContact = "contact"
+    // A poll, from Poll
+    KindPoll = "poll"
+    // A reaction to a message sent before, from Reaction
+    KindReaction = "reaction"
+)
+
+// Most options WhatsApp lets a poll have
+const maxPollOptions = 12
+
+// A place sent by location messages
+type Location struct {
+    // Degrees, required, pointers so 0 can be told apart from missing
+    Latitude  *float64 `json:"latitude" yaml:"latitude"`
+    Longitude *float64 `json:"longitude" yaml:"longitude"`
+    Name      string   `json:"name,omitempty" yaml:"name,omitempty"`
+    Address   string   `json:"address,omitempty" yaml:"address,omitempty"`
+}
+
+// A person sent by contact messages, as a vCard
+type Contact struct {
+    Name string `json:"name" yaml:"name"`
+    // Phone numbers in international format, like +5511999999999
+    Phones []string `json:"phones" yaml:"phones"`
+}
+
+// The preview of a link in a text message, WhatsApp doesn't fetch it so the producer supplies it
+type Link struct {
+    // Link previewed, added to the content when missing from it
+    URL         string `json:"url" yaml:"url"`
+    Title       string `json:"title,omitempty" yaml:"title,omitempty"`
+    Description string `json:"description,omitempty" yaml:"description,omitempty"`
+    // Base64 encoded image, scaled down when sent
+    Thumbnail string `json:"thumbnail,omitempty" yaml:"thumbnail,omitempty"`
+}
+
+// A poll, its votes are collected as they come in and listed by GET /polls/{id}
+type Poll struct {
+    Question string   `json:"question" yaml:"question"`
+    Options  []string `json:"options" yaml:"options"`
+    // How many options each voter can pick, 0 for any number of them
+    SelectableCount int `json:"selectable_count,omitempty" yaml:"selectable_count,omitempty"`
+}
+
+// A reaction to a message watchzap sent, in the chat it was sent to
+type Reaction struct {
+    // ID of the message in the outbox
+    Message int64 `json:"message" yaml:"message"`
+    // An empty one removes the reaction
+    Emoji string `json:"emoji" yaml:"emoji"`
+}
+
+// Fields only some kinds take, and the kinds taking them
+// Reactions go to the chat of the message they react to, so they are the only kind without a recipient
+// Mentions are only shown in text, and captions of media
+var kindFields = map[string][]string{
+    KindText:     {"recipient", "content", "attachment", "link", "reply_to", "mentions"},
+    KindLocation: {"recipient", "content", "location", "reply_to"},
+    KindContact:  {"recipient", "contact", "reply_to"},
+    KindPoll:     {"recipient", "poll", "reply_to"},
+    KindReaction: {"reaction"},
+}
+
+// Returns the kind of the message, text when empty
+func (m Message) MessageKind() string {
+    if m.Kind == "" {
+        return KindText
+    }
+
+    return m.Kind
+}
+
+// Checks the fields the kind of the message needs, and that it has none meant for other kinds
+func (m Message) validateKind() error {
+    kind := m.MessageKind()
+    allowed, ok := kindFields[kind]
+    if !ok {
+        return fmt.Errorf("%s: %s", static.INVALID_KIND, kind)
+    }
+
+    fields := []struct {
+        name string
+        set  bool
+    }{
+        {"recipient", m.Recipient != "" || m.Phone != "" || m.Jid != ""},
+        {"content", m.Content != "" || m.Template != ""},
+        {"attachment", m.HasAttachment()},
+        {"link", m.Link != nil},
+        {"location", m.Location != nil},
+        {"contact", m.Contact != nil},
+        {"poll", m.Poll != nil},
+        {"reaction", m.Reaction != nil},
+        {"reply_to", m.ReplyTo != 0},
+        {"mentions", len(m.Mentions) > 0},
+    }
+    for _, f := range fields {
+        if f.set && !slices.Contains(allowed, f.name) {
+            return fmt.Errorf("%s: %s in a %s message", static.KIND_FIELD, f.name, kind)
+        }
+    }
+
+    if kind != KindReaction && m.Recipient == "" && m.Phone == "" && m.Jid == "" {
+        return fmt.Errorf("%s: recipient, phone or jid", static.EMPTY_FIELD)
+    }
+
+    switch kind {
+    case KindText:
+        if m.Content == "" && m.Template == "" && !m.HasAttachment() {
+            return fmt.Errorf("%s: content, template or attachment", static.EMPTY_FIELD)
+        }
+        if m.Link != nil {
+            if m.HasAttachment() {
+                return fmt.Errorf("%s: link in a message with an attachment", static.KIND_FIELD)
+            }
+            return m.Link.Validate()
+        }
+    case KindLocation:
+        if m.Location == nil {
+            return fmt.Errorf("%s: location", static.EMPTY_FIELD)
+        }
+        return m.Location.Validate()
+    case KindContact:
+        if m.Contact == nil {
+            return fmt.Errorf("%s: contact", static.EMPTY_FIELD)
+        }
+        return m.Contact.Validate()
+    case KindPoll:
+        if m.Poll == nil {
+            return fmt.Errorf("%s: poll", static.EMPTY_FIELD)
+        }
+        return m.Poll.Validate()
+    case KindReaction:
+        if m.Reaction == nil {
+            return fmt.Errorf("%s: reaction", static.EMPTY_FIELD)
+        }
+        if m.Reaction.Message <= 0 {
+            return fmt.Errorf("%s: %d", static.INVALID_ID, m.Reaction.Message)
+        }
+    }
+
+    return nil
+}
+
+// Checks that the location has coordinates on the map
+func (l Location) Validate() error {
+    if l.Latitude == nil || l.Longitude == nil {
+        return fmt.Errorf("%s: location latitude and longitude", static.EMPTY_FIELD)
+    }
+    if *l.Latitude < -90 || *l.Latitude > 90 {
+        return fmt.Errorf("%s: %v", static.INVALID_LATITUDE, *l.Latitude)
+    }
+    if *l.Longitude < -180 || *l.Longitude > 180 {
+        return fmt.Errorf("%s: %v", static.INVALID_LONGITUDE, *l.Longitude)
+    }
+
+    return nil
+}
+
+// Checks that the contact has a name and valid phone numbers
+func (c Contact) Validate() error {
+    if strings.TrimSpace(c.Name) == "" {
+        return fmt.Errorf("%s: contact name", static.EMPTY_FIELD)
+    }
+    if len(c.Phones) == 0 {
+        return fmt.Errorf("%s: contact phones", static.EMPTY_FIELD)
+    }
+    for _, phone := range c.Phones {
+        _, err := NormalizePhone(phone)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Checks the URL and that the thumbnail is base64, whether it is an image is only known when it is decoded
+func (l Link) Validate() error {
+    if l.URL == "" {
+        return fmt.Errorf("%s: link url", static.EMPTY_FIELD)
+    }
+    err := checkField("link_url", l.URL)
+    if err != nil {
+        return err
+    }
+
+    if l.Thumbnail != "" {
+        _, err := base64.StdEncoding.DecodeString(l.Thumbnail)
+        if err != nil {
+            return errors.New(static.INVALID_THUMBNAIL)
+        }
+    }
+
+    return nil
+}
+
+// Checks the poll has a question and between 2 and 12 distinct options, and that the count fits them
+func (p Poll) Validate() error {
+    if strings.TrimSpace(p.Question) == "" {
+        return fmt.Errorf("%s: poll question", static.EMPTY_FIELD)
+    }
+    if len(p.Options) < 2 || len(p.Options) > maxPollOptions {
+        return fmt.Errorf("%s: %d", static.POLL_OPTIONS, len(p.Options))
+    }
+
+    // Votes name the options by a hash of their text, so two equal options could not be told apart
+    seen := map[string]bool{}
+    for _, option := range p.Options {
+        if strings.TrimSpace(option) == "" {
+            return fmt.Errorf("%s: poll option", static.EMPTY_FIELD)
+        }
+        if seen[option] {
+            return fmt.Errorf("%s: %s", static.DUPLICATE_OPTION, option)
+        }
+        seen[option] = true
+    }
+
+    if p.SelectableCount < 0 || p.SelectableCount > len(p.Options) {
+        return fmt.Errorf("%s: %d", static.INVALID_SELECTABLE, p.SelectableCount)
+    }
+
+    return nil
+}
@@ -0,0 +1,303 @@
+package parser
+
+import (
+    "errors"
+    "strings"
+    "testing"
+
+    "github.com/watchzap/internal/static"
+)
+
+func TestMessageValidateKinds(t *testing.T) {
+    lat, long, far := -23.5613, -46.6565, 123.0
+    tests := []struct {
+        name string
+        m    Message
+        // Start of the error, empty when valid
+        err string
+    }{
+        {
+            name: "location",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindLocation,
+                Content:   "Meet here",
+                Location:  &Location{Latitude: &lat, Longitude: &long, Name: "MASP"},
+            },
+        },
+        {
+            name: "location on the equator",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindLocation,
+                Location:  &Location{Latitude: new(float64), Longitude: &long},
+            },
+        },
+        {
+            name: "location without longitude",
+            m:    Message{Recipient: "Ops", Kind: KindLocation, Location: &Location{Latitude: &lat}},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "latitude out of range",
+            m:    Message{Recipient: "Ops", Kind: KindLocation, Location: &Location{Latitude: &far, Longitude: &long}},
+            err:  static.INVALID_LATITUDE,
+        },
+        {
+            name: "location kind without location",
+            m:    Message{Recipient: "Ops", Kind: KindLocation, Content: "here"},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "location with an attachment",
+            m: Message{
+                Recipient:      "Ops",
+                Kind:           KindLocation,
+                Location:       &Location{Latitude: &lat, Longitude: &long},
+                AttachmentPath: "map.png",
+            },
+            err: static.KIND_FIELD,
+        },
+        {
+            name: "location in a text message",
+            m:    Message{Recipient: "Ops", Content: "hi", Location: &Location{Latitude: &lat, Longitude: &long}},
+            err:  static.KIND_FIELD,
+        },
+        {
+            name: "contact",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindContact,
+                Contact:   &Contact{Name: "Support", Phones: []string{"+55 11 99999-9999", "+5511988887777"}},
+            },
+        },
+        {
+            name: "contact without phones",
+            m:    Message{Recipient: "Ops", Kind: KindContact, Contact: &Contact{Name: "Support"}},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "contact with an invalid phone",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindContact,
+                Contact:   &Contact{Name: "Support", Phones: []string{"123"}},
+            },
+            err: static.INVALID_PHONE,
+        },
+        {
+            name: "contact with content",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindContact,
+                Content:   "call them",
+                Contact:   &Contact{Name: "Support", Phones: []string{"+5511988887777"}},
+            },
+            err: static.KIND_FIELD,
+        },
+        {
+            name: "link",
+            m: Message{
+                Recipient: "Ops",
+                Content:   "Read the news",
+                Link:      &Link{URL: "https://example.com/news", Title: "News", Thumbnail: "iVBORw0KGgo="},
+            },
+        },
+        {
+            name: "link without content",
+            m:    Message{Recipient: "Ops", Link: &Link{URL: "https://example.com/news"}},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "link with an invalid url",
+            m:    Message{Recipient: "Ops", Content: "hi", Link: &Link{URL: "example.com"}},
+            err:  static.INVALID_LINK_URL,
+        },
+        {
+            name: "link with a thumbnail that is not base64",
+            m:    Message{Recipient: "Ops", Content: "hi", Link: &Link{URL: "https://x.io", Thumbnail: "not base64!"}},
+            err:  static.INVALID_THUMBNAIL,
+        },
+        {
+            name: "link with an attachment",
+            m:    Message{Recipient: "Ops", AttachmentPath: "a.png", Link: &Link{URL: "https://x.io"}},
+            err:  static.KIND_FIELD,
+        },
+        {
+            name: "poll",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindPoll,
+                Poll:      &Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}, SelectableCount: 1},
+            },
+        },
+        {
+            name: "poll with one option",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindPoll,
+                Poll:      &Poll{Question: "Lunch?", Options: []string{"Pizza"}},
+            },
+            err: static.POLL_OPTIONS,
+        },
+        {
+            name: "poll with a repeated option",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindPoll,
+                Poll:      &Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi", "Pizza"}},
+            },
+            err: static.DUPLICATE_OPTION,
+        },
+        {
+            name: "poll with more selectable options than it has",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindPoll,
+                Poll:      &Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}, SelectableCount: 3},
+            },
+            err: static.INVALID_SELECTABLE,
+        },
+        {
+            name: "poll without question",
+            m:    Message{Recipient: "Ops", Kind: KindPoll, Poll: &Poll{Options: []string{"Pizza", "Sushi"}}},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "reaction",
+            m:    Message{Kind: KindReaction, Reaction: &Reaction{Message: 1, Emoji: "👍"}},
+        },
+        {
+            name: "reaction removed",
+            m:    Message{Kind: KindReaction, Reaction: &Reaction{Message: 1}},
+        },
+        {
+            name: "reaction without message",
+            m:    Message{Kind: KindReaction, Reaction: &Reaction{Emoji: "👍"}},
+            err:  static.INVALID_ID,
+        },
+        {
+            name: "reaction with a recipient",
+            m:    Message{Recipient: "Ops", Kind: KindReaction, Reaction: &Reaction{Message: 1, Emoji: "👍"}},
+            err:  static.KIND_FIELD,
+        },
+        {
+            name: "text without recipient",
+            m:    Message{Content: "hi"},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "reply with mentions",
+            m: Message{
+                Recipient: "Ops",
+                Content:   "@Alice look",
+                ReplyTo:   1,
+                Mentions:  []string{"Alice", "+5511988887777"},
+            },
+        },
+        {
+            name: "poll replying to a message",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindPoll,
+                ReplyTo:   1,
+                Poll:      &Poll{Question: "Restart it?", Options: []string{"Yes", "No"}},
+            },
+        },
+        {
+            name: "reply to an invalid message",
+            m:    Message{Recipient: "Ops", Content: "hi", ReplyTo: -1},
+            err:  static.INVALID_ID,
+        },
+        {
+            name: "mention with an invalid phone",
+            m:    Message{Recipient: "Ops", Content: "hi", Mentions: []string{"+123"}},
+            err:  static.INVALID_PHONE,
+        },
+        {
+            name: "empty mention",
+            m:    Message{Recipient: "Ops", Content: "hi", Mentions: []string{" "}},
+            err:  static.EMPTY_FIELD,
+        },
+        {
+            name: "mention in a contact message",
+            m: Message{
+                Recipient: "Ops",
+                Kind:      KindContact,
+                Mentions:  []string{"Alice"},
+                Contact:   &Contact{Name: "Support", Phones: []string{"+5511988887777"}},
+            },
+            err: static.KIND_FIELD,
+        },
+        {
+            name: "reaction replying to a message",
+            m:    Message{Kind: KindReaction, ReplyTo: 1, Reaction: &Reaction{Message: 1, Emoji: "👍"}},
+            err:  static.KIND_FIELD,
+        },
+        {name: "unknown kind", m: Message{Recipient: "Ops", Kind: "sms", Content: "hi"}, err: static.INVALID_KIND},
+    }
+
+    for _, tt := range tests {
+        err := tt.m.Validate()
+        if tt.err == "" && err != nil {
+            t.Errorf("%s: expected no error, got %v", tt.name, err)
+        }
+        if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+            t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+        }
+    }
+}
+
+func TestParseKinds(t *testing.T) {
+    body := `
+- phone: "+5511999999999"
+  kind: location
+  location: {latitude: -23.5613, longitude: -46.6565, name: MASP, address: "Av. Paulista, 1578"}
+- phone: "+5511999999999"
+  kind: contact
+  contact:
+    name: Support
+    phones: ["+5511988887777"]
+- jid: 120363000000000001@g.us
+  kind: poll
+  poll:
+    question: Lunch?
+    options: [Pizza, Sushi]
+    selectable_count: 1
+- kind: reaction
+  reaction: {message: 1, emoji: "👍"}
+`
+    p, err := Default.ForFile("messages.yaml")
+    if err != nil {
+        t.Fatal(err)
+    }
+    messages, err := p.Read([]byte(body), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    l := messages[0].Location
+    if *l.Latitude != -23.5613 || *l.Longitude != -46.6565 || l.Address != "Av. Paulista, 1578" {
+        t.Errorf("unexpected location %+v", l)
+    }
+    if c := messages[1].Contact; c.Name != "Support" || len(c.Phones) != 1 {
+        t.Errorf("unexpected contact %+v", c)
+    }
+    if p := messages[2].Poll; p.Question != "Lunch?" || len(p.Options) != 2 || p.SelectableCount != 1 {
+        t.Errorf("unexpected poll %+v", p)
+    }
+    if r := messages[3].Reaction; r.Message != 1 || r.Emoji != "👍" || messages[3].To() != "message 1" {
+        t.Errorf("unexpected reaction %+v", r)
+    }
+
+    // Kinds needing more than a string can't come from a CSV column
+    _, err = readCsv("phone,kind\n+5511999999999,location\n")
+    var csvErr *CsvError
+    if !errors.As(err, &csvErr) || !strings.Contains(err.Error(), static.EMPTY_FIELD) {
+        t.Errorf("expected %q, got %v", static.EMPTY_FIELD, err)
+    }
+    _, err = readCsv("phone,kind,content\n+5511999999999,sms,hi\n")
+    if err == nil || !strings.Contains(err.Error(), static.INVALID_KIND) {
+        t.Errorf("expected %q, got %v", static.INVALID_KIND, err)
+    }
+}
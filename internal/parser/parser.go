@@ -1,43 +1,361 @@
 package parser
 
 import (
-    "bytes"
+    "errors"
     "fmt"
-    "unicode/utf16"
-    "unicode/utf8"
+    "mime"
+    "net/url"
+    "strings"
+    "time"
 
     "github.com/watchzap/internal/static"
 )
 
+// Servers a message can be sent to directly by JID
+const (
+    UserServer  = "s.whatsapp.net"
+    GroupServer = "g.us"
+)
+
 type Message struct {
-    Recipient  string `json:"recipient"`
-    Content    string `json:"content"`
-    Attachment string `json:"attachment"`
+    // Contact or group name, used only when neither Phone nor Jid is set
+    Recipient string `json:"recipient" yaml:"recipient"`
+    // Phone number in international format, like +5511999999999
+    Phone string `json:"phone" yaml:"phone"`
+    // Contact (@s.whatsapp.net) or group (@g.us) JID
+    Jid     string `json:"jid" yaml:"jid"`
+    Content string `json:"content" yaml:"content"`
+    // What the message is, one of the Kind constants, text when empty
+    Kind string `json:"kind,omitempty" yaml:"kind,omitempty"`
+    // Place sent by location messages, which show Content under it
+    Location *Location `json:"location,omitempty" yaml:"location,omitempty"`
+    // Person sent by contact messages, which have no Content
+    Contact *Contact `json:"contact,omitempty" yaml:"contact,omitempty"`
+    // Preview of a link in the Content of a text message
+    Link *Link `json:"link,omitempty" yaml:"link,omitempty"`
+    // Question and options of poll messages
+    Poll *Poll `json:"poll,omitempty" yaml:"poll,omitempty"`
+    // Message and emoji of reaction messages, which have no recipient
+    Reaction *Reaction `json:"reaction,omitempty" yaml:"reaction,omitempty"`
+    // ID of a message of the outbox this one replies to, quoting it
+    ReplyTo int64 `json:"reply_to,omitempty" yaml:"reply_to,omitempty"`
+    // Phone numbers or contact names notified with an @ in Content
+    Mentions []string `json:"mentions,omitempty" yaml:"mentions,omitempty"`
+    // Base64 encoded media
+    Attachment string `json:"attachment" yaml:"attachment"`
+    // File with the media, relative to the media root or else to the watched file
+    AttachmentPath string `json:"attachment_path,omitempty" yaml:"attachment_path,omitempty"`
+    // http or https URL the media is downloaded from when the message is sent
+    AttachmentURL string `json:"attachment_url,omitempty" yaml:"attachment_url,omitempty"`
+    // Name of a file part of the multipart/form-data request the message came in
+    AttachmentPart string `json:"attachment_part,omitempty" yaml:"attachment_part,omitempty"`
+    // Name the recipient sees for the attachment, taken from its path, URL or part when empty
+    Filename string `json:"filename,omitempty" yaml:"filename,omitempty"`
+    // Media type of the attachment, detected from its content and file name when empty
+    Mimetype string `json:"mimetype,omitempty" yaml:"mimetype,omitempty"`
+    // How the attachment is sent, one of the SendAs constants, picked by its media type when empty
+    SendAs string `json:"send_as,omitempty" yaml:"send_as,omitempty"`
+    // Several attachments sent in order, instead of the attachment fields above
+    Attachments []Attachment `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+    // Position of the attachment showing Content as its caption, from 0
+    CaptionIndex int `json:"caption_index,omitempty" yaml:"caption_index,omitempty"`
+    // Name of a template in the templates folder rendered into Content
+    Template string `json:"template,omitempty" yaml:"template,omitempty"`
+    // Values for the template, or for Content itself when no template is named
+    Vars map[string]any `json:"vars,omitempty" yaml:"vars,omitempty"`
+    // When to send the message, in RFC 3339 like 2024-07-01T08:00:00-03:00
+    SendAt string `json:"send_at,omitempty" yaml:"send_at,omitempty"`
+    // How long after being received to send the message, like 90m or 2h30m
+    Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+}
+
+// How an attachment can be sent
+const (
+    SendAsImage = "image"
+    SendAsVideo = "video"
+    SendAsAudio = "audio"
+    // Audio played as a recorded voice note, must be Ogg Opus
+    SendAsVoice = "voice"
+    // Video played muted and looping like a GIF, must be MP4
+    SendAsGif = "gif"
+    // Anything else, the file as is
+    SendAsDocument = "document"
+    // WebP image shown without a bubble, animated or not
+    SendAsSticker = "sticker"
+)
+
+// One of the attachments of a message, only one of its sources is set
+type Attachment struct {
+    // Base64 encoded media
+    Data string `json:"data,omitempty" yaml:"data,omitempty"`
+    // Like attachment_path
+    Path string `json:"path,omitempty" yaml:"path,omitempty"`
+    // Like attachment_url
+    URL string `json:"url,omitempty" yaml:"url,omitempty"`
+    // Like attachment_part
+    Part string `json:"part,omitempty" yaml:"part,omitempty"`
+    // Like the filename, mimetype and send_as of a message
+    Filename string `json:"filename,omitempty" yaml:"filename,omitempty"`
+    Mimetype string `json:"mimetype,omitempty" yaml:"mimetype,omitempty"`
+    SendAs   string `json:"send_as,omitempty" yaml:"send_as,omitempty"`
+}
+
+// Checks that the attachment has exactly one source
+func (a Attachment) Validate() error {
+    sources := 0
+    for _, source := range []string{a.Data, a.Path, a.URL, a.Part} {
+        if source != "" {
+            sources++
+        }
+    }
+    if sources != 1 {
+        return errors.New(static.ONE_SOURCE)
+    }
+
+    fields := []struct{ name, value string }{
+        {"attachment_url", a.URL},
+        {"mimetype", a.Mimetype},
+        {"send_as", a.SendAs},
+    }
+    for _, f := range fields {
+        err := checkField(f.name, f.value)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Returns one message for each of its attachments, in order, or the message itself when it has no attachments list
+// Only the attachment at CaptionIndex keeps Content, as its caption, along with the message it replies to and mentions
+func (m Message) Split() []Message {
+    if len(m.Attachments) == 0 {
+        return []Message{m}
+    }
+
+    parts := make([]Message, len(m.Attachments))
+    for i, a := range m.Attachments {
+        part := m
+        part.Attachments = nil
+        part.CaptionIndex = 0
+        part.Attachment, part.AttachmentPath, part.AttachmentURL, part.AttachmentPart = a.Data, a.Path, a.URL, a.Part
+        part.Filename, part.Mimetype, part.SendAs = a.Filename, a.Mimetype, a.SendAs
+        if i != m.CaptionIndex {
+            part.Content, part.ReplyTo, part.Mentions = "", 0, nil
+        }
+        parts[i] = part
+    }
+
+    return parts
+}
+
+// Returns when the message should be sent, given when it was received
+// Messages without send_at or delay are due right away
+func (m Message) DueAt(received time.Time) time.Time {
+    if m.SendAt != "" {
+        at, err := time.Parse(time.RFC3339, m.SendAt)
+        if err == nil {
+            return at
+        }
+    }
+    if m.Delay != "" {
+        delay, err := time.ParseDuration(m.Delay)
+        if err == nil {
+            return received.Add(delay)
+        }
+    }
+
+    return received
+}
+
+// Returns how the recipient of the message was given, for logs and responses
+// Reactions have none, the message they react to is given instead
+func (m Message) To() string {
+    switch {
+    case m.Reaction != nil:
+        return fmt.Sprintf("message %d", m.Reaction.Message)
+    case m.Jid != "":
+        return m.Jid
+    case m.Phone != "":
+        return m.Phone
+    }
+
+    return m.Recipient
+}
+
+// Returns whether the message carries media, in any of the ways it can be given
+func (m Message) HasAttachment() bool {
+    return m.Attachment != "" || m.AttachmentPath != "" || m.AttachmentURL != "" || m.AttachmentPart != "" ||
+        len(m.Attachments) > 0
 }
 
-func DecodeUTF16(b []byte) ([]byte, error) {
-    if len(b)%2 != 0 {
-        return []byte{}, fmt.Errorf(static.INVALID_BYTES)
+// Checks that the message has everything needed to be sent
+func (m Message) Validate() error {
+    err := m.validateKind()
+    if err != nil {
+        return err
     }
 
-    u16s := make([]uint16, 1)
+    attachments := 0
+    for _, a := range []string{m.Attachment, m.AttachmentPath, m.AttachmentURL, m.AttachmentPart} {
+        if a != "" {
+            attachments++
+        }
+    }
+    if attachments > 1 || (attachments == 1 && len(m.Attachments) > 0) {
+        return errors.New(static.MANY_ATTACHMENTS)
+    }
+    for i, a := range m.Attachments {
+        err := a.Validate()
+        if err != nil {
+            return fmt.Errorf("attachment %d: %w", i, err)
+        }
+    }
+    if m.CaptionIndex < 0 || (m.CaptionIndex > 0 && m.CaptionIndex >= len(m.Attachments)) {
+        return fmt.Errorf("%s: %d", static.INVALID_CAPTION_INDEX, m.CaptionIndex)
+    }
+
+    if m.ReplyTo < 0 {
+        return fmt.Errorf("%s: %d", static.INVALID_ID, m.ReplyTo)
+    }
+    for _, mention := range m.Mentions {
+        if strings.TrimSpace(mention) == "" {
+            return fmt.Errorf("%s: mention", static.EMPTY_FIELD)
+        }
+        err = checkField("mention", mention)
+        if err != nil {
+            return err
+        }
+    }
+
+    if m.SendAt != "" && m.Delay != "" {
+        return errors.New(static.SEND_AT_AND_DELAY)
+    }
+
+    fields := []struct{ name, value string }{
+        {"phone", m.Phone},
+        {"jid", m.Jid},
+        {"send_at", m.SendAt},
+        {"delay", m.Delay},
+        {"attachment_url", m.AttachmentURL},
+        {"mimetype", m.Mimetype},
+        {"send_as", m.SendAs},
+    }
+    for _, f := range fields {
+        err = checkField(f.name, f.value)
+        if err != nil {
+            return err
+        }
+    }
 
-    ret := &bytes.Buffer{}
+    return nil
+}
 
-    b8buf := make([]byte, 4)
+// Checks the format of a field that can be wrong on its own, empty values are always fine
+func checkField(name string, value string) error {
+    if value == "" {
+        return nil
+    }
 
-    lb := len(b)
-    for i := 0; i < lb; i += 2 {
-        u16s[0] = uint16(b[i]) + (uint16(b[i+1]) << 8)
-        r := utf16.Decode(u16s)
-        n := utf8.EncodeRune(b8buf, r[0])
-        ret.Write(b8buf[:n])
+    switch name {
+    case "phone":
+        _, err := NormalizePhone(value)
+        return err
+    case "mention":
+        // Names are only known to be contacts when the message is sent
+        if strings.HasPrefix(value, "+") {
+            _, err := NormalizePhone(value)
+            return err
+        }
+    case "jid":
+        return ValidateJid(value)
+    case "send_at":
+        _, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            return fmt.Errorf("%s: %s", static.INVALID_SEND_AT, value)
+        }
+    case "delay":
+        delay, err := time.ParseDuration(value)
+        if err != nil || delay < 0 {
+            return fmt.Errorf("%s: %s", static.INVALID_DELAY, value)
+        }
+    case "attachment_url":
+        if !isWebURL(value) {
+            return fmt.Errorf("%s: %s", static.INVALID_MEDIA_URL, value)
+        }
+    case "link_url":
+        if !isWebURL(value) {
+            return fmt.Errorf("%s: %s", static.INVALID_LINK_URL, value)
+        }
+    case "kind":
+        if _, ok := kindFields[value]; !ok {
+            return fmt.Errorf("%s: %s", static.INVALID_KIND, value)
+        }
+    case "mimetype":
+        _, _, err := mime.ParseMediaType(value)
+        if err != nil || !strings.Contains(value, "/") {
+            return fmt.Errorf("%s: %s", static.INVALID_MIMETYPE, value)
+        }
+    case "send_as":
+        switch value {
+        case SendAsImage, SendAsVideo, SendAsAudio, SendAsVoice, SendAsGif, SendAsDocument, SendAsSticker:
+        default:
+            return fmt.Errorf("%s: %s", static.INVALID_SEND_AS, value)
+        }
     }
 
-    // Remove the Byte Order Mark (BOM). The BOM identifies that the text is UTF-8 encoded, but it should be removed before decoding
-    // For more info see here: https://stackoverflow.com/questions/31398044/got-error-invalid-character-%c3%af-looking-for-beginning-of-value-from-json-unmar#31399046
-    body := ret.Bytes()
-    body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+    return nil
+}
+
+// Returns whether value is an http or https URL with a host
+func isWebURL(value string) bool {
+    u, err := url.Parse(value)
+
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Returns the digits of an E.164 phone number, dropping the + and the usual separators
+func NormalizePhone(phone string) (string, error) {
+    digits := strings.Map(func(r rune) rune {
+        switch r {
+        case ' ', '-', '.', '(', ')':
+            return -1
+        }
+        return r
+    }, strings.TrimPrefix(strings.TrimSpace(phone), "+"))
+
+    // E.164 numbers have at most 15 digits, and no country has numbers this short
+    if len(digits) < 8 || len(digits) > 15 || strings.Trim(digits, "0123456789") != "" || digits[0] == '0' {
+        return "", fmt.Errorf("%s: %s", static.INVALID_PHONE, phone)
+    }
+
+    return digits, nil
+}
+
+// Checks that jid is a contact or group JID
+func ValidateJid(jid string) error {
+    user, server, found := strings.Cut(jid, "@")
+    if !found || user == "" || (server != UserServer && server != GroupServer) {
+        return fmt.Errorf("%s: %s", static.INVALID_JID, jid)
+    }
+
+    // Old group JIDs are made of the creator phone and a timestamp, like 5511999999999-1600000000
+    if strings.Trim(user, "0123456789-") != "" {
+        return fmt.Errorf("%s: %s", static.INVALID_JID, jid)
+    }
+
+    return nil
+}
+
+// Validates every message, telling which one is wrong
+func validate(messages []Message) error {
+    for i, m := range messages {
+        err := m.Validate()
+        if err != nil {
+            return fmt.Errorf("message %d: %w", i, err)
+        }
+    }
 
-    return body, nil
+    return nil
 }
@@ -0,0 +1,81 @@
+package parser
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestMessageSplit(t *testing.T) {
+    m := Message{
+        Recipient: "Ops",
+        Content:   "July report",
+        Attachments: []Attachment{
+            {Path: "/media/cover.png"},
+            {URL: "https://example.com/chart.png"},
+            {Data: "JVBERi0xLjQK"},
+        },
+        CaptionIndex: 1,
+        ReplyTo:      7,
+        Mentions:     []string{"Alice"},
+    }
+
+    // The reply and mentions go with the caption
+    expected := []Message{
+        {Recipient: "Ops", AttachmentPath: "/media/cover.png"},
+        {
+            Recipient:     "Ops",
+            Content:       "July report",
+            AttachmentURL: "https://example.com/chart.png",
+            ReplyTo:       7,
+            Mentions:      []string{"Alice"},
+        },
+        {Recipient: "Ops", Attachment: "JVBERi0xLjQK"},
+    }
+    if parts := m.Split(); !reflect.DeepEqual(parts, expected) {
+        t.Errorf("expected %+v, got %+v", expected, parts)
+    }
+
+    single := Message{Recipient: "Ops", Content: "hi", AttachmentURL: "https://example.com/chart.png"}
+    if parts := single.Split(); !reflect.DeepEqual(parts, []Message{single}) {
+        t.Errorf("expected the message itself, got %+v", parts)
+    }
+}
+
+func TestMessageValidateAttachments(t *testing.T) {
+    tests := []struct {
+        name  string
+        m     Message
+        valid bool
+    }{
+        {name: "attachment only", m: Message{Recipient: "Ops", AttachmentPath: "a.png"}, valid: true},
+        {
+            name:  "attachments list",
+            m:     Message{Recipient: "Ops", Attachments: []Attachment{{Path: "a.png"}, {Part: "b"}}, CaptionIndex: 1},
+            valid: true,
+        },
+        {name: "two sources", m: Message{Recipient: "Ops", Attachment: "aGk=", AttachmentPath: "a.png"}},
+        {
+            name: "source and list",
+            m:    Message{Recipient: "Ops", AttachmentPath: "a.png", Attachments: []Attachment{{Path: "b.png"}}},
+        },
+        {name: "empty attachment", m: Message{Recipient: "Ops", Attachments: []Attachment{{}}}},
+        {
+            name: "attachment with two sources",
+            m:    Message{Recipient: "Ops", Attachments: []Attachment{{Path: "a", URL: "https://x.io/a"}}},
+        },
+        {name: "invalid url", m: Message{Recipient: "Ops", Attachments: []Attachment{{URL: "ftp://x.io/a"}}}},
+        {name: "invalid attachment_url", m: Message{Recipient: "Ops", AttachmentURL: "file:///etc/passwd"}},
+        {
+            name: "caption index out of range",
+            m:    Message{Recipient: "Ops", Attachments: []Attachment{{Path: "a"}}, CaptionIndex: 1},
+        },
+        {name: "caption index without list", m: Message{Recipient: "Ops", Content: "hi", CaptionIndex: 1}},
+    }
+
+    for _, tt := range tests {
+        err := tt.m.Validate()
+        if (err == nil) != tt.valid {
+            t.Errorf("%s: expected valid to be %v, got %v", tt.name, tt.valid, err)
+        }
+    }
+}
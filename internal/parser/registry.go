@@ -0,0 +1,138 @@
+package parser
+
+import (
+    "fmt"
+    "mime"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "github.com/watchzap/internal/static"
+)
+
+// Parser turns a file or request body of one format into messages
+type Parser struct {
+    // Short name of the format, like json
+    Name string
+    // File extensions of the format with their dot, like .json
+    Extensions []string
+    // Media types of the format, like application/json
+    MimeTypes []string
+    // Parses and validates the messages of body, which is always UTF-8
+    Parse func(body []byte) ([]Message, error)
+}
+
+// Converts body to UTF-8 and parses it, charset is an optional hint of its encoding
+// Every format goes through here, so they all understand the same encodings
+func (p Parser) Read(body []byte, charset string) ([]Message, error) {
+    decoded, err := Decode(body, charset)
+    if err != nil {
+        return nil, err
+    }
+
+    return p.Parse(decoded)
+}
+
+// Registry finds the parser of a file by its extension or of a request by its Content-Type
+type Registry struct {
+    mu      sync.RWMutex
+    parsers []Parser
+    byExt   map[string]Parser
+    byMime  map[string]Parser
+}
+
+// The registry used by watchzap, the built-in formats register themselves in it
+var Default = NewRegistry()
+
+// Creates an empty registry
+func NewRegistry() *Registry {
+    return &Registry{
+        byExt:  map[string]Parser{},
+        byMime: map[string]Parser{},
+    }
+}
+
+// Adds p to the default registry, meant to be called from init
+func Register(p Parser) {
+    Default.Register(p)
+}
+
+// Adds p to the registry
+// Like database/sql drivers, registering a name, extension or media type twice is a programming error and panics
+func (r *Registry) Register(p Parser) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if p.Name == "" || p.Parse == nil {
+        panic("parser: Register needs a name and a Parse function")
+    }
+    for _, registered := range r.parsers {
+        if registered.Name == p.Name {
+            panic("parser: Register called twice for " + p.Name)
+        }
+    }
+
+    for _, ext := range p.Extensions {
+        ext = strings.ToLower(ext)
+        if _, ok := r.byExt[ext]; ok {
+            panic("parser: extension " + ext + " registered twice")
+        }
+        r.byExt[ext] = p
+    }
+    for _, mimeType := range p.MimeTypes {
+        mimeType = strings.ToLower(mimeType)
+        if _, ok := r.byMime[mimeType]; ok {
+            panic("parser: media type " + mimeType + " registered twice")
+        }
+        r.byMime[mimeType] = p
+    }
+
+    r.parsers = append(r.parsers, p)
+}
+
+// Returns the registered parsers in the order they were registered
+func (r *Registry) Parsers() []Parser {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    return append([]Parser(nil), r.parsers...)
+}
+
+// Returns the parser of the file at path, by its extension
+func (r *Registry) ForFile(path string) (Parser, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    ext := strings.ToLower(filepath.Ext(path))
+    p, ok := r.byExt[ext]
+    if !ok {
+        return Parser{}, fmt.Errorf("%s: %s", static.NO_PARSER_FOUND, filepath.Base(path))
+    }
+
+    return p, nil
+}
+
+// Returns the parser of a Content-Type header, its parameters like charset are ignored
+// Structured syntax suffixes are understood too, so application/vnd.acme+json is parsed as json
+func (r *Registry) ForContentType(contentType string) (Parser, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        return Parser{}, fmt.Errorf("%s: %q", static.NO_PARSER_FOUND, contentType)
+    }
+
+    if p, ok := r.byMime[mediaType]; ok {
+        return p, nil
+    }
+    if _, suffix, found := strings.Cut(mediaType, "+"); found {
+        for _, p := range r.parsers {
+            if p.Name == suffix {
+                return p, nil
+            }
+        }
+    }
+
+    return Parser{}, fmt.Errorf("%s: %s", static.NO_PARSER_FOUND, mediaType)
+}
@@ -0,0 +1,91 @@
+package parser
+
+import (
+    "testing"
+)
+
+func TestDefaultRegistry(t *testing.T) {
+    contentTypes := []struct {
+        contentType string
+        expected    string
+    }{
+        {contentType: "application/json", expected: "json"},
+        {contentType: "application/json; charset=utf-8", expected: "json"},
+        {contentType: "Application/JSON ; charset=UTF-16LE", expected: "json"},
+        {contentType: "application/vnd.acme.messages+json", expected: "json"},
+        {contentType: "text/yaml", expected: "yaml"},
+        {contentType: "application/x-yaml", expected: "yaml"},
+        {contentType: "text/csv; charset=utf-8; header=present", expected: "csv"},
+        {contentType: "text/plain"},
+        {contentType: "application/notjson"},
+        {contentType: ""},
+        {contentType: "json;;"},
+    }
+    for _, tt := range contentTypes {
+        p, err := Default.ForContentType(tt.contentType)
+        if tt.expected == "" {
+            if err == nil {
+                t.Errorf("%q: expected no parser, got %s", tt.contentType, p.Name)
+            }
+            continue
+        }
+        if err != nil || p.Name != tt.expected {
+            t.Errorf("%q: expected %s, got %q: %v", tt.contentType, tt.expected, p.Name, err)
+        }
+    }
+
+    files := []struct {
+        path     string
+        expected string
+    }{
+        {path: "messages/batch.json", expected: "json"},
+        {path: "batch.YML", expected: "yaml"},
+        {path: "export.csv", expected: "csv"},
+        {path: "notes.txt"},
+        {path: "json"},
+    }
+    for _, tt := range files {
+        p, err := Default.ForFile(tt.path)
+        if tt.expected == "" {
+            if err == nil {
+                t.Errorf("%q: expected no parser, got %s", tt.path, p.Name)
+            }
+            continue
+        }
+        if err != nil || p.Name != tt.expected {
+            t.Errorf("%q: expected %s, got %q: %v", tt.path, tt.expected, p.Name, err)
+        }
+    }
+}
+
+func TestRegistryRegister(t *testing.T) {
+    r := NewRegistry()
+    r.Register(Parser{
+        Name:       "lines",
+        Extensions: []string{".TXT"},
+        MimeTypes:  []string{"text/plain"},
+        Parse: func(body []byte) ([]Message, error) {
+            return []Message{{Recipient: "Alice", Content: string(body)}}, nil
+        },
+    })
+
+    p, err := r.ForFile("notes.txt")
+    if err != nil || p.Name != "lines" {
+        t.Fatalf("expected the lines parser, got %q: %v", p.Name, err)
+    }
+    messages, err := p.Parse([]byte("hi"))
+    if err != nil || len(messages) != 1 || messages[0].Content != "hi" {
+        t.Errorf("expected the registered Parse to be used, got %+v: %v", messages, err)
+    }
+
+    defer func() {
+        if recover() == nil {
+            t.Error("expected registering the same extension twice to panic")
+        }
+    }()
+    r.Register(Parser{
+        Name:       "other",
+        Extensions: []string{".txt"},
+        Parse:      p.Parse,
+    })
+}
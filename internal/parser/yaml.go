@@ -1,13 +1,20 @@
 package parser
 
 import (
-    "errors"
-
     "github.com/rs/zerolog/log"
     "gopkg.in/yaml.v3"
 )
 
-func YamlParser(body []byte) (*[]Message, error) {
+func init() {
+    Register(Parser{
+        Name:       "yaml",
+        Extensions: []string{".yaml", ".yml"},
+        MimeTypes:  []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+        Parse:      YamlParser,
+    })
+}
+
+func YamlParser(body []byte) ([]Message, error) {
     var messages []Message
 
     err := yaml.Unmarshal(body, &messages)
@@ -18,15 +25,14 @@ func YamlParser(body []byte) (*[]Message, error) {
         return nil, err
     }
 
-    for i, m := range messages {
-        if m.Recipient == "" || m.Content == "" {
-            log.Warn().
-                Str("parser", "yaml").
-                Int("index", i).
-                Msg("WZ: Recipient or Content fields are empty")
-            return nil, errors.New("empty field")
-        }
+    err = validate(messages)
+    if err != nil {
+        log.Warn().
+            Err(err).
+            Str("parser", "yaml").
+            Msg("WZ: Invalid message")
+        return nil, err
     }
 
-    return &messages, nil
+    return messages, nil
 }
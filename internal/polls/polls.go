@@ -0,0 +1,153 @@
+package polls
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+
+    "github.com/watchzap/internal/parser"
+)
+
+// Store keeps the votes on the polls watchzap sent, by the ID of the poll in the outbox
+// Each voter has a single row holding their latest vote, since changing a vote sends the whole new choice
+type Store struct {
+    db *sql.DB
+}
+
+// The options a voter picked, none when they took their vote back
+type Vote struct {
+    Voter   string    `json:"voter"`
+    Options []string  `json:"options"`
+    At      time.Time `json:"at"`
+}
+
+// How many voters picked an option, and who
+type OptionResult struct {
+    Name   string   `json:"name"`
+    Votes  int      `json:"votes"`
+    Voters []string `json:"voters"`
+}
+
+// The tally of a poll
+type Results struct {
+    Question        string         `json:"question"`
+    SelectableCount int            `json:"selectable_count"`
+    Options         []OptionResult `json:"options"`
+    // Voters with at least one option picked
+    Voters int `json:"voters"`
+}
+
+// Creates a store on top of db, which must already be migrated
+func New(db *sql.DB) *Store {
+    return &Store{db: db}
+}
+
+// Records the vote of voter on the poll, replacing the one they cast before
+// Updates may arrive out of order, so an older vote never replaces a newer one
+func (s *Store) Record(pollID int64, vote Vote) error {
+    if vote.Options == nil {
+        vote.Options = []string{}
+    }
+    options, err := json.Marshal(vote.Options)
+    if err != nil {
+        return err
+    }
+
+    _, err = s.db.Exec(
+        `INSERT INTO watchzap_poll_votes (message_id, voter, options, voted_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (message_id, voter) DO UPDATE SET options = excluded.options, voted_at = excluded.voted_at
+        WHERE excluded.voted_at >= watchzap_poll_votes.voted_at`,
+        pollID,
+        vote.Voter,
+        string(options),
+        vote.At.UnixMilli(),
+    )
+
+    return err
+}
+
+// Returns the latest vote of everyone who voted on the poll, taken back ones included, oldest first
+func (s *Store) Votes(pollID int64) ([]Vote, error) {
+    rows, err := s.db.Query(
+        "SELECT voter, options, voted_at FROM watchzap_poll_votes WHERE message_id = ? ORDER BY voted_at, voter",
+        pollID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    votes := []Vote{}
+    for rows.Next() {
+        var vote Vote
+        var options string
+        var at int64
+
+        err := rows.Scan(&vote.Voter, &options, &at)
+        if err != nil {
+            return nil, err
+        }
+        err = json.Unmarshal([]byte(options), &vote.Options)
+        if err != nil {
+            return nil, err
+        }
+
+        vote.At = time.UnixMilli(at)
+        votes = append(votes, vote)
+    }
+
+    return votes, rows.Err()
+}
+
+// Returns the options of the poll matching the hashes a vote carries, in the order of the poll
+// WhatsApp votes name the options by the SHA-256 of their text, hashes of no option are dropped
+func OptionNames(poll parser.Poll, selected [][]byte) []string {
+    hashes := whatsmeow.HashPollOptions(poll.Options)
+
+    names := []string{}
+    for i, hash := range hashes {
+        for _, s := range selected {
+            if bytes.Equal(hash, s) {
+                names = append(names, poll.Options[i])
+                break
+            }
+        }
+    }
+
+    return names
+}
+
+// Counts the votes of every option of the poll
+func Tally(poll parser.Poll, votes []Vote) Results {
+    results := Results{
+        Question:        poll.Question,
+        SelectableCount: poll.SelectableCount,
+        Options:         make([]OptionResult, len(poll.Options)),
+    }
+    index := map[string]int{}
+    for i, option := range poll.Options {
+        results.Options[i] = OptionResult{Name: option, Voters: []string{}}
+        index[option] = i
+    }
+
+    for _, vote := range votes {
+        if len(vote.Options) == 0 {
+            continue
+        }
+
+        results.Voters++
+        for _, option := range vote.Options {
+            i, ok := index[option]
+            if !ok {
+                continue
+            }
+            results.Options[i].Votes++
+            results.Options[i].Voters = append(results.Options[i].Voters, vote.Voter)
+        }
+    }
+
+    return results
+}
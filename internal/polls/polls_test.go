@@ -0,0 +1,102 @@
+package polls
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/queue"
+)
+
+var lunch = parser.Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi", "Salad"}, SelectableCount: 2}
+
+// Creates a store and the outbox row of a poll the votes can point to
+func newStore(t *testing.T) (*Store, int64) {
+    t.Helper()
+
+    db, err := database.Open("file:" + filepath.Join(t.TempDir(), "zap.db") + "?_foreign_keys=on")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+
+    outbox, err := queue.New(db, 1, time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, err := outbox.Enqueue(parser.Message{Recipient: "Ops", Kind: parser.KindPoll, Poll: &lunch})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return New(db), id
+}
+
+func TestStoreKeepsLatestVote(t *testing.T) {
+    store, id := newStore(t)
+    start := time.UnixMilli(1_720_000_000_000)
+
+    votes := []Vote{
+        {Voter: "alice@s.whatsapp.net", Options: []string{"Pizza"}, At: start},
+        {Voter: "bob@s.whatsapp.net", Options: []string{"Sushi", "Salad"}, At: start.Add(time.Second)},
+        // Alice changes her mind, then an older update arrives late and must not undo it
+        {Voter: "alice@s.whatsapp.net", Options: []string{"Salad"}, At: start.Add(3 * time.Second)},
+        {Voter: "alice@s.whatsapp.net", Options: []string{"Sushi"}, At: start.Add(2 * time.Second)},
+        // Bob takes his vote back
+        {Voter: "bob@s.whatsapp.net", Options: nil, At: start.Add(4 * time.Second)},
+    }
+    for _, vote := range votes {
+        err := store.Record(id, vote)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    got, err := store.Votes(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := []Vote{
+        {Voter: "alice@s.whatsapp.net", Options: []string{"Salad"}, At: start.Add(3 * time.Second)},
+        {Voter: "bob@s.whatsapp.net", Options: []string{}, At: start.Add(4 * time.Second)},
+    }
+    if !reflect.DeepEqual(got, expected) {
+        t.Errorf("expected %+v, got %+v", expected, got)
+    }
+}
+
+func TestOptionNames(t *testing.T) {
+    selected := whatsmeow.HashPollOptions([]string{"Salad", "Burger", "Pizza"})
+
+    names := OptionNames(lunch, selected)
+    if !reflect.DeepEqual(names, []string{"Pizza", "Salad"}) {
+        t.Errorf("expected the known options in poll order, got %v", names)
+    }
+}
+
+func TestTally(t *testing.T) {
+    votes := []Vote{
+        {Voter: "alice", Options: []string{"Pizza", "Salad"}},
+        {Voter: "bob", Options: []string{"Pizza"}},
+        {Voter: "carol", Options: []string{}},
+    }
+
+    expected := Results{
+        Question:        "Lunch?",
+        SelectableCount: 2,
+        Options: []OptionResult{
+            {Name: "Pizza", Votes: 2, Voters: []string{"alice", "bob"}},
+            {Name: "Sushi", Votes: 0, Voters: []string{}},
+            {Name: "Salad", Votes: 1, Voters: []string{"alice"}},
+        },
+        Voters: 2,
+    }
+    if got := Tally(lunch, votes); !reflect.DeepEqual(got, expected) {
+        t.Errorf("expected %+v, got %+v", expected, got)
+    }
+}
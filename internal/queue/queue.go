@@ -0,0 +1,814 @@
+package queue
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// Status of a queued message
+// A message moves forward through queued, sending, sent, delivered, read and played, or ends up failed
+// Messages meant for later start scheduled and can be cancelled until they are due
+const (
+    StatusScheduled = "scheduled"
+    StatusCancelled = "cancelled"
+    StatusQueued    = "queued"
+    StatusSending   = "sending"
+    StatusSent      = "sent"
+    StatusDelivered = "delivered"
+    StatusRead      = "read"
+    StatusPlayed    = "played"
+    StatusFailed    = "failed"
+)
+
+// Order of the statuses reported by receipts, a receipt never moves a message backwards
+var receiptRank = map[string]int{
+    StatusSent:      1,
+    StatusDelivered: 2,
+    StatusRead:      3,
+    StatusPlayed:    4,
+}
+
+// Columns read by scanItem
+const itemColumns = `id, message, status, attempts, last_error, next_attempt_at, created_at, updated_at,
+    whatsapp_id, chat, after_id`
+
+// Items following another one are held back until it is done, see EnqueueAfter
+const ready = `(after_id = 0 OR NOT EXISTS (SELECT 1 FROM watchzap_outbox AS prev
+    WHERE prev.id = watchzap_outbox.after_id AND prev.status IN ('` +
+    StatusScheduled + "', '" + StatusQueued + "', '" + StatusSending + "')))"
+
+// Longest wait between two attempts of the same message
+const maxBackoff = 10 * time.Minute
+
+// Longest the worker sleeps before looking at the queue again when nothing wakes it up
+const idleWait = time.Minute
+
+// A message stored in the queue
+type Item struct {
+    ID          int64          `json:"id"`
+    Message     parser.Message `json:"-"`
+    Status      string         `json:"status"`
+    Attempts    int            `json:"attempts"`
+    LastError   string         `json:"last_error,omitempty"`
+    NextAttempt time.Time      `json:"next_attempt_at"`
+    CreatedAt   time.Time      `json:"created_at"`
+    UpdatedAt   time.Time      `json:"updated_at"`
+    WhatsappID  string         `json:"whatsapp_id,omitempty"`
+    Chat        string         `json:"chat,omitempty"`
+    // Item that has to be done before this one is sent
+    After       int64          `json:"after,omitempty"`
+}
+
+// A status change of an item
+type Event struct {
+    Status string    `json:"status"`
+    Error  string    `json:"error,omitempty"`
+    At     time.Time `json:"at"`
+}
+
+// A status change of an item along with the item, as read from the history of every item by Changes
+type Change struct {
+    // Position of the change in the history, later changes have higher ones
+    Seq int64
+    Event
+    Item Item
+}
+
+// What WhatsApp answered when a message was sent
+type Sent struct {
+    WhatsappID string
+    Chat       string
+}
+
+// Reports whether the item was sent, failed or cancelled, receipts may still move a sent item forward
+func (i Item) Done() bool {
+    return i.Status == StatusFailed || i.Status == StatusCancelled || receiptRank[i.Status] > 0
+}
+
+// Queue is the durable outbox of watchzap
+// Every message is stored in SQLite before being sent, so nothing is lost if the process stops,
+// and a single worker drains it retrying failures with exponential backoff
+type Queue struct {
+    db          *sql.DB
+    maxAttempts int
+    backoff     time.Duration
+    wake        chan struct{}
+
+    mu   sync.Mutex
+    subs map[chan Item]struct{}
+}
+
+// Returned by Cancel for items that are not scheduled
+var ErrNotScheduled = errors.New(static.NOT_SCHEDULED)
+
+// Wrapped by the errors of items whose message can't be decoded, like after a manual edit of the database
+// The rest of the item is still read, so it can be failed instead of blocking the queue
+var ErrUnreadable = errors.New(static.UNREADABLE_MESSAGE)
+
+// Wraps an error that retrying won't fix, the message fails without further attempts
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string {
+    return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+    return e.err
+}
+
+// Marks err as not worth retrying
+func Permanent(err error) error {
+    return permanentError{err: err}
+}
+
+// Creates a queue on top of db, which must already be migrated
+func New(db *sql.DB, maxAttempts int, backoff time.Duration) (*Queue, error) {
+    if maxAttempts < 1 {
+        maxAttempts = 1
+    }
+
+    return &Queue{
+        db:          db,
+        maxAttempts: maxAttempts,
+        backoff:     backoff,
+        wake:        make(chan struct{}, 1),
+        subs:        map[chan Item]struct{}{},
+    }, nil
+}
+
+// Stores m to be sent as soon as possible, or when it is due if it is scheduled, and returns its ID
+func (q *Queue) Enqueue(m parser.Message) (int64, error) {
+    return q.EnqueueAfter(m, 0)
+}
+
+// Stores m like Enqueue, but holds it back until the item after is sent, failed or cancelled
+// Chaining the attachments of a message this way keeps them in order even when one of them is retried
+func (q *Queue) EnqueueAfter(m parser.Message, after int64) (int64, error) {
+    body, err := json.Marshal(m)
+    if err != nil {
+        return 0, err
+    }
+
+    now := time.Now().UnixMilli()
+    status, due := StatusQueued, now
+    if dueAt := m.DueAt(time.UnixMilli(now)); dueAt.UnixMilli() > now {
+        status, due = StatusScheduled, dueAt.UnixMilli()
+    }
+
+    res, err := q.db.Exec(
+        `INSERT INTO watchzap_outbox (message, status, next_attempt_at, created_at, updated_at, after_id)
+        VALUES (?, ?, ?, ?, ?, ?)`,
+        string(body),
+        status,
+        due,
+        now,
+        now,
+        after,
+    )
+    if err != nil {
+        return 0, err
+    }
+
+    id, err := res.LastInsertId()
+    if err != nil {
+        return 0, err
+    }
+
+    err = q.record(id, status, "", time.UnixMilli(now))
+    if err != nil {
+        return 0, err
+    }
+
+    q.notify()
+
+    return id, nil
+}
+
+// Returns the scheduled items that are not due yet, the next one first
+func (q *Queue) Scheduled() ([]Item, error) {
+    rows, err := q.db.Query(
+        "SELECT "+itemColumns+" FROM watchzap_outbox WHERE status = ? ORDER BY next_attempt_at, id",
+        StatusScheduled,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    items := []Item{}
+    for rows.Next() {
+        item, err := scanItem(rows)
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+
+    return items, rows.Err()
+}
+
+// Returns the items that are not done yet, the oldest first
+// Items whose message can't be read are left out, they fail as soon as the worker gets to them
+func (q *Queue) Pending() ([]Item, error) {
+    rows, err := q.db.Query(
+        "SELECT "+itemColumns+" FROM watchzap_outbox WHERE status IN (?, ?, ?) ORDER BY id",
+        StatusScheduled,
+        StatusQueued,
+        StatusSending,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    items := []Item{}
+    for rows.Next() {
+        item, err := scanItem(rows)
+        if errors.Is(err, ErrUnreadable) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+
+    return items, rows.Err()
+}
+
+// Cancels a scheduled item so it is never sent and returns it
+// Items that are already due or were never scheduled can't be cancelled
+func (q *Queue) Cancel(id int64) (Item, error) {
+    item, err := q.Get(id)
+    if err != nil {
+        return Item{}, err
+    }
+
+    // Conditional, so it is safe against the worker claiming the item at the same time, even from another process
+    now := time.Now()
+    res, err := q.db.Exec(
+        "UPDATE watchzap_outbox SET status = ?, updated_at = ? WHERE id = ? AND status = ?",
+        StatusCancelled,
+        now.UnixMilli(),
+        id,
+        StatusScheduled,
+    )
+    if err != nil {
+        return Item{}, err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return Item{}, fmt.Errorf("%w: %d is %s", ErrNotScheduled, id, item.Status)
+    }
+
+    item.Status = StatusCancelled
+    item.UpdatedAt = now
+    err = q.record(id, item.Status, "", now)
+    if err != nil {
+        return Item{}, err
+    }
+    q.publish(item)
+
+    return item, nil
+}
+
+// Returns the item with the given ID
+func (q *Queue) Get(id int64) (Item, error) {
+    row := q.db.QueryRow("SELECT "+itemColumns+" FROM watchzap_outbox WHERE id = ?", id)
+
+    item, err := scanItem(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Item{}, errors.New(static.MESSAGE_NOT_FOUND)
+    }
+
+    return item, err
+}
+
+// Returns the item WhatsApp knows by whatsappID, the ID it gave the message when it was sent
+func (q *Queue) GetByWhatsappID(whatsappID string) (Item, error) {
+    if whatsappID == "" {
+        return Item{}, errors.New(static.MESSAGE_NOT_FOUND)
+    }
+
+    row := q.db.QueryRow(
+        "SELECT "+itemColumns+" FROM watchzap_outbox WHERE whatsapp_id = ? ORDER BY id DESC LIMIT 1",
+        whatsappID,
+    )
+
+    item, err := scanItem(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return Item{}, errors.New(static.MESSAGE_NOT_FOUND)
+    }
+
+    return item, err
+}
+
+// Returns the status changes of the item with the given ID, oldest first
+func (q *Queue) History(id int64) ([]Event, error) {
+    rows, err := q.db.Query(
+        "SELECT status, error, at FROM watchzap_outbox_history WHERE message_id = ? ORDER BY id",
+        id,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var history []Event
+    for rows.Next() {
+        var event Event
+        var at int64
+
+        err := rows.Scan(&event.Status, &event.Error, &at)
+        if err != nil {
+            return nil, err
+        }
+
+        event.At = time.UnixMilli(at)
+        history = append(history, event)
+    }
+
+    return history, rows.Err()
+}
+
+// Returns up to limit status changes of any item made after the change at seq, oldest first
+// Unlike Subscribe it never misses a change, so it suits readers that may fall behind
+func (q *Queue) Changes(seq int64, limit int) ([]Change, error) {
+    rows, err := q.db.Query(
+        "SELECT id, message_id, status, error, at FROM watchzap_outbox_history WHERE id > ? ORDER BY id LIMIT ?",
+        seq,
+        limit,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var changes []Change
+    for rows.Next() {
+        var change Change
+        var at int64
+
+        err := rows.Scan(&change.Seq, &change.Item.ID, &change.Status, &change.Error, &at)
+        if err != nil {
+            return nil, err
+        }
+
+        change.At = time.UnixMilli(at)
+        changes = append(changes, change)
+    }
+    err = rows.Err()
+    if err != nil {
+        return nil, err
+    }
+
+    // Loaded once the rows are closed, SQLite may only have one connection
+    rows.Close()
+    for i := range changes {
+        // A change of an item that can't be read is still a change, with what could be read of the item
+        changes[i].Item, err = q.Get(changes[i].Item.ID)
+        if err != nil && !errors.Is(err, ErrUnreadable) {
+            return nil, err
+        }
+    }
+
+    return changes, nil
+}
+
+// Returns the position in the history the reader called name got to, see Changes
+// A new reader starts at the latest change, so it only gets the changes made from then on
+func (q *Queue) Cursor(name string) (int64, error) {
+    var seq int64
+    err := q.db.QueryRow("SELECT history_id FROM watchzap_history_cursors WHERE name = ?", name).Scan(&seq)
+    if !errors.Is(err, sql.ErrNoRows) {
+        return seq, err
+    }
+
+    err = q.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM watchzap_outbox_history").Scan(&seq)
+    if err != nil {
+        return 0, err
+    }
+
+    return seq, q.SetCursor(name, seq)
+}
+
+// Stores how far the reader called name got in the history
+func (q *Queue) SetCursor(name string, seq int64) error {
+    _, err := q.db.Exec(
+        `INSERT INTO watchzap_history_cursors (name, history_id) VALUES (?, ?)
+        ON CONFLICT (name) DO UPDATE SET history_id = excluded.history_id`,
+        name,
+        seq,
+    )
+
+    return err
+}
+
+// Moves the sent messages with the given WhatsApp IDs to status, as reported by a receipt
+// Messages already further along are left alone, receipts may arrive out of order
+func (q *Queue) MarkReceipt(whatsappIDs []string, status string, at time.Time) error {
+    for _, waID := range whatsappIDs {
+        if waID == "" {
+            continue
+        }
+
+        rows, err := q.db.Query("SELECT "+itemColumns+" FROM watchzap_outbox WHERE whatsapp_id = ?", waID)
+        if err != nil {
+            return err
+        }
+
+        var items []Item
+        for rows.Next() {
+            item, err := scanItem(rows)
+            if err != nil {
+                rows.Close()
+                return err
+            }
+            items = append(items, item)
+        }
+        rows.Close()
+
+        for _, item := range items {
+            if receiptRank[item.Status] == 0 || receiptRank[item.Status] >= receiptRank[status] {
+                continue
+            }
+
+            item.Status = status
+            item.UpdatedAt = at
+            err := q.update(item)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+// Drains the queue until ctx is done, handing each due message to send
+func (q *Queue) Run(ctx context.Context, send func(parser.Message) (Sent, error)) {
+    err := q.recover()
+    if err != nil {
+        log.Error().Err(err).Str("function", "queue").Msg("WZ: Failed recovering interrupted messages")
+    }
+
+    for {
+        item, err := q.next()
+        if err != nil && !errors.Is(err, sql.ErrNoRows) {
+            log.Error().Err(err).Str("function", "queue").Msg("WZ: Failed reading the queue")
+        }
+
+        if err != nil {
+            select {
+            case <-ctx.Done():
+                return
+            case <-q.wake:
+            case <-time.After(q.untilNextDue()):
+            }
+            continue
+        }
+
+        sent, err := send(item.Message)
+        item.WhatsappID = sent.WhatsappID
+        item.Chat = sent.Chat
+        q.finish(item, err)
+    }
+}
+
+// Waits until every item in ids is done or ctx ends, then returns them in the same order
+// Scheduled items are returned as they are, they may only be due days later,
+// and so are the items following one, since they are held back until it is sent
+func (q *Queue) Wait(ctx context.Context, ids []int64) ([]Item, error) {
+    updates, unsubscribe := q.Subscribe()
+    defer unsubscribe()
+
+    items := make([]Item, len(ids))
+    pending := map[int64]int{}
+    for i, id := range ids {
+        item, err := q.Get(id)
+        if err != nil {
+            return nil, err
+        }
+
+        items[i] = item
+        if item.Done() || item.Status == StatusScheduled {
+            continue
+        }
+        scheduled, err := q.heldBack(item)
+        if err != nil {
+            return nil, err
+        }
+        if !scheduled {
+            pending[id] = i
+        }
+    }
+
+    // Updates may be dropped for slow subscribers, so check the database every now and then as well
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for len(pending) > 0 {
+        select {
+        case <-ctx.Done():
+            return items, ctx.Err()
+        case <-ticker.C:
+            for id, i := range pending {
+                item, err := q.Get(id)
+                if err != nil {
+                    return items, err
+                }
+
+                items[i] = item
+                if item.Done() {
+                    delete(pending, id)
+                }
+            }
+        case item := <-updates:
+            i, ok := pending[item.ID]
+            if !ok {
+                continue
+            }
+
+            items[i] = item
+            if item.Done() {
+                delete(pending, item.ID)
+            }
+        }
+    }
+
+    return items, nil
+}
+
+// Returns whether item follows a scheduled item, directly or through the items it follows
+func (q *Queue) heldBack(item Item) (bool, error) {
+    seen := map[int64]bool{item.ID: true}
+    for id := item.After; id != 0 && !seen[id]; {
+        seen[id] = true
+
+        var prev Item
+        err := q.db.QueryRow("SELECT status, after_id FROM watchzap_outbox WHERE id = ?", id).
+            Scan(&prev.Status, &prev.After)
+        // Items following one that doesn't exist are sent right away, see ready
+        if errors.Is(err, sql.ErrNoRows) {
+            return false, nil
+        }
+        if err != nil {
+            return false, err
+        }
+        if prev.Status == StatusScheduled {
+            return true, nil
+        }
+        if prev.Done() {
+            return false, nil
+        }
+        id = prev.After
+    }
+
+    return false, nil
+}
+
+// Returns a channel receiving every item whose status changes and a function to stop receiving
+func (q *Queue) Subscribe() (<-chan Item, func()) {
+    ch := make(chan Item, 64)
+
+    q.mu.Lock()
+    q.subs[ch] = struct{}{}
+    q.mu.Unlock()
+
+    return ch, func() {
+        q.mu.Lock()
+        delete(q.subs, ch)
+        q.mu.Unlock()
+    }
+}
+
+// Queues again the messages left sending by a previous run
+// They may have been sent right before it stopped, but delivering twice is better than not delivering at all
+func (q *Queue) recover() error {
+    _, err := q.db.Exec(
+        "UPDATE watchzap_outbox SET status = ?, updated_at = ? WHERE status = ?",
+        StatusQueued,
+        time.Now().UnixMilli(),
+        StatusSending,
+    )
+
+    return err
+}
+
+// Claims the oldest due message, queued or scheduled, returns sql.ErrNoRows when there is none
+func (q *Queue) next() (Item, error) {
+    row := q.db.QueryRow(
+        "SELECT "+itemColumns+` FROM watchzap_outbox WHERE status IN (?, ?) AND next_attempt_at <= ? AND `+ready+`
+        ORDER BY next_attempt_at, id LIMIT 1`,
+        StatusQueued,
+        StatusScheduled,
+        time.Now().UnixMilli(),
+    )
+
+    item, err := scanItem(row)
+    if errors.Is(err, ErrUnreadable) {
+        // Left as it is, it would be first in line forever
+        log.Error().Err(err).Int64("id", item.ID).Msg("WZ: Failing queued message that can't be read")
+        item.Status = StatusFailed
+        item.LastError = err.Error()
+        item.UpdatedAt = time.Now()
+        err = q.update(item)
+        if err != nil {
+            return Item{}, err
+        }
+        return q.next()
+    }
+    if err != nil {
+        return Item{}, err
+    }
+
+    // A scheduled item may have been cancelled since it was read
+    res, err := q.db.Exec(
+        "UPDATE watchzap_outbox SET status = ? WHERE id = ? AND status = ?",
+        StatusSending,
+        item.ID,
+        item.Status,
+    )
+    if err != nil {
+        return Item{}, err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return q.next()
+    }
+
+    item.Status = StatusSending
+    item.UpdatedAt = time.Now()
+    err = q.update(item)
+
+    return item, err
+}
+
+// Records the result of sending item
+func (q *Queue) finish(item Item, sendErr error) {
+    item.Attempts++
+    item.UpdatedAt = time.Now()
+
+    var permanent permanentError
+    switch {
+    case sendErr == nil:
+        item.Status = StatusSent
+        item.LastError = ""
+    case errors.As(sendErr, &permanent) || item.Attempts >= q.maxAttempts:
+        item.Status = StatusFailed
+        item.LastError = sendErr.Error()
+    default:
+        item.Status = StatusQueued
+        item.LastError = sendErr.Error()
+        item.NextAttempt = item.UpdatedAt.Add(q.backoffFor(item.Attempts))
+    }
+
+    if sendErr != nil {
+        log.Warn().
+            Err(sendErr).
+            Int64("id", item.ID).
+            Int("attempts", item.Attempts).
+            Str("status", item.Status).
+            Msg("WZ: Failed sending queued message")
+    }
+
+    err := q.update(item)
+    if err != nil {
+        log.Error().Err(err).Int64("id", item.ID).Msg("WZ: Failed updating queued message")
+    }
+}
+
+// Waits twice as long after every failed attempt, up to maxBackoff
+func (q *Queue) backoffFor(attempts int) time.Duration {
+    d := q.backoff
+    for i := 1; i < attempts && d < maxBackoff; i++ {
+        d *= 2
+    }
+
+    return min(d, maxBackoff)
+}
+
+// Returns how long until the next queued or scheduled message is due
+func (q *Queue) untilNextDue() time.Duration {
+    var next sql.NullInt64
+    err := q.db.QueryRow(
+        "SELECT MIN(next_attempt_at) FROM watchzap_outbox WHERE status IN (?, ?) AND "+ready,
+        StatusQueued,
+        StatusScheduled,
+    ).Scan(&next)
+    if err != nil || !next.Valid {
+        return idleWait
+    }
+
+    return min(max(time.Until(time.UnixMilli(next.Int64)), 0), idleWait)
+}
+
+// Saves the status of item, records it in the history and tells the subscribers about it
+func (q *Queue) update(item Item) error {
+    _, err := q.db.Exec(
+        `UPDATE watchzap_outbox SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ?,
+        whatsapp_id = ?, chat = ? WHERE id = ?`,
+        item.Status,
+        item.Attempts,
+        item.LastError,
+        item.NextAttempt.UnixMilli(),
+        item.UpdatedAt.UnixMilli(),
+        item.WhatsappID,
+        item.Chat,
+        item.ID,
+    )
+    if err != nil {
+        return err
+    }
+
+    err = q.record(item.ID, item.Status, item.LastError, item.UpdatedAt)
+    if err != nil {
+        return err
+    }
+
+    q.publish(item)
+
+    return nil
+}
+
+// Appends a status change to the history of the item
+func (q *Queue) record(id int64, status string, lastError string, at time.Time) error {
+    _, err := q.db.Exec(
+        "INSERT INTO watchzap_outbox_history (message_id, status, error, at) VALUES (?, ?, ?, ?)",
+        id,
+        status,
+        lastError,
+        at.UnixMilli(),
+    )
+
+    return err
+}
+
+func (q *Queue) publish(item Item) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    for ch := range q.subs {
+        select {
+        case ch <- item:
+        default:
+            log.Warn().Int64("id", item.ID).Msg("WZ: Subscriber is too slow, dropping queue update")
+        }
+    }
+}
+
+// Wakes the worker up without blocking
+func (q *Queue) notify() {
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+}
+
+type scanner interface {
+    Scan(dest ...any) error
+}
+
+func scanItem(row scanner) (Item, error) {
+    var item Item
+    var body string
+    var nextAttempt, createdAt, updatedAt int64
+
+    err := row.Scan(
+        &item.ID,
+        &body,
+        &item.Status,
+        &item.Attempts,
+        &item.LastError,
+        &nextAttempt,
+        &createdAt,
+        &updatedAt,
+        &item.WhatsappID,
+        &item.Chat,
+        &item.After,
+    )
+    if err != nil {
+        return Item{}, err
+    }
+
+    item.NextAttempt = time.UnixMilli(nextAttempt)
+    item.CreatedAt = time.UnixMilli(createdAt)
+    item.UpdatedAt = time.UnixMilli(updatedAt)
+
+    err = json.Unmarshal([]byte(body), &item.Message)
+    if err != nil {
+        return item, fmt.Errorf("%w: %w", ErrUnreadable, err)
+    }
+
+    return item, nil
+}
@@ -0,0 +1,518 @@
+package queue
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+func openDB(t *testing.T, path string) *sql.DB {
+    t.Helper()
+
+    db, err := database.Open("file:" + path + "?_foreign_keys=on")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+
+    return db
+}
+
+func newQueue(t *testing.T, db *sql.DB, maxAttempts int) *Queue {
+    t.Helper()
+
+    q, err := New(db, maxAttempts, time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return q
+}
+
+// Runs the worker until the test ends
+func run(t *testing.T, q *Queue, send func(parser.Message) error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(cancel)
+
+    go q.Run(ctx, func(m parser.Message) (Sent, error) {
+        err := send(m)
+        if err != nil {
+            return Sent{}, err
+        }
+
+        return Sent{WhatsappID: "WA" + m.Content, Chat: m.Recipient}, nil
+    })
+}
+
+func wait(t *testing.T, q *Queue, ids ...int64) []Item {
+    t.Helper()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    items, err := q.Wait(ctx, ids)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return items
+}
+
+func TestQueueSendsInOrder(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    var sent []string
+    first, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "1"})
+    second, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "2"})
+    run(t, q, func(m parser.Message) error {
+        sent = append(sent, m.Content)
+        return nil
+    })
+
+    items := wait(t, q, first, second)
+    for _, item := range items {
+        if item.Status != StatusSent || item.Attempts != 1 {
+            t.Errorf("expected item to be sent on the first attempt, got %+v", item)
+        }
+    }
+    if len(sent) != 2 || sent[0] != "1" || sent[1] != "2" {
+        t.Errorf("expected messages in order, got %v", sent)
+    }
+}
+
+func TestQueueEnqueueAfter(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    var sent []string
+    calls := 0
+    first, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "1"})
+    second, _ := q.EnqueueAfter(parser.Message{Recipient: "Alice", Content: "2"}, first)
+    third, _ := q.EnqueueAfter(parser.Message{Recipient: "Alice", Content: "3"}, second)
+    other, _ := q.Enqueue(parser.Message{Recipient: "Bob", Content: "other"})
+    run(t, q, func(m parser.Message) error {
+        calls++
+        // The first message is retried once and the second one is given up on, the chain goes on anyway
+        switch {
+        case m.Content == "1" && calls == 1:
+            return errors.New("offline")
+        case m.Content == "2":
+            return Permanent(errors.New("broken attachment"))
+        }
+        sent = append(sent, m.Content)
+        return nil
+    })
+
+    items := wait(t, q, first, second, third, other)
+    if items[0].Status != StatusSent || items[1].Status != StatusFailed || items[2].Status != StatusSent {
+        t.Fatalf("expected the chain to be sent, failed and sent, got %+v", items)
+    }
+    if items[1].After != first || items[2].After != second {
+        t.Errorf("expected each item to follow the previous one, got %+v", items)
+    }
+
+    chain := []string{}
+    for _, content := range sent {
+        if content != "other" {
+            chain = append(chain, content)
+        }
+    }
+    if strings.Join(chain, ",") != "1,3" {
+        t.Errorf("expected the chain to keep its order, got %v", sent)
+    }
+}
+
+func TestQueueRetries(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    calls := 0
+    id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "hi"})
+    run(t, q, func(m parser.Message) error {
+        calls++
+        if calls < 3 {
+            return errors.New("offline")
+        }
+        return nil
+    })
+
+    item := wait(t, q, id)[0]
+    if item.Status != StatusSent || item.Attempts != 3 || item.LastError != "" {
+        t.Errorf("expected item to be sent on the third attempt, got %+v", item)
+    }
+}
+
+func TestQueueGivesUp(t *testing.T) {
+    tests := []struct {
+        name     string
+        err      error
+        attempts int
+    }{
+        {name: "max attempts", err: errors.New("offline"), attempts: 3},
+        {name: "permanent error", err: Permanent(errors.New("unknown recipient")), attempts: 1},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+            id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "hi"})
+            run(t, q, func(m parser.Message) error {
+                return tt.err
+            })
+
+            item := wait(t, q, id)[0]
+            if item.Status != StatusFailed || item.Attempts != tt.attempts || item.LastError != tt.err.Error() {
+                t.Errorf("expected item to fail after %d attempts, got %+v", tt.attempts, item)
+            }
+        })
+    }
+}
+
+func TestQueueBackoff(t *testing.T) {
+    q := &Queue{backoff: time.Second}
+
+    expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+    for i, d := range expected {
+        if got := q.backoffFor(i + 1); got != d {
+            t.Errorf("attempt %d: expected %v, got %v", i+1, d, got)
+        }
+    }
+    if got := q.backoffFor(50); got != maxBackoff {
+        t.Errorf("expected backoff to be capped at %v, got %v", maxBackoff, got)
+    }
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "zap.db")
+
+    db := openDB(t, path)
+    q := newQueue(t, db, 3)
+    pending, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "pending"})
+    interrupted, _ := q.Enqueue(parser.Message{Recipient: "Bob", Content: "interrupted"})
+
+    // Simulate a crash in the middle of sending the second message
+    _, err := db.Exec("UPDATE watchzap_outbox SET status = ? WHERE id = ?", StatusSending, interrupted)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+
+    q = newQueue(t, openDB(t, path), 3)
+    var sent []string
+    run(t, q, func(m parser.Message) error {
+        sent = append(sent, m.Content)
+        return nil
+    })
+
+    for _, item := range wait(t, q, pending, interrupted) {
+        if item.Status != StatusSent {
+            t.Errorf("expected item to be sent after restart, got %+v", item)
+        }
+    }
+    if len(sent) != 2 {
+        t.Errorf("expected both messages to be sent, got %v", sent)
+    }
+}
+
+func TestQueueReceipts(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "1"})
+    run(t, q, func(m parser.Message) error {
+        return nil
+    })
+
+    item := wait(t, q, id)[0]
+    if item.WhatsappID != "WA1" || item.Chat != "Alice" {
+        t.Fatalf("expected the WhatsApp ID and chat to be stored, got %+v", item)
+    }
+
+    now := time.Now()
+    steps := []struct {
+        status   string
+        expected string
+    }{
+        {status: StatusRead, expected: StatusRead},
+        {status: StatusDelivered, expected: StatusRead},
+        {status: StatusPlayed, expected: StatusPlayed},
+    }
+    for _, step := range steps {
+        err := q.MarkReceipt([]string{"WA1", "unknown"}, step.status, now)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        item, err := q.Get(id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if item.Status != step.expected {
+            t.Errorf("after %s receipt expected %s, got %s", step.status, step.expected, item.Status)
+        }
+    }
+
+    history, err := q.History(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var statuses []string
+    for _, event := range history {
+        statuses = append(statuses, event.Status)
+    }
+    expected := []string{StatusQueued, StatusSending, StatusSent, StatusRead, StatusPlayed}
+    if strings.Join(statuses, ",") != strings.Join(expected, ",") {
+        t.Errorf("expected history %v, got %v", expected, statuses)
+    }
+}
+
+func TestQueueReceiptsIgnoreUnsent(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "1"})
+    err := q.MarkReceipt([]string{""}, StatusDelivered, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    item, _ := q.Get(id)
+    if item.Status != StatusQueued {
+        t.Errorf("expected receipts to leave queued messages alone, got %s", item.Status)
+    }
+}
+
+func TestQueueGetByWhatsappID(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "1"})
+    run(t, q, func(m parser.Message) error {
+        return nil
+    })
+    wait(t, q, id)
+
+    item, err := q.GetByWhatsappID("WA1")
+    if err != nil || item.ID != id {
+        t.Errorf("expected message %d, got %+v, %v", id, item, err)
+    }
+    // Messages never sent have no WhatsApp ID to be found by
+    for _, whatsappID := range []string{"", "unknown"} {
+        item, err := q.GetByWhatsappID(whatsappID)
+        if err == nil || err.Error() != static.MESSAGE_NOT_FOUND {
+            t.Errorf("%q: expected %q, got %+v, %v", whatsappID, static.MESSAGE_NOT_FOUND, item, err)
+        }
+    }
+}
+
+func TestQueueSchedules(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "zap.db")
+    q := newQueue(t, openDB(t, path), 3)
+
+    var sent []string
+    due, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "soon", Delay: "200ms"})
+    later, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "later", Delay: "1h"})
+    cancelled, _ := q.Enqueue(parser.Message{
+        Recipient: "Alice",
+        Content:   "never",
+        SendAt:    time.Now().Add(time.Hour).Format(time.RFC3339),
+    })
+
+    scheduled, err := q.Scheduled()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(scheduled) != 3 || scheduled[0].ID != due || scheduled[0].Status != StatusScheduled {
+        t.Fatalf("expected the 3 messages to be scheduled, next one first, got %+v", scheduled)
+    }
+
+    _, err = q.Cancel(cancelled)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = q.Cancel(cancelled)
+    if !errors.Is(err, ErrNotScheduled) {
+        t.Errorf("expected cancelling twice to fail, got %v", err)
+    }
+
+    start := time.Now()
+    run(t, q, func(m parser.Message) error {
+        sent = append(sent, m.Content)
+        return nil
+    })
+
+    // Wait returns scheduled items as they are, so poll until the worker picks it up
+    item, _ := q.Get(due)
+    for item.Status == StatusScheduled && time.Since(start) < 5*time.Second {
+        time.Sleep(10 * time.Millisecond)
+        item, _ = q.Get(due)
+    }
+    item = wait(t, q, due)[0]
+    if item.Status != StatusSent || time.Since(start) < 150*time.Millisecond {
+        t.Errorf("expected the message to be sent once due, got %+v after %v", item, time.Since(start))
+    }
+
+    item, _ = q.Get(later)
+    if item.Status != StatusScheduled {
+        t.Errorf("expected the later message to still be scheduled, got %s", item.Status)
+    }
+    item, _ = q.Get(cancelled)
+    if item.Status != StatusCancelled {
+        t.Errorf("expected the cancelled message to stay cancelled, got %s", item.Status)
+    }
+    if len(sent) != 1 {
+        t.Errorf("expected only the due message to be sent, got %v", sent)
+    }
+}
+
+func TestQueueWaitSkipsScheduled(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    id, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "later", Delay: "1h"})
+
+    item := wait(t, q, id)[0]
+    if item.Status != StatusScheduled {
+        t.Errorf("expected Wait to return scheduled messages right away, got %+v", item)
+    }
+}
+
+func TestQueueWaitSkipsFollowersOfScheduled(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+    run(t, q, func(m parser.Message) error {
+        return nil
+    })
+
+    scheduled, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "later", Delay: "1h"})
+    reaction, _ := q.EnqueueAfter(parser.Message{Recipient: "Alice", Content: "reaction"}, scheduled)
+    // Held back through the reaction, which is only queued
+    follower, _ := q.EnqueueAfter(parser.Message{Recipient: "Alice", Content: "follower"}, reaction)
+    now, _ := q.Enqueue(parser.Message{Recipient: "Bob", Content: "now"})
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    items, err := q.Wait(ctx, []int64{reaction, follower, now})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if items[0].Status != StatusQueued || items[1].Status != StatusQueued {
+        t.Errorf("expected the followers of a scheduled message to stay queued, got %+v", items[:2])
+    }
+    if items[2].Status != StatusSent {
+        t.Errorf("expected the other message to be waited for, got %+v", items[2])
+    }
+}
+
+func TestQueueChanges(t *testing.T) {
+    q := newQueue(t, openDB(t, filepath.Join(t.TempDir(), "zap.db")), 3)
+
+    old, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "before"})
+
+    // A new reader starts after the changes made so far, and keeps its position
+    seq, err := q.Cursor("test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, _ := q.Enqueue(parser.Message{Recipient: "Bob", Content: "after"})
+    run(t, q, func(m parser.Message) error {
+        return nil
+    })
+    wait(t, q, old, id)
+
+    var statuses []string
+    for {
+        changes, err := q.Changes(seq, 2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(changes) == 0 {
+            break
+        }
+        for _, change := range changes {
+            if change.Seq <= seq {
+                t.Fatalf("expected changes after %d, got %d", seq, change.Seq)
+            }
+            seq = change.Seq
+            statuses = append(statuses, fmt.Sprintf("%s %s", change.Item.Message.Content, change.Status))
+        }
+    }
+    expected := []string{"after queued", "before sending", "before sent", "after sending", "after sent"}
+    if strings.Join(statuses, ",") != strings.Join(expected, ",") {
+        t.Errorf("expected changes %v, got %v", expected, statuses)
+    }
+
+    err = q.SetCursor("test", seq)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cursor, err := q.Cursor("test"); err != nil || cursor != seq {
+        t.Errorf("expected the cursor to be kept at %d, got %d, %v", seq, cursor, err)
+    }
+}
+
+func TestQueueFailsUnreadableMessages(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "zap.db"))
+    q := newQueue(t, db, 3)
+
+    // Like a row edited by hand, or written before a field changed its type
+    bad, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "bad"})
+    _, err := db.Exec(`UPDATE watchzap_outbox SET message = '{"reply_to": "one"}' WHERE id = ?`, bad)
+    if err != nil {
+        t.Fatal(err)
+    }
+    good, _ := q.Enqueue(parser.Message{Recipient: "Bob", Content: "good"})
+
+    var sent []string
+    run(t, q, func(m parser.Message) error {
+        sent = append(sent, m.Content)
+        return nil
+    })
+
+    if item := wait(t, q, good)[0]; item.Status != StatusSent {
+        t.Errorf("expected the next message to be sent, got %+v", item)
+    }
+    if len(sent) != 1 || sent[0] != "good" {
+        t.Errorf("expected only the readable message to be sent, got %v", sent)
+    }
+
+    history, err := q.History(bad)
+    if err != nil {
+        t.Fatal(err)
+    }
+    last := history[len(history)-1]
+    if last.Status != StatusFailed || !strings.Contains(last.Error, static.UNREADABLE_MESSAGE) {
+        t.Errorf("expected the unreadable message to fail, got %+v", history)
+    }
+}
+
+func TestQueuePending(t *testing.T) {
+    db := openDB(t, filepath.Join(t.TempDir(), "zap.db"))
+    q := newQueue(t, db, 3)
+
+    sent, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "sent"})
+    run(t, q, func(m parser.Message) error { return nil })
+    wait(t, q, sent)
+
+    scheduled, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "later", Delay: "1h"})
+    cancelled, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "never", Delay: "1h"})
+    q.Cancel(cancelled)
+    bad, _ := q.Enqueue(parser.Message{Recipient: "Alice", Content: "bad", Delay: "1h"})
+    _, err := db.Exec(`UPDATE watchzap_outbox SET message = '{"reply_to": "one"}' WHERE id = ?`, bad)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pending, err := q.Pending()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(pending) != 1 || pending[0].ID != scheduled || pending[0].Message.Content != "later" {
+        t.Errorf("expected only the scheduled message to be pending, got %+v", pending)
+    }
+}
@@ -8,6 +8,73 @@ const (
     // Errors
     INTERNAL_SERVER_ERROR = "An unexpected error has occurred"
     EMPTY_FIELD           = "Mandatory field is empty"
-    NO_PARSER_FOUND       = "No parser found for extension"
-    INVALID_BYTES         = "Must have even byte slice"
+    NO_PARSER_FOUND       = "No parser found for the file extension or Content-Type"
+    NO_TTY                = "No -mode given and stdin is not a terminal, use -mode watch, http or both"
+    INVALID_MODE          = "Invalid mode, must be one of watch, http or both"
+    MISSING_FOLDER        = "A folder is required for this mode, use -folder"
+    MISSING_PORT          = "A port is required for this mode, use -port"
+    NOT_A_FOLDER          = "Path is not a folder"
+    INVALID_PORT          = "Invalid port"
+    RECIPIENT_NOT_FOUND   = "Recipient was not found"
+    MESSAGE_NOT_FOUND     = "Message not found"
+    SEND_FAILED           = "Some messages could not be sent"
+    INVALID_ID            = "Invalid message ID"
+    INVALID_PHONE         = "Invalid phone number, use the international format like +5511999999999"
+    INVALID_JID           = "Invalid JID, must end with @s.whatsapp.net or @g.us"
+    NOT_ON_WHATSAPP       = "Phone number is not on WhatsApp"
+    AMBIGUOUS_RECIPIENT   = "Ambiguous recipient"
+    INVALID_POLICY        = "Invalid recipient policy, must be one of strict, prefer-group, prefer-contact or first"
+    UNKNOWN_COMMAND       = "Unknown command"
+    UNSUPPORTED_OPTION    = "Option type cannot be set from the environment"
+    INVALID_ALIAS         = "Alias must point to a target or a list of targets"
+    NO_TEMPLATES          = "No templates folder configured, use -templates"
+    INVALID_TEMPLATE      = "Invalid template name"
+    TEMPLATE_NOT_FOUND    = "Template not found"
+    TEMPLATE_FAILED       = "Some messages could not be rendered"
+    INVALID_SEND_AT       = "Invalid send_at, use RFC 3339 like 2024-07-01T08:00:00-03:00"
+    INVALID_DELAY         = "Invalid delay, use a positive duration like 90m or 2h30m"
+    SEND_AT_AND_DELAY     = "Use either send_at or delay, not both"
+    NOT_SCHEDULED         = "Message is not scheduled"
+    INVALID_SCHEDULE      = "Invalid cron schedule"
+    INVALID_TIMEZONE      = "Invalid timezone, use an IANA name like America/Sao_Paulo"
+    INVALID_CATCH_UP      = "Invalid catch-up policy, must be one of skip, once or all"
+    JOB_NOT_FOUND         = "Job not found"
+    DUPLICATE_JOB         = "Job is defined more than once"
+    CONFIG_JOB            = "Job is defined in the config file and can only be changed there"
+    UNKNOWN_COLUMN        = "Unknown column"
+    DUPLICATE_COLUMN      = "Column is repeated"
+    INVALID_ENCODING      = "Text is not valid in its encoding"
+    UNKNOWN_CHARSET       = "Unknown charset"
+    MANY_ATTACHMENTS      = "Use only one of attachment, attachment_path, attachment_url, attachment_part or attachments"
+    INVALID_MEDIA_URL     = "Invalid attachment_url, must be an http or https URL"
+    NO_MEDIA_ROOT         = "attachment_path needs a media root, use -mediaRoot"
+    OUTSIDE_MEDIA_ROOT    = "attachment_path is outside of the allowed folder"
+    NOT_A_FILE            = "Path is not a regular file"
+    MEDIA_TOO_LARGE       = "Attachment is larger than the size limit, see -mediaMaxSize"
+    MEDIA_FETCH_FAILED    = "Could not download attachment_url"
+    NO_MULTIPART          = "attachment_part only works in multipart/form-data requests"
+    MISSING_MESSAGES      = "The multipart/form-data request has no messages field"
+    UNKNOWN_PART          = "No file part with this name"
+    DUPLICATE_PART        = "File part name is repeated"
+    ONE_SOURCE            = "Attachment needs exactly one of data, path, url or part"
+    INVALID_CAPTION_INDEX = "caption_index must point to one of the attachments"
+    INVALID_MIMETYPE      = "Invalid mimetype, use a media type like application/pdf"
+    INVALID_SEND_AS       = "Invalid send_as, must be one of image, video, audio, voice, gif, document or sticker"
+    NOT_OPUS              = "Voice notes must be Ogg files with Opus audio"
+    NOT_WEBP              = "Stickers must be WebP images"
+    GIF_NOT_MP4           = "GIFs must be sent as MP4 videos"
+    NOT_IMAGE             = "Not a JPEG, PNG, GIF or WebP image"
+    NOT_MP4               = "Not an MP4 video"
+    INVALID_KIND          = "Invalid kind, must be one of text, location, contact, poll or reaction"
+    KIND_FIELD            = "Field does not apply to this kind of message"
+    INVALID_LATITUDE      = "Invalid latitude, must be between -90 and 90"
+    INVALID_LONGITUDE     = "Invalid longitude, must be between -180 and 180"
+    INVALID_LINK_URL      = "Invalid link url, must be an http or https URL"
+    INVALID_THUMBNAIL     = "Invalid link thumbnail, must be a base64 encoded image"
+    POLL_OPTIONS          = "A poll needs between 2 and 12 options"
+    DUPLICATE_OPTION      = "Poll option is repeated"
+    INVALID_SELECTABLE    = "Invalid selectable_count, must be between 0 and the number of options"
+    NOT_SENT              = "The message was not sent, so there is nothing to refer to"
+    NOT_A_POLL            = "Message is not a poll"
+    UNREADABLE_MESSAGE    = "Stored message can't be read"
 )
@@ -0,0 +1,134 @@
+package templates
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "text/template"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/static"
+)
+
+// Extension of the named templates inside the templates folder
+const Ext = ".tmpl"
+
+// A rendering error of one message, telling which field caused it
+type FieldError struct {
+    Index int
+    Field string
+    Err   error
+}
+
+func (e *FieldError) Error() string {
+    return fmt.Sprintf("message %d: %s: %v", e.Index, e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+    return e.Err
+}
+
+// Every rendering error of a batch of messages
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+    msgs := make([]string, len(e))
+    for i, err := range e {
+        msgs[i] = err.Error()
+    }
+
+    return strings.Join(msgs, "; ")
+}
+
+// Store renders the content of messages from named templates kept in a folder,
+// or from the content itself when the message has variables
+type Store struct {
+    dir string
+}
+
+// Creates a store reading the named templates from dir, which is read on every render so edits apply right away
+// With an empty dir only inline templates are rendered
+func NewStore(dir string) *Store {
+    return &Store{dir: dir}
+}
+
+// Renders the content of every message in place
+// Every message is rendered even after an error, so all the broken ones are reported at once
+func (s *Store) RenderAll(messages []parser.Message) error {
+    var errs Errors
+    for i := range messages {
+        field, err := s.Render(&messages[i])
+        if err != nil {
+            errs = append(errs, &FieldError{Index: i, Field: field, Err: err})
+        }
+    }
+    if len(errs) > 0 {
+        return errs
+    }
+
+    return nil
+}
+
+// Renders the content of m in place, returning the field to blame on error
+// Messages with neither template nor vars are left untouched, so plain content containing {{ is sent as is,
+// and so are those with vars but nothing to render, like an attachment without caption or a poll
+func (s *Store) Render(m *parser.Message) (string, error) {
+    if m.Template == "" && (len(m.Vars) == 0 || m.Content == "") {
+        return "", nil
+    }
+
+    field, text := "content", m.Content
+    if m.Template != "" {
+        field = "template"
+        var err error
+        text, err = s.load(m.Template)
+        if err != nil {
+            return field, err
+        }
+    }
+
+    t, err := template.New(field).Option("missingkey=error").Parse(text)
+    if err != nil {
+        return field, err
+    }
+
+    var b bytes.Buffer
+    err = t.Execute(&b, m.Vars)
+    if err != nil {
+        var execErr template.ExecError
+        if errors.As(err, &execErr) && strings.Contains(err.Error(), "no entry for key") {
+            return "vars", err
+        }
+        return field, err
+    }
+    if b.Len() == 0 {
+        return field, fmt.Errorf("%s: content", static.EMPTY_FIELD)
+    }
+
+    m.Content = b.String()
+
+    return "", nil
+}
+
+// Reads the named template, refusing names that would leave the templates folder
+func (s *Store) load(name string) (string, error) {
+    if s == nil || s.dir == "" {
+        return "", errors.New(static.NO_TEMPLATES)
+    }
+    if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+        return "", fmt.Errorf("%s: %s", static.INVALID_TEMPLATE, name)
+    }
+
+    body, err := os.ReadFile(filepath.Join(s.dir, name+Ext))
+    if errors.Is(err, os.ErrNotExist) {
+        return "", fmt.Errorf("%s: %s", static.TEMPLATE_NOT_FOUND, name)
+    }
+    if err != nil {
+        return "", err
+    }
+
+    return string(body), nil
+}
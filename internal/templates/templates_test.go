@@ -0,0 +1,138 @@
+package templates
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/watchzap/internal/parser"
+)
+
+func newTestStore(t *testing.T) *Store {
+    t.Helper()
+
+    dir := t.TempDir()
+    err := os.WriteFile(filepath.Join(dir, "invoice_due.tmpl"), []byte("Invoice of ${{.amount}} is due"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{.amount"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return NewStore(dir)
+}
+
+func TestRender(t *testing.T) {
+    store := newTestStore(t)
+
+    tests := []struct {
+        name     string
+        message  parser.Message
+        expected string
+        field    string
+    }{
+        {
+            name:     "named template",
+            message:  parser.Message{Template: "invoice_due", Vars: map[string]any{"amount": "120"}},
+            expected: "Invoice of $120 is due",
+        },
+        {
+            name:     "inline template",
+            message:  parser.Message{Content: "Hi {{.name}}", Vars: map[string]any{"name": "Alice"}},
+            expected: "Hi Alice",
+        },
+        {
+            name: "vars without content or template",
+            message: parser.Message{
+                AttachmentURL: "https://example.com/logo.png",
+                Vars:          map[string]any{"name": "Alice"},
+            },
+            expected: "",
+        },
+        {
+            name:     "no vars is sent verbatim",
+            message:  parser.Message{Content: "Hi {{.name}}"},
+            expected: "Hi {{.name}}",
+        },
+        {
+            name:    "missing variable",
+            message: parser.Message{Template: "invoice_due", Vars: map[string]any{"total": "120"}},
+            field:   "vars",
+        },
+        {
+            name:    "unknown template",
+            message: parser.Message{Template: "missing", Vars: map[string]any{"amount": "120"}},
+            field:   "template",
+        },
+        {
+            name:    "template outside the folder",
+            message: parser.Message{Template: "../invoice_due"},
+            field:   "template",
+        },
+        {
+            name:    "broken template",
+            message: parser.Message{Template: "broken", Vars: map[string]any{"amount": "120"}},
+            field:   "template",
+        },
+        {
+            name:    "broken inline template",
+            message: parser.Message{Content: "Hi {{.name", Vars: map[string]any{"name": "Alice"}},
+            field:   "content",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            m := tt.message
+            field, err := store.Render(&m)
+            if tt.field != "" {
+                if err == nil || field != tt.field {
+                    t.Fatalf("expected an error on %s, got %q: %v", tt.field, field, err)
+                }
+                return
+            }
+
+            if err != nil {
+                t.Fatal(err)
+            }
+            if m.Content != tt.expected {
+                t.Errorf("expected %q, got %q", tt.expected, m.Content)
+            }
+        })
+    }
+}
+
+func TestRenderWithoutFolder(t *testing.T) {
+    var store *Store
+
+    m := parser.Message{Template: "invoice_due"}
+    field, err := store.Render(&m)
+    if err == nil || field != "template" {
+        t.Errorf("expected named templates to fail without a folder, got %q: %v", field, err)
+    }
+}
+
+func TestRenderAllReportsEveryMessage(t *testing.T) {
+    store := newTestStore(t)
+
+    messages := []parser.Message{
+        {Template: "missing"},
+        {Template: "invoice_due", Vars: map[string]any{"amount": 5}},
+        {Content: "{{.x}}", Vars: map[string]any{"y": 1}},
+    }
+
+    err := store.RenderAll(messages)
+    var errs Errors
+    if !errors.As(err, &errs) {
+        t.Fatalf("expected rendering errors, got %v", err)
+    }
+    if len(errs) != 2 || errs[0].Index != 0 || errs[0].Field != "template" || errs[1].Index != 2 || errs[1].Field != "vars" {
+        t.Errorf("expected errors on messages 0 and 2, got %v", errs)
+    }
+    if messages[1].Content != "Invoice of $5 is due" {
+        t.Errorf("expected the valid message to be rendered, got %q", messages[1].Content)
+    }
+}
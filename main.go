@@ -3,29 +3,32 @@ package main
 import (
     "context"
     "database/sql"
-    "encoding/json"
     "errors"
     "flag"
     "fmt"
-    "io"
-    "net/http"
     "os"
     "os/exec"
-    "path/filepath"
     "runtime"
-    "strings"
+    "strconv"
     "syscall"
     "time"
 
-    "github.com/radovskyb/watcher"
     "github.com/rs/zerolog"
     "github.com/rs/zerolog/log"
-    "go.mau.fi/whatsmeow/types"
+    "golang.org/x/term"
 
+    "github.com/watchzap/internal/alias"
     "github.com/watchzap/internal/api"
+    "github.com/watchzap/internal/config"
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/jobs"
+    "github.com/watchzap/internal/media"
     "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/polls"
     "github.com/watchzap/internal/prompt"
+    "github.com/watchzap/internal/queue"
     "github.com/watchzap/internal/static"
+    "github.com/watchzap/internal/templates"
 )
 
 // Msa stands for shortcut for map[string]any
@@ -35,63 +38,161 @@ const (
     version string = "v1.0.0"
 )
 
+// Run modes accepted by the -mode flag
+const (
+    modeWatch = "watch"
+    modeHttp  = "http"
+    modeBoth  = "both"
+)
+
 var (
-    debug        bool
-    removeOnSend bool
-    folder       string
-    port         string
+    cfg          config.Config
     wait         int
     printVersion bool
-    msgLimit     int
-    timeLimit    int
+    logout       bool
+    configPath   string
+    // Logical recipient names, nil when no alias file is configured
+    aliases *alias.Book
+    // Renders message templates, only inline ones when no templates folder is configured
+    templateStore *templates.Store
+    // Dispatches the recurring jobs, set once the outbox is running
+    scheduler *jobs.Scheduler
+    // Reads attachments from base64, files and URLs before they are uploaded
+    mediaLoader *media.Loader
+    // Votes on the polls we sent, set once the outbox is running
+    pollStore *polls.Store
 )
 
-type MessageRequest struct {
-    Jid  types.JID
-    Flag bool
-}
-
-// Parses messages based on their content type
-func parse(ext string, body []byte) (*[]parser.Message, error) {
-    if ext == "json" {
-        return parser.JsonParser(body)
-    } else if ext == "yaml" {
-        return parser.YamlParser(body)
-    }
-
-    return nil, errors.New(static.NO_PARSER_FOUND)
-}
-
-func checkExt(ext string) (string, error) {
-    if strings.HasSuffix(ext, "json") {
-        return "json", nil
-    }
-
-    if strings.HasSuffix(ext, "yaml") || strings.HasSuffix(ext, "yml") {
-        return "yaml", nil
-    }
-
-    return "", errors.New(static.NO_PARSER_FOUND)
-}
-
 func main() {
     log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-    flag.BoolVar(&debug, "debug", false, "enables the debug mode for WhatsApp API")
-    flag.BoolVar(&removeOnSend, "removeOnSend", false, "deletes the file after sending the message")
+    // Flags are parsed into their own copy so only the ones actually set override the file and env
+    defaults := config.Default()
+    var flags config.Config
+    flag.BoolVar(&flags.Debug, "debug", defaults.Debug, "enables the debug mode for WhatsApp API")
+    flag.BoolVar(
+        &flags.RemoveOnSend,
+        "removeOnSend",
+        defaults.RemoveOnSend,
+        "deletes the file after sending the message",
+    )
     flag.BoolVar(&printVersion, "version", false, "prints the program version")
     flag.IntVar(
-        &msgLimit,
+        &flags.MsgLimit,
         "msgLimit",
-        4,
+        defaults.MsgLimit,
         "limits the number of messages being sent before waiting",
     )
     flag.IntVar(
-        &timeLimit,
+        &flags.TimeLimit,
         "timeLimit",
-        5,
+        defaults.TimeLimit,
         "limits the waiting time after the msgLimit has been reached (in seconds)",
     )
+    flag.StringVar(&flags.Mode, "mode", defaults.Mode, "run without prompting: watch, http or both")
+    flag.StringVar(
+        &flags.Folder,
+        "folder",
+        defaults.Folder,
+        "folder to watch (required for -mode watch and both)",
+    )
+    flag.StringVar(
+        &flags.Port,
+        "port",
+        defaults.Port,
+        "port for the HTTP server (required for -mode http and both)",
+    )
+    flag.IntVar(
+        &flags.MaxAttempts,
+        "maxAttempts",
+        defaults.MaxAttempts,
+        "number of times a message is tried before giving up",
+    )
+    flag.DurationVar(
+        &flags.RetryBackoff,
+        "retryBackoff",
+        defaults.RetryBackoff,
+        "wait before retrying a failed message, doubled after every attempt",
+    )
+    flag.StringVar(
+        &flags.Webhook,
+        "webhook",
+        defaults.Webhook,
+        "URL receiving a POST for every status change of a message",
+    )
+    flag.BoolVar(
+        &flags.CheckRegistered,
+        "checkRegistered",
+        defaults.CheckRegistered,
+        "checks that phone recipients are on WhatsApp before sending",
+    )
+    flag.StringVar(
+        &flags.RecipientPolicy,
+        "recipientPolicy",
+        defaults.RecipientPolicy,
+        "what to do when a name matches several recipients: strict, prefer-group, prefer-contact or first",
+    )
+    flag.DurationVar(
+        &flags.DirectoryTTL,
+        "directoryTTL",
+        defaults.DirectoryTTL,
+        "how long contacts and groups are cached before being reloaded",
+    )
+    flag.StringVar(
+        &flags.Aliases,
+        "aliases",
+        defaults.Aliases,
+        "YAML or JSON file mapping names to one or more recipients, reloaded when it changes",
+    )
+    flag.StringVar(
+        &flags.Templates,
+        "templates",
+        defaults.Templates,
+        "folder with the named message templates, as <name>.tmpl files",
+    )
+    flag.StringVar(
+        &flags.Charset,
+        "charset",
+        defaults.Charset,
+        "encoding of files and requests without BOM or charset, detected when empty",
+    )
+    flag.StringVar(
+        &flags.MediaRoot,
+        "mediaRoot",
+        defaults.MediaRoot,
+        "folder attachment_path is relative to, required to use it over HTTP",
+    )
+    flag.IntVar(
+        &flags.MediaMaxSize,
+        "mediaMaxSize",
+        defaults.MediaMaxSize,
+        "largest attachment accepted (in MB)",
+    )
+    flag.DurationVar(
+        &flags.MediaTimeout,
+        "mediaTimeout",
+        defaults.MediaTimeout,
+        "how long downloading an attachment_url may take",
+    )
+    flag.IntVar(
+        &flags.RequestMaxSize,
+        "requestMaxSize",
+        defaults.RequestMaxSize,
+        "largest request body accepted by the HTTP server, uploads included (in MB)",
+    )
+    flag.StringVar(
+        &flags.CatchUp,
+        "catchUp",
+        defaults.CatchUp,
+        "what to do with job runs missed while stopped: skip, once or all",
+    )
+    flag.BoolVar(&logout, "logout", false, "logs out from WhatsApp, wipes the database and exits")
+    flag.StringVar(
+        &configPath,
+        "config",
+        "",
+        "path to the config file (defaults to $WATCHZAP_CONFIG or ./watchzap.yaml)",
+    )
     flag.Parse()
 
     if printVersion {
@@ -99,253 +200,244 @@ func main() {
         return
     }
 
-    db, err := sql.Open("sqlite3", "file:zap.db?_foreign_keys=on")
+    err := loadConfig(flags)
+    if err != nil {
+        log.Fatal().Err(err).Msg("WZ: Could not load configuration")
+    }
+
+    if flag.NArg() > 0 {
+        err := subcommand(flag.Args())
+        if err != nil {
+            log.Fatal().Err(err).Msg("WZ: Command failed")
+        }
+        return
+    }
+
+    // Without a mode we can only ask, so make sure there is someone to answer
+    if cfg.Mode == "" && !logout && !term.IsTerminal(int(os.Stdin.Fd())) {
+        log.Fatal().Msg(static.NO_TTY)
+    }
+
+    if cfg.Mode != "" {
+        err := validateMode()
+        if err != nil {
+            log.Fatal().Err(err).Msg("WZ: Invalid flags")
+        }
+    }
+
+    db, err := database.Open(database.URI)
     if err != nil {
         log.Fatal().Err(err).Msg(static.INTERNAL_SERVER_ERROR)
     }
 
-    whatsapp, err := api.NewWhatsapp(debug)
+    outbox, err := queue.New(db, cfg.MaxAttempts, cfg.RetryBackoff)
     if err != nil {
         log.Fatal().Err(err).Msg(static.INTERNAL_SERVER_ERROR)
     }
 
-    err = whatsapp.Login()
+    whatsapp, err := api.NewWhatsapp(cfg.Debug)
     if err != nil {
         log.Fatal().Err(err).Msg(static.INTERNAL_SERVER_ERROR)
     }
 
-    runResult := prompt.Select(
-        "Select ",
-        []string{"Watch Folder", "Enable HTTP Server", "Both", "Logout"},
-    )
-    switch runResult {
-    case "Watch Folder":
-        folder = prompt.Input("What folder will you watch", nil)
-        watch(whatsapp)
-    case "Enable HTTP Server":
-        port = prompt.Input("What port will you listen", nil)
-        httpServe(whatsapp)
-    case "Both":
-        folder = prompt.Input("What folder will you watch", nil)
-        port = prompt.Input("What port will you listen", nil)
-        go httpServe(whatsapp)
-        watch(whatsapp)
-    case "Logout":
-        whatsapp.Client.Logout()
+    // There is no session to end, so just make sure nothing is left behind
+    if logout && whatsapp.Client.Store.ID == nil {
         db.Exec(static.WIPE_DB)
-        restart()
+        log.Info().Msg("WZ: No session found, database wiped")
+        return
     }
-}
 
-// Sets up an HTTP server for receiving message requests
-func httpServe(whatsapp *api.Whatsapp) {
-    time.Sleep(time.Millisecond * 100)
+    err = whatsapp.Login()
+    if err != nil {
+        log.Fatal().Err(err).Msg(static.INTERNAL_SERVER_ERROR)
+    }
 
-    mux := http.NewServeMux()
-    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        body, err := io.ReadAll(r.Body)
-        if err != nil {
-            w.WriteHeader(http.StatusUnprocessableEntity)
-            log.Error().Err(err).Msg("WZ: Error reading request body")
+    if logout {
+        whatsapp.Client.Logout()
+        db.Exec(static.WIPE_DB)
+        log.Info().Msg("WZ: Logged out from WhatsApp")
+        return
+    }
 
-            jsonR, _ := json.Marshal(msa{"status": "error", "error": err.Error()})
-            w.Write(jsonR)
-            return
-        }
-        defer r.Body.Close()
+    if cfg.Mode == "" {
+        interactive(whatsapp, db, outbox)
+        return
+    }
 
-        suffix, err := checkExt(r.Header.Get("Content-Type"))
-        if err != nil {
-            w.WriteHeader(http.StatusUnprocessableEntity)
-            log.Error().Err(err).Msg("WZ: Error checking extension")
+    run(whatsapp, db, outbox)
+}
 
-            jsonR, _ := json.Marshal(msa{"status": "error", "error": err.Error()})
-            w.Write(jsonR)
-            return
-        }
+// Builds the effective configuration, precedence is flags > env > file > defaults
+func loadConfig(flags config.Config) error {
+    cfg = config.Default()
 
-        messages, err := parse(suffix, body)
+    if path := config.Path(configPath); path != "" {
+        err := cfg.LoadFile(path)
         if err != nil {
-            w.WriteHeader(http.StatusUnprocessableEntity)
-            log.Error().Err(err).Msg("WZ: Error parsing file")
-
-            jsonR, _ := json.Marshal(msa{"status": "error", "error": err.Error()})
-            w.Write(jsonR)
-            return
+            return err
         }
+    }
 
-        err = sendMessages(messages, whatsapp)
-        if err != nil {
-            w.WriteHeader(http.StatusInternalServerError)
-            log.Error().Err(err).Msg("WZ: Error sending messages")
+    err := cfg.LoadEnv()
+    if err != nil {
+        return err
+    }
 
-            jsonR, _ := json.Marshal(msa{"status": "error", "error": err.Error()})
-            w.Write(jsonR)
-            return
-        }
+    set := map[string]bool{}
+    flag.Visit(func(f *flag.Flag) {
+        set[f.Name] = true
+    })
+    cfg.Merge(flags, set)
 
-        jsonR, _ := json.Marshal(msa{"status": "ok", "amount": len(*messages)})
+    err = api.ValidatePolicy(cfg.RecipientPolicy)
+    if err != nil {
+        return err
+    }
 
-        w.WriteHeader(http.StatusCreated)
-        w.Write(jsonR)
-    })
-    log.Info().Str("function", "http").Msg("WZ: Serving HTTP server at " + port)
-    err := http.ListenAndServe(":"+port, mux)
+    err = jobs.ValidateCatchUp(cfg.CatchUp)
     if err != nil {
-        log.Fatal().Err(err).Msg("WZ: Failed to serve HTTP server")
+        return err
     }
+
+    return parser.ValidateCharset(cfg.Charset)
 }
 
-// Sets up a file watcher to monitor changes in a directory
-func watch(whatsapp *api.Whatsapp) {
-    w := watcher.New()
-    w.FilterOps(watcher.Create, watcher.Move, watcher.Write, watcher.Rename)
-    go func() {
-        for {
-            select {
-            case event := <-w.Event:
-                doEvent(event, whatsapp)
-            case err := <-w.Error:
-                log.Fatal().Err(err).Str("function", "watch").Msg("WZ: Failed getting folder event")
-            case <-w.Closed:
-                return
-            }
-        }
-    }()
-    if err := w.Add(folder); err != nil {
-        log.Fatal().Err(err).Str("function", "watch").Msg("WZ: Error adding folder to watch")
-    }
-    log.Info().Str("folder", folder).Msg("WZ: Watching folder every 100ms")
-    if err := w.Start(time.Millisecond * 100); err != nil {
-        log.Fatal().
-            Err(err).
-            Str("function", "watch").
-            Msg(fmt.Sprintf("Failed to watch folder %s", folder))
+// Checks that the flags given for a headless run are complete and usable
+func validateMode() error {
+    switch cfg.Mode {
+    case modeWatch, modeHttp, modeBoth:
+    default:
+        return fmt.Errorf("%s: %q", static.INVALID_MODE, cfg.Mode)
     }
-}
 
-// / Processes file events triggered by the watch function
-func doEvent(w watcher.Event, whatsapp *api.Whatsapp) {
-    if w.IsDir() {
-        return
+    if cfg.Mode == modeWatch || cfg.Mode == modeBoth {
+        err := validateFolder(cfg.Folder)
+        if err != nil {
+            return err
+        }
     }
 
-    ext, err := checkExt(filepath.Ext(w.Path))
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Error checking file extension")
-        return
+    if cfg.Mode == modeHttp || cfg.Mode == modeBoth {
+        err := validatePort(cfg.Port)
+        if err != nil {
+            return err
+        }
     }
 
-    f, err := os.Open(w.Path)
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Failed opening file")
-        return
+    return nil
+}
+
+// Checks that folder is an existing folder to watch
+func validateFolder(folder string) error {
+    if folder == "" {
+        return errors.New(static.MISSING_FOLDER)
     }
 
-    stat, err := f.Stat()
+    stat, err := os.Stat(folder)
     if err != nil {
-        log.Error().Err(err).Msg("WZ: Failed getting stat of file")
-        return
+        return err
     }
-    if stat.Size() == 0 {
-        log.Warn().Str("file", w.Name()).Str("path", w.Path).Msg("WZ: File content is empty")
-        return
+    if !stat.IsDir() {
+        return fmt.Errorf("%s: %s", static.NOT_A_FOLDER, folder)
     }
 
-    body := make([]byte, stat.Size())
-    _, err = f.Read(body)
-    if err != nil {
-        log.Error().Err(err).Str("parser", "json").Msg("WZ: Error reading file")
-        return
-    }
+    return nil
+}
 
-    err = f.Close()
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Could not close file")
-        return
+// Checks that port is a TCP port to listen on
+func validatePort(port string) error {
+    if port == "" {
+        return errors.New(static.MISSING_PORT)
     }
 
-    messages, err := parse(ext, body)
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Error parsing messages")
-        return
+    p, err := strconv.Atoi(port)
+    if err != nil || p < 1 || p > 65535 {
+        return fmt.Errorf("%s: %s", static.INVALID_PORT, port)
     }
 
-    err = sendMessages(messages, whatsapp)
-    if err != nil {
-        log.Error().Err(err).Msg("WZ: Could not send messages")
-        return
-    }
+    return nil
+}
 
-    if removeOnSend {
-        err := os.Remove(w.Path)
+// Starts watchzap in the mode chosen by flags or by the interactive menu
+func run(whatsapp *api.Whatsapp, db *sql.DB, outbox *queue.Queue) {
+    templateStore = templates.NewStore(cfg.Templates)
+    mediaLoader = media.NewLoader(int64(cfg.MediaMaxSize)<<20, cfg.MediaTimeout)
+    if cfg.Aliases != "" {
+        book, err := alias.Load(cfg.Aliases)
         if err != nil {
-            log.Warn().Err(err).Msg("WZ: Could not delete the file upon send")
-            return
+            log.Fatal().Err(err).Msg("WZ: Could not load aliases")
         }
+        aliases = book
+        go aliases.Watch(time.Second)
     }
-}
-
-// Sends messages to recipients based on parsed messages
-func sendMessages(messages *[]parser.Message, whatsapp *api.Whatsapp) error {
-    if wait >= msgLimit {
-        for t := timeLimit; t > 0; t-- {
-            log.Info().Msgf("WZ: Waiting to prevent rate over limit...%v", t)
-            time.Sleep(time.Second * 1)
-        }
-        wait = 0
+    trackReceipts(whatsapp, outbox)
+    pollStore = polls.New(db)
+    trackPollVotes(whatsapp, outbox, pollStore)
+    if cfg.Webhook != "" {
+        notifyWebhook(outbox, cfg.Webhook)
     }
+    resolver := api.NewResolver(whatsapp, api.ResolverOptions{
+        CheckRegistered: cfg.CheckRegistered,
+        Policy:          cfg.RecipientPolicy,
+        DirectoryTTL:    cfg.DirectoryTTL,
+    })
+    go outbox.Run(context.Background(), func(m parser.Message) (queue.Sent, error) {
+        return sendMessage(m, whatsapp, resolver, outbox)
+    })
+    cleanUploads(context.Background(), outbox)
 
-    for _, m := range *messages {
-        var req MessageRequest
-
-        contacts, err := whatsapp.Client.Store.Contacts.GetAllContacts()
-        if err != nil {
-            log.Error().Err(err).Msg("WZ: Failed getting contacts")
-            return err
-        }
-        groups, err := whatsapp.Client.GetJoinedGroups()
-        if err != nil {
-            log.Error().Err(err).Msg("WZ: Failed to get joined groups")
-            return err
-        }
+    scheduler = jobs.New(db, cfg.CatchUp, func(job jobs.Job, at time.Time) error {
+        return runJob(job, at, outbox)
+    })
+    err := scheduler.Sync(cfg.Jobs)
+    if err != nil {
+        log.Fatal().Err(err).Msg("WZ: Could not load the jobs of the config file")
+    }
+    go scheduler.Run(context.Background())
+
+    switch cfg.Mode {
+    case modeWatch:
+        watch(outbox)
+    case modeHttp:
+        httpServe(outbox)
+    case modeBoth:
+        go httpServe(outbox)
+        watch(outbox)
+    }
+}
 
-        for _, g := range groups {
-            if m.Recipient == g.GroupName.Name {
-                req.Jid = g.JID
-                req.Flag = true
-            }
-        }
-        for j, c := range contacts {
-            if m.Recipient == c.PushName || m.Recipient == c.FullName {
-                req.Jid = j
-                req.Flag = true
-            }
-        }
+// Asks the user what to do, used when no -mode is given and stdin is a terminal
+func interactive(whatsapp *api.Whatsapp, db *sql.DB, outbox *queue.Queue) {
+    runResult := prompt.Select(
+        "Select ",
+        []string{"Watch Folder", "Enable HTTP Server", "Both", "Logout"},
+    )
+    // Answers are checked as they are typed, so the prompt asks again until they are usable
+    switch runResult {
+    case "Watch Folder":
+        cfg.Mode = modeWatch
+        cfg.Folder = prompt.Input("What folder will you watch", validateFolder)
+    case "Enable HTTP Server":
+        cfg.Mode = modeHttp
+        cfg.Port = prompt.Input("What port will you listen", validatePort)
+    case "Both":
+        cfg.Mode = modeBoth
+        cfg.Folder = prompt.Input("What folder will you watch", validateFolder)
+        cfg.Port = prompt.Input("What port will you listen", validatePort)
+    case "Logout":
+        whatsapp.Client.Logout()
+        db.Exec(static.WIPE_DB)
+        restart()
+        return
+    }
 
-        if req.Flag {
-            sendMessage, err := whatsapp.GenerateMessage(m)
-            if err != nil {
-                return err
-            }
-
-            _, err = whatsapp.Client.SendMessage(context.Background(), req.Jid, sendMessage)
-            if err != nil {
-                log.Error().Err(err).Msg("WZ: Error sending message to recipient")
-                return err
-            }
-            log.Info().
-                Str("recipient", m.Recipient).
-                Str("content", m.Content).
-                Msg("WZ: Sent message successfully")
-            wait++
-        } else {
-            log.Info().Msg("WZ: Recipient was not found")
-            return err
-        }
+    // Same checks as a headless run, for whatever the prompts let through
+    err := validateMode()
+    if err != nil {
+        log.Fatal().Err(err).Msg("WZ: Invalid answers")
     }
 
-    return nil
+    run(whatsapp, db, outbox)
 }
 
 // Restart go program execution
@@ -0,0 +1,1629 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "unicode/utf16"
+
+    "github.com/radovskyb/watcher"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+
+    "github.com/watchzap/internal/alias"
+    "github.com/watchzap/internal/api"
+    "github.com/watchzap/internal/config"
+    "github.com/watchzap/internal/database"
+    "github.com/watchzap/internal/jobs"
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/polls"
+    "github.com/watchzap/internal/queue"
+    "github.com/watchzap/internal/static"
+    "github.com/watchzap/internal/templates"
+)
+
+var (
+    aliceJID = types.NewJID("5511999990001", types.DefaultUserServer)
+    bobJID   = types.NewJID("5511999990002", types.DefaultUserServer)
+    opsJID   = types.NewJID("120363000000000001", types.GroupServer)
+)
+
+// 1x1 transparent PNG
+const pngBase64 = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+// Creates a fake WhatsApp with a few contacts and a queue whose worker sends through it
+func newTestEnv(t *testing.T) (*api.Fake, *queue.Queue) {
+    t.Helper()
+
+    cfg = config.Default()
+    cfg.MsgLimit = 1000
+    wait = 0
+    aliases = nil
+    templateStore = nil
+    mediaLoader = media.NewLoader(int64(cfg.MediaMaxSize)<<20, cfg.MediaTimeout)
+
+    fake := api.NewFake()
+    fake.AddContact(aliceJID, "Alice", "Alice Smith")
+    fake.AddContact(bobJID, "Bob", "")
+    fake.AddGroup(opsJID, "Ops")
+
+    db, err := database.Open("file:" + filepath.Join(t.TempDir(), "zap.db") + "?_foreign_keys=on")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+
+    outbox, err := queue.New(db, 2, time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(cancel)
+    trackReceipts(fake, outbox)
+    pollStore = polls.New(db)
+    trackPollVotes(fake, outbox, pollStore)
+    resolver := api.NewResolver(fake, api.ResolverOptions{CheckRegistered: cfg.CheckRegistered})
+    go outbox.Run(ctx, func(m parser.Message) (queue.Sent, error) {
+        return sendMessage(m, fake, resolver, outbox)
+    })
+    scheduler = jobs.New(db, jobs.CatchUpSkip, func(job jobs.Job, at time.Time) error {
+        return runJob(job, at, outbox)
+    })
+
+    return fake, outbox
+}
+
+// Waits for the item to be done and returns it
+func waitItem(t *testing.T, outbox *queue.Queue, id int64) queue.Item {
+    t.Helper()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    items, err := outbox.Wait(ctx, []int64{id})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return items[0]
+}
+
+// Encodes s as UTF-16LE without BOM, the way PowerShell writes files
+func utf16le(s string) []byte {
+    var b []byte
+    for _, u := range utf16.Encode([]rune(s)) {
+        b = append(b, byte(u), byte(u>>8))
+    }
+
+    return b
+}
+
+func post(t *testing.T, outbox *queue.Queue, contentType string, body []byte) *httptest.ResponseRecorder {
+    t.Helper()
+
+    req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+    req.Header.Set("Content-Type", contentType)
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    return rec
+}
+
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) msa {
+    t.Helper()
+
+    var res msa
+    err := json.Unmarshal(rec.Body.Bytes(), &res)
+    if err != nil {
+        t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+    }
+
+    return res
+}
+
+func TestHttpSendsYaml(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "- recipient: Alice\n  content: hello\n- recipient: Ops\n  content: deploy done\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    if res := decodeResponse(t, rec); res["amount"] != float64(2) {
+        t.Errorf("expected amount 2, got %v", res["amount"])
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 {
+        t.Fatalf("expected 2 sent messages, got %d", len(sent))
+    }
+    if sent[0].To != aliceJID || sent[0].Message.GetConversation() != "hello" {
+        t.Errorf("unexpected first message %v %q", sent[0].To, sent[0].Message.GetConversation())
+    }
+    if sent[1].To != opsJID || sent[1].Message.GetConversation() != "deploy done" {
+        t.Errorf("unexpected second message %v %q", sent[1].To, sent[1].Message.GetConversation())
+    }
+}
+
+func TestValidateMode(t *testing.T) {
+    folder := t.TempDir()
+    file := filepath.Join(folder, "messages.json")
+    missing := filepath.Join(folder, "missing")
+    err := os.WriteFile(file, []byte("[]"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        mode   string
+        folder string
+        port   string
+        err    string
+    }{
+        {name: "watch", mode: modeWatch, folder: folder},
+        {name: "http", mode: modeHttp, port: "8080"},
+        {name: "both", mode: modeBoth, folder: folder, port: "8080"},
+        {name: "unknown mode", mode: "serve", err: static.INVALID_MODE},
+        {name: "watch without folder", mode: modeWatch, err: static.MISSING_FOLDER},
+        {name: "watch of a file", mode: modeWatch, folder: file, err: static.NOT_A_FOLDER},
+        {name: "watch of a missing folder", mode: modeWatch, folder: missing, err: "no such file"},
+        {name: "http without port", mode: modeHttp, err: static.MISSING_PORT},
+        {name: "port that is not a number", mode: modeHttp, port: "http", err: static.INVALID_PORT},
+        {name: "port out of range", mode: modeHttp, port: "65536", err: static.INVALID_PORT},
+        {name: "both without port", mode: modeBoth, folder: folder, err: static.MISSING_PORT},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg = config.Default()
+            cfg.Mode, cfg.Folder, cfg.Port = tt.mode, tt.folder, tt.port
+
+            err := validateMode()
+            if tt.err == "" {
+                if err != nil {
+                    t.Errorf("expected no error, got %v", err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Errorf("expected %q, got %v", tt.err, err)
+            }
+        })
+    }
+}
+
+// The interactive prompts check their answers with the same functions as the flags
+func TestPromptValidators(t *testing.T) {
+    folder := t.TempDir()
+
+    if err := validateFolder(folder); err != nil {
+        t.Errorf("expected %s to be a folder to watch, got %v", folder, err)
+    }
+    if err := validateFolder(""); err == nil || err.Error() != static.MISSING_FOLDER {
+        t.Errorf("expected an empty folder to be rejected, got %v", err)
+    }
+    if err := validatePort("8080"); err != nil {
+        t.Errorf("expected 8080 to be a port, got %v", err)
+    }
+    if err := validatePort("0"); err == nil || !strings.Contains(err.Error(), static.INVALID_PORT) {
+        t.Errorf("expected port 0 to be rejected, got %v", err)
+    }
+}
+
+func TestHttpSendsJson(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := utf16le(`[{"recipient": "Alice Smith", "content": "full name works"}]`)
+    rec := post(t, outbox, "application/json", body)
+
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 1 || sent[0].To != aliceJID {
+        t.Fatalf("expected one message to %v, got %v", aliceJID, sent)
+    }
+}
+
+func TestHttpSendsUtf8(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    // An odd byte count and non-ASCII text, which used to be read as UTF-16
+    body := `[{"recipient": "Alice", "content": "Olá, ação!"}]`
+    if len(body)%2 == 0 {
+        body += " "
+    }
+    rec := post(t, outbox, "application/json", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 1 || sent[0].Message.GetConversation() != "Olá, ação!" {
+        t.Errorf("expected the UTF-8 content to be kept, got %+v", sent)
+    }
+}
+
+func TestHttpSendsWithCharset(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "- recipient: Alice\n  content: \"Ol\xe1\"\n"
+    rec := post(t, outbox, "text/yaml; charset=iso-8859-1", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    if sent := fake.Sent(); len(sent) != 1 || sent[0].Message.GetConversation() != "Olá" {
+        t.Errorf("expected the Latin-1 content to be decoded, got %+v", sent)
+    }
+
+    rec = post(t, outbox, "text/yaml; charset=klingon", []byte(body))
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Errorf("expected status %d for an unknown charset, got %d", http.StatusUnprocessableEntity, rec.Code)
+    }
+}
+
+func TestHttpSendsCsv(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "recipient;content\nAlice;\"Hello,\nAlice\"\nOps;deploy done\n"
+    rec := post(t, outbox, "text/csv; charset=utf-8", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 || sent[0].Message.GetConversation() != "Hello,\nAlice" || sent[1].To != opsJID {
+        t.Errorf("expected both rows to be sent, got %+v", sent)
+    }
+
+    rec = post(t, outbox, "text/csv", []byte("recipient,content\nAlice,hi\nBob,\n"))
+    res := decodeResponse(t, rec)
+    if rec.Code != http.StatusUnprocessableEntity || !strings.HasPrefix(res["error"].(string), "row 3:") {
+        t.Errorf("expected the error to cite row 3, got %d: %s", rec.Code, rec.Body.String())
+    }
+}
+
+func TestHttpSendsAttachment(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "- recipient: Bob\n  content: a picture\n  attachment: " + pngBase64 + "\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    if len(fake.Uploads()) != 1 {
+        t.Fatalf("expected one upload, got %d", len(fake.Uploads()))
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 1 {
+        t.Fatalf("expected one sent message, got %d", len(sent))
+    }
+    image := sent[0].Message.GetImageMessage()
+    if image == nil {
+        t.Fatalf("expected an image message, got %v", sent[0].Message)
+    }
+    if image.GetCaption() != "a picture" || image.GetMimetype() != "image/png" {
+        t.Errorf("unexpected image caption %q and mimetype %q", image.GetCaption(), image.GetMimetype())
+    }
+}
+
+func TestHttpSendsAttachmentSources(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    png, err := base64.StdEncoding.DecodeString(pngBase64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg.MediaRoot = t.TempDir()
+    err = os.WriteFile(filepath.Join(cfg.MediaRoot, "logo.png"), png, 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write(png)
+    }))
+    defer server.Close()
+
+    body := "- recipient: Alice\n  content: from a file\n  attachment_path: logo.png\n" +
+        "- recipient: Bob\n  attachment_url: " + server.URL + "/logo.png\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 || sent[0].Message.GetImageMessage() == nil || sent[1].Message.GetImageMessage() == nil {
+        t.Fatalf("expected two images, got %+v", sent)
+    }
+    if sent[0].Message.GetImageMessage().GetCaption() != "from a file" {
+        t.Errorf("unexpected caption %q", sent[0].Message.GetImageMessage().GetCaption())
+    }
+    for _, upload := range fake.Uploads() {
+        if string(upload) != string(png) {
+            t.Errorf("expected the PNG to be uploaded, got %d bytes", len(upload))
+        }
+    }
+
+    rec = post(t, outbox, "text/yaml", []byte("- recipient: Alice\n  attachment_path: ../../etc/passwd\n"))
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Errorf("expected a path outside the media root to be rejected, got %d", rec.Code)
+    }
+
+    cfg.MediaRoot = ""
+    rec = post(t, outbox, "text/yaml", []byte("- recipient: Alice\n  attachment_path: logo.png\n"))
+    if res := decodeResponse(t, rec); rec.Code != http.StatusUnprocessableEntity ||
+        !strings.Contains(res["error"].(string), static.NO_MEDIA_ROOT) {
+        t.Errorf("expected attachment_path to need a media root, got %d: %s", rec.Code, rec.Body.String())
+    }
+}
+
+// Builds a multipart/form-data body, fields without a file name are plain form fields
+func multipartBody(t *testing.T, parts []multipartField) (string, []byte) {
+    t.Helper()
+
+    var body bytes.Buffer
+    writer := multipart.NewWriter(&body)
+    for _, p := range parts {
+        header := textproto.MIMEHeader{}
+        disposition := fmt.Sprintf("form-data; name=%q", p.name)
+        if p.filename != "" {
+            disposition += fmt.Sprintf("; filename=%q", p.filename)
+        }
+        header.Set("Content-Disposition", disposition)
+        if p.contentType != "" {
+            header.Set("Content-Type", p.contentType)
+        }
+
+        w, err := writer.CreatePart(header)
+        if err != nil {
+            t.Fatal(err)
+        }
+        w.Write(p.data)
+    }
+    writer.Close()
+
+    return writer.FormDataContentType(), body.Bytes()
+}
+
+type multipartField struct {
+    name        string
+    filename    string
+    contentType string
+    data        []byte
+}
+
+// Removes the uploaded files as their messages are done until the test ends, cfg has to be set up first
+func startCleanUploads(t *testing.T, outbox *queue.Queue) {
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(cancel)
+    cleanUploads(ctx, outbox)
+}
+
+// Waits for the uploads folder to be down to n files and returns their names
+func waitUploads(t *testing.T, n int) []string {
+    t.Helper()
+
+    var names []string
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        entries, err := os.ReadDir(uploadDir())
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            t.Fatal(err)
+        }
+        names = names[:0]
+        for _, entry := range entries {
+            names = append(names, entry.Name())
+        }
+        if len(names) <= n || time.Now().After(deadline) {
+            return names
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestHttpSendsMultipart(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    cfg.MediaRoot = t.TempDir()
+    startCleanUploads(t, outbox)
+
+    png, err := base64.StdEncoding.DecodeString(pngBase64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    contentType, body := multipartBody(t, []multipartField{
+        {name: "messages", data: []byte(`[
+            {"recipient": "Alice", "content": "the logo", "attachment_part": "logo"},
+            {"recipient": "Bob", "content": "just text"}
+        ]`)},
+        {name: "note", data: []byte("plain fields are ignored")},
+        {name: "logo", filename: "logo.png", contentType: "image/png", data: png},
+    })
+    rec := post(t, outbox, contentType, body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 || sent[0].Message.GetImageMessage().GetCaption() != "the logo" ||
+        sent[1].Message.GetConversation() != "just text" {
+        t.Fatalf("expected an image and a text, got %+v", sent)
+    }
+    if uploads := fake.Uploads(); len(uploads) != 1 || !bytes.Equal(uploads[0], png) {
+        t.Errorf("expected the PNG part to be uploaded, got %d uploads", len(uploads))
+    }
+
+    // The outbox keeps the path of the part, whose file is removed once the message is sent
+    id := int64(decodeResponse(t, rec)["messages"].([]any)[0].(map[string]any)["id"].(float64))
+    item, err := outbox.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if item.Message.Attachment != "" || filepath.Dir(item.Message.AttachmentPath) != uploadDir() {
+        t.Errorf("expected the part to be queued by path, got %+v", item.Message)
+    }
+    if names := waitUploads(t, 0); len(names) != 0 {
+        t.Errorf("expected the uploaded file to be removed, got %v", names)
+    }
+
+    // The messages can be a file in any supported format too
+    contentType, body = multipartBody(t, []multipartField{
+        {name: "report", filename: "july.pdf", data: []byte("%PDF-1.4\n")},
+        {name: "messages", filename: "messages.yaml", data: []byte("- recipient: Ops\n  attachment_part: report\n")},
+    })
+    rec = post(t, outbox, contentType, body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    if sent := fake.Sent(); len(sent) != 3 || sent[2].Message.GetDocumentMessage().GetFileName() != "july.pdf" {
+        t.Errorf("expected a document named after its part for Ops, got %+v", sent)
+    }
+}
+
+func TestHttpSendsAttachmentsInOrder(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    cfg.MediaRoot = t.TempDir()
+    startCleanUploads(t, outbox)
+
+    png, err := base64.StdEncoding.DecodeString(pngBase64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/logo.png" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Write(png)
+    }))
+    defer server.Close()
+
+    messages := fmt.Sprintf(`[{
+        "recipient": "Ops",
+        "content": "July report",
+        "attachments": [{"part": "cover"}, {"url": "%[1]s/missing.png"}, {"url": "%[1]s/logo.png"}]
+    }]`, server.URL)
+    contentType, body := multipartBody(t, []multipartField{
+        {name: "messages", contentType: "application/json", data: []byte(messages)},
+        {name: "cover", filename: "cover.png", data: png},
+    })
+    rec := post(t, outbox, contentType, body)
+
+    // One broken attachment fails the request but not the others
+    res := decodeResponse(t, rec)
+    if rec.Code != http.StatusInternalServerError || res["error"] != static.SEND_FAILED {
+        t.Fatalf("expected the missing attachment to fail, got %d: %s", rec.Code, rec.Body.String())
+    }
+    results := res["messages"].([]any)
+    expected := []string{queue.StatusSent, queue.StatusFailed, queue.StatusSent}
+    if len(results) != len(expected) {
+        t.Fatalf("expected one result per attachment, got %v", results)
+    }
+    for i, status := range expected {
+        result := results[i].(map[string]any)
+        if result["attachment"] != float64(i+1) || result["status"] != status {
+            t.Errorf("attachment %d: expected %s, got %v", i+1, status, result)
+        }
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 {
+        t.Fatalf("expected two images, got %+v", sent)
+    }
+    if sent[0].Message.GetImageMessage().GetCaption() != "July report" || sent[1].Message.GetImageMessage().GetCaption() != "" {
+        t.Errorf("expected the caption on the first attachment only, got %+v", sent)
+    }
+    if names := waitUploads(t, 0); len(names) != 0 {
+        t.Errorf("expected the uploaded file to be removed, got %v", names)
+    }
+}
+
+func TestHttpKeepsUploadsUntilDone(t *testing.T) {
+    _, outbox := newTestEnv(t)
+
+    // Without a media root the parts are written next to zap.db
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.Chdir(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Chdir(wd) })
+    startCleanUploads(t, outbox)
+
+    contentType, body := multipartBody(t, []multipartField{
+        {name: "messages", data: []byte(`[{"recipient": "Alice", "delay": "1h", "attachment_part": "report"}]`)},
+        {name: "report", filename: "july.pdf", data: []byte("%PDF-1.4\n")},
+        {name: "unused", filename: "unused.txt", data: []byte("never sent")},
+    })
+    rec := post(t, outbox, contentType, body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    // The part no message uses goes, the other one stays while its message is scheduled
+    err = uploads.clean(outbox, uploadDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    id := int64(decodeResponse(t, rec)["messages"].([]any)[0].(map[string]any)["id"].(float64))
+    item, err := outbox.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := waitUploads(t, 1)
+    if len(names) != 1 || names[0] != filepath.Base(item.Message.AttachmentPath) || filepath.Ext(names[0]) != ".pdf" {
+        t.Fatalf("expected only the scheduled part to be kept, got %v", names)
+    }
+
+    _, err = outbox.Cancel(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names := waitUploads(t, 0); len(names) != 0 {
+        t.Errorf("expected the part to be removed once its message is cancelled, got %v", names)
+    }
+}
+
+func TestHttpMultipartErrors(t *testing.T) {
+    messages := multipartField{name: "messages", data: []byte(`[{"recipient": "Alice", "attachment_part": "logo"}]`)}
+    // Limits in MB, the parts are sized against them
+    tests := []struct {
+        name           string
+        parts          []multipartField
+        mediaMaxSize   int
+        requestMaxSize int
+        status         int
+    }{
+        {
+            name:   "no messages field",
+            parts:  []multipartField{{name: "logo", filename: "a.png", data: []byte("x")}},
+            status: http.StatusUnprocessableEntity,
+        },
+        {name: "unknown part", parts: []multipartField{messages}, status: http.StatusUnprocessableEntity},
+        {
+            name: "repeated part",
+            parts: []multipartField{
+                messages,
+                {name: "logo", filename: "a.png", data: []byte("x")},
+                {name: "logo", filename: "b.png", data: []byte("y")},
+            },
+            status: http.StatusUnprocessableEntity,
+        },
+        {
+            name:   "part over the size limit",
+            parts:        []multipartField{messages, {name: "logo", filename: "a.png", data: make([]byte, 1<<20+1)}},
+            mediaMaxSize: 1,
+            status:       http.StatusRequestEntityTooLarge,
+        },
+        {
+            name:           "request over the size limit",
+            parts:          []multipartField{messages, {name: "logo", filename: "a.png", data: make([]byte, 2<<20)}},
+            requestMaxSize: 1,
+            status:         http.StatusRequestEntityTooLarge,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake, outbox := newTestEnv(t)
+            cfg.MediaRoot = t.TempDir()
+            startCleanUploads(t, outbox)
+            if tt.mediaMaxSize != 0 {
+                cfg.MediaMaxSize = tt.mediaMaxSize
+            }
+            if tt.requestMaxSize != 0 {
+                cfg.RequestMaxSize = tt.requestMaxSize
+            }
+
+            contentType, body := multipartBody(t, tt.parts)
+            rec := post(t, outbox, contentType, body)
+            if rec.Code != tt.status {
+                t.Errorf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+            }
+            if len(fake.Sent()) != 0 {
+                t.Errorf("expected nothing to be sent, got %+v", fake.Sent())
+            }
+            if names := waitUploads(t, 0); len(names) != 0 {
+                t.Errorf("expected the uploaded files to be removed, got %v", names)
+            }
+        })
+    }
+
+    _, outbox := newTestEnv(t)
+    rec := post(t, outbox, "application/json", []byte(`[{"recipient": "Alice", "attachment_part": "logo"}]`))
+    if res := decodeResponse(t, rec); rec.Code != http.StatusUnprocessableEntity ||
+        !strings.Contains(res["error"].(string), static.NO_MULTIPART) {
+        t.Errorf("expected attachment_part to need a multipart request, got %d: %s", rec.Code, rec.Body.String())
+    }
+}
+
+func TestHttpErrors(t *testing.T) {
+    tests := []struct {
+        name        string
+        contentType string
+        body        string
+        setup       func(f *api.Fake)
+        status      int
+        sent        int
+    }{
+        {
+            name:        "unknown content type",
+            contentType: "text/plain",
+            body:        "hello",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "malformed body",
+            contentType: "text/yaml",
+            body:        "recipient: [",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "empty field",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "invalid phone",
+            contentType: "text/yaml",
+            body:        "- phone: \"12\"\n  content: hi\n",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "invalid jid",
+            contentType: "text/yaml",
+            body:        "- jid: 5511999990001@example.com\n  content: hi\n",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "invalid send_at",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n  send_at: tomorrow\n",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "send_at and delay",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n  send_at: 2030-01-01T08:00:00Z\n  delay: 1h\n",
+            status:      http.StatusUnprocessableEntity,
+        },
+        {
+            name:        "unknown recipient",
+            contentType: "text/yaml",
+            body:        "- recipient: Carol\n  content: hi\n",
+            status:      http.StatusInternalServerError,
+        },
+        {
+            name:        "send failure",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n",
+            setup: func(f *api.Fake) {
+                f.SendErr = errors.New("connection lost")
+            },
+            status: http.StatusInternalServerError,
+        },
+        {
+            name:        "send failure for one recipient",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n- recipient: Bob\n  content: hi\n",
+            setup: func(f *api.Fake) {
+                f.SendErrFor[bobJID] = errors.New("not allowed")
+            },
+            status: http.StatusInternalServerError,
+            sent:   1,
+        },
+        {
+            name:        "upload failure",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n  attachment: " + pngBase64 + "\n",
+            setup: func(f *api.Fake) {
+                f.UploadErr = errors.New("upload refused")
+            },
+            status: http.StatusInternalServerError,
+        },
+        {
+            name:        "contacts failure",
+            contentType: "text/yaml",
+            body:        "- recipient: Alice\n  content: hi\n",
+            setup: func(f *api.Fake) {
+                f.ContactsErr = errors.New("store closed")
+            },
+            status: http.StatusInternalServerError,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake, outbox := newTestEnv(t)
+            if tt.setup != nil {
+                tt.setup(fake)
+            }
+
+            rec := post(t, outbox, tt.contentType, []byte(tt.body))
+            if rec.Code != tt.status {
+                t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+            }
+            if res := decodeResponse(t, rec); res["status"] != "error" {
+                t.Errorf("expected error status, got %v", res["status"])
+            }
+            if len(fake.Sent()) != tt.sent {
+                t.Errorf("expected %d sent messages, got %d", tt.sent, len(fake.Sent()))
+            }
+        })
+    }
+}
+
+func TestHttpSendsToPhoneAndJid(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "- phone: +55 11 99999-0099\n  content: by phone\n- jid: " + opsJID.String() + "\n  content: by jid\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 {
+        t.Fatalf("expected 2 sent messages, got %d", len(sent))
+    }
+    if sent[0].To != types.NewJID("5511999990099", types.DefaultUserServer) {
+        t.Errorf("expected message to the phone JID, got %v", sent[0].To)
+    }
+    if sent[1].To != opsJID {
+        t.Errorf("expected message to %v, got %v", opsJID, sent[1].To)
+    }
+}
+
+func TestHttpSendsToAlias(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    path := filepath.Join(t.TempDir(), "aliases.yaml")
+    err := os.WriteFile(path, []byte("ops-oncall:\n  - Alice\n  - "+bobJID.String()+"\n  - Ops\n"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    aliases, err = alias.Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rec := post(t, outbox, "text/yaml", []byte("- recipient: ops-oncall\n  content: paging\n"))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    res := decodeResponse(t, rec)
+    if res["amount"] != float64(3) {
+        t.Errorf("expected one result per target, got %v", res["messages"])
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 3 || sent[0].To != aliceJID || sent[1].To != bobJID || sent[2].To != opsJID {
+        t.Errorf("expected the message to be sent to every target in order, got %+v", sent)
+    }
+}
+
+func TestHttpRendersTemplates(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    dir := t.TempDir()
+    err := os.WriteFile(filepath.Join(dir, "invoice_due.tmpl"), []byte("Invoice of ${{.amount}} is due"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    templateStore = templates.NewStore(dir)
+
+    body := `[{"recipient": "Alice", "template": "invoice_due", "vars": {"amount": "120"}}]`
+    rec := post(t, outbox, "application/json", utf16le(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 1 || sent[0].Message.GetConversation() != "Invoice of $120 is due" {
+        t.Errorf("expected the rendered template to be sent, got %+v", sent)
+    }
+}
+
+func TestHttpReportsTemplateErrors(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    templateStore = templates.NewStore(t.TempDir())
+
+    body := "- recipient: Alice\n  content: fine\n" +
+        "- recipient: Bob\n  template: missing\n" +
+        "- recipient: Bob\n  content: \"Hi {{.name}}\"\n  vars: {other: x}\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+    }
+
+    var res struct {
+        Errors []struct {
+            Index int    `json:"index"`
+            Field string `json:"field"`
+        } `json:"errors"`
+    }
+    err := json.Unmarshal(rec.Body.Bytes(), &res)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(res.Errors) != 2 || res.Errors[0].Index != 1 || res.Errors[0].Field != "template" ||
+        res.Errors[1].Index != 2 || res.Errors[1].Field != "vars" {
+        t.Errorf("expected errors on the template of message 1 and the vars of message 2, got %+v", res.Errors)
+    }
+    if len(fake.Sent()) != 0 {
+        t.Errorf("expected nothing to be queued, got %+v", fake.Sent())
+    }
+}
+
+func TestHttpReportsEachMessage(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    fake.SendErrFor[aliceJID] = errors.New("not allowed")
+
+    body := "- recipient: Alice\n  content: first\n- recipient: Bob\n  content: second\n"
+    rec := post(t, outbox, "text/yaml", []byte(body))
+    if rec.Code != http.StatusInternalServerError {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusInternalServerError, rec.Code, rec.Body.String())
+    }
+
+    var res struct {
+        Messages []messageResult `json:"messages"`
+    }
+    err := json.Unmarshal(rec.Body.Bytes(), &res)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(res.Messages) != 2 {
+        t.Fatalf("expected 2 results, got %v", res.Messages)
+    }
+    if res.Messages[0].Status != queue.StatusFailed || res.Messages[0].Error != "not allowed" {
+        t.Errorf("expected first message to fail, got %+v", res.Messages[0])
+    }
+    if res.Messages[1].Status != queue.StatusSent || res.Messages[1].Recipient != "Bob" {
+        t.Errorf("expected second message to be sent, got %+v", res.Messages[1])
+    }
+}
+
+func getMessage(t *testing.T, outbox *queue.Queue, id string) (int, messageStatus) {
+    t.Helper()
+
+    req := httptest.NewRequest(http.MethodGet, "/messages/"+id, nil)
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    var res struct {
+        Message messageStatus `json:"message"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &res)
+
+    return rec.Code, res.Message
+}
+
+func TestHttpMessageStatus(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    rec := post(t, outbox, "text/yaml", []byte("- recipient: Alice\n  content: hello\n"))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()[0]
+    fake.Emit(&events.Receipt{
+        MessageSource: types.MessageSource{Chat: aliceJID, Sender: aliceJID},
+        MessageIDs:    []types.MessageID{sent.ID},
+        Timestamp:     time.Now(),
+        Type:          types.ReceiptTypeDelivered,
+    })
+    fake.Emit(&events.Receipt{
+        MessageSource: types.MessageSource{Chat: aliceJID, Sender: aliceJID},
+        MessageIDs:    []types.MessageID{sent.ID},
+        Timestamp:     time.Now(),
+        Type:          types.ReceiptTypeRead,
+    })
+
+    code, status := getMessage(t, outbox, "1")
+    if code != http.StatusOK {
+        t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+    }
+    if status.Status != queue.StatusRead || status.WhatsappID != sent.ID || status.Recipient != "Alice" {
+        t.Errorf("unexpected message status %+v", status)
+    }
+    if len(status.History) != 5 {
+        t.Errorf("expected 5 history entries, got %v", status.History)
+    }
+
+    if code, _ := getMessage(t, outbox, "42"); code != http.StatusNotFound {
+        t.Errorf("expected status %d for unknown message, got %d", http.StatusNotFound, code)
+    }
+    if code, _ := getMessage(t, outbox, "abc"); code != http.StatusBadRequest {
+        t.Errorf("expected status %d for invalid ID, got %d", http.StatusBadRequest, code)
+    }
+}
+
+func TestHttpAsyncMessages(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader("- recipient: Bob\n  content: later\n"))
+    req.Header.Set("Content-Type", "text/yaml")
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    if rec.Code != http.StatusAccepted {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+    }
+
+    var res struct {
+        Messages []messageResult `json:"messages"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &res)
+    // The worker may pick the message up before the response is written, so it may be sending or sent already
+    if len(res.Messages) != 1 || res.Messages[0].ID == 0 || res.Messages[0].Status == queue.StatusFailed {
+        t.Fatalf("expected one accepted message, got %+v", res.Messages)
+    }
+
+    item := waitItem(t, outbox, res.Messages[0].ID)
+    if item.Status != queue.StatusSent || len(fake.Sent()) != 1 {
+        t.Errorf("expected the message to be sent in the background, got %+v", item)
+    }
+}
+
+func TestHttpWaitMessages(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    fake.SendErr = errors.New("offline")
+
+    req := httptest.NewRequest(http.MethodPost, "/messages?wait=true", strings.NewReader("- recipient: Bob\n  content: now\n"))
+    req.Header.Set("Content-Type", "text/yaml")
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    if rec.Code != http.StatusInternalServerError {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusInternalServerError, rec.Code, rec.Body.String())
+    }
+}
+
+func TestHttpSchedules(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := "- recipient: Alice\n  content: reminder\n  send_at: " + time.Now().Add(time.Hour).Format(time.RFC3339) +
+        "\n- recipient: Bob\n  content: now\n"
+    req := httptest.NewRequest(http.MethodPost, "/messages?wait=true", strings.NewReader(body))
+    req.Header.Set("Content-Type", "text/yaml")
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    var res struct {
+        Messages []messageResult `json:"messages"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &res)
+    if rec.Code != http.StatusCreated || len(res.Messages) != 2 {
+        t.Fatalf("expected status %d with 2 messages, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    if res.Messages[0].Status != queue.StatusScheduled || res.Messages[1].Status != queue.StatusSent {
+        t.Errorf("expected the first message scheduled and the second sent, got %+v", res.Messages)
+    }
+    if len(fake.Sent()) != 1 {
+        t.Errorf("expected only the unscheduled message to be sent, got %+v", fake.Sent())
+    }
+
+    req = httptest.NewRequest(http.MethodGet, "/schedules", nil)
+    rec = httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+    var list struct {
+        Schedules []scheduledMessage `json:"schedules"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &list)
+    if len(list.Schedules) != 1 || list.Schedules[0].ID != res.Messages[0].ID || list.Schedules[0].Content != "reminder" {
+        t.Fatalf("expected the reminder to be listed, got %s", rec.Body.String())
+    }
+
+    tests := []struct {
+        id     string
+        status int
+    }{
+        {id: "1", status: http.StatusOK},
+        {id: "1", status: http.StatusConflict},
+        {id: "2", status: http.StatusConflict},
+        {id: "99", status: http.StatusNotFound},
+        {id: "abc", status: http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(http.MethodDelete, "/schedules/"+tt.id, nil)
+        rec := httptest.NewRecorder()
+        newMux(outbox).ServeHTTP(rec, req)
+        if rec.Code != tt.status {
+            t.Errorf("DELETE /schedules/%s: expected status %d, got %d: %s", tt.id, tt.status, rec.Code, rec.Body.String())
+        }
+    }
+
+    _, status := getMessage(t, outbox, "1")
+    if status.Status != queue.StatusCancelled {
+        t.Errorf("expected the reminder to be cancelled, got %s", status.Status)
+    }
+}
+
+func TestHttpJobs(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    do := func(method string, target string, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, target, strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        rec := httptest.NewRecorder()
+        newMux(outbox).ServeHTTP(rec, req)
+
+        return rec
+    }
+
+    body := `{"name": "standup", "schedule": "0 9 * * 1-5", "timezone": "America/Sao_Paulo",
+        "message": {"recipient": "Ops", "content": "Standup of {{.run.Format \"02/01\"}} in {{.room}}", "vars": {"room": "A"}}}`
+    rec := do(http.MethodPost, "/jobs", body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    rec = do(http.MethodPost, "/jobs", `{"name": "broken", "schedule": "daily", "message": {"recipient": "Ops", "content": "hi"}}`)
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Errorf("expected an invalid schedule to be rejected, got %d: %s", rec.Code, rec.Body.String())
+    }
+
+    cfg.RequestMaxSize = 1
+    rec = do(http.MethodPost, "/jobs", `{"name": "big", "schedule": "@daily", "message": {"recipient": "Ops", "content": "`+
+        strings.Repeat("a", 1<<20)+`"}}`)
+    if rec.Code != http.StatusRequestEntityTooLarge {
+        t.Errorf("expected a job over the request size limit to be rejected, got %d", rec.Code)
+    }
+    cfg.RequestMaxSize = config.Default().RequestMaxSize
+
+    var list struct {
+        Jobs []jobs.Job `json:"jobs"`
+    }
+    rec = do(http.MethodGet, "/jobs", "")
+    json.Unmarshal(rec.Body.Bytes(), &list)
+    if len(list.Jobs) != 1 || list.Jobs[0].Name != "standup" || list.Jobs[0].NextRun.IsZero() {
+        t.Fatalf("expected the standup job with its next run, got %s", rec.Body.String())
+    }
+
+    // A run queues the job message rendered with the date of the run
+    err := runJob(list.Jobs[0], time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC), outbox)
+    if err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for len(fake.Sent()) == 0 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    sent := fake.Sent()
+    if len(sent) != 1 || sent[0].To != opsJID || sent[0].Message.GetConversation() != "Standup of 01/07 in A" {
+        t.Errorf("expected the rendered standup message to be sent to Ops, got %+v", sent)
+    }
+
+    rec = do(http.MethodDelete, "/jobs/standup", "")
+    if rec.Code != http.StatusOK {
+        t.Errorf("expected the job to be deleted, got %d: %s", rec.Code, rec.Body.String())
+    }
+    rec = do(http.MethodGet, "/jobs/standup", "")
+    if rec.Code != http.StatusNotFound {
+        t.Errorf("expected the deleted job not to be found, got %d: %s", rec.Code, rec.Body.String())
+    }
+}
+
+func TestRunJobWithoutContent(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    tests := []jobs.Job{
+        {
+            Name:     "lunch",
+            Schedule: "0 11 * * *",
+            Message: parser.Message{
+                Recipient: "Ops",
+                Kind:      parser.KindPoll,
+                Poll:      &parser.Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}},
+                Vars:      map[string]any{"room": "A"},
+            },
+        },
+        {
+            Name:     "logo",
+            Schedule: "0 9 * * 1",
+            Message:  parser.Message{Recipient: "Ops", Attachment: pngBase64, Filename: "logo.png"},
+        },
+    }
+
+    for _, job := range tests {
+        err := job.Validate()
+        if err != nil {
+            t.Fatalf("%s: %v", job.Name, err)
+        }
+        err = runJob(job, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC), outbox)
+        if err != nil {
+            t.Errorf("%s: expected the job to be queued, got %v", job.Name, err)
+        }
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for len(fake.Sent()) < 2 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    sent := fake.Sent()
+    if len(sent) != 2 || sent[0].Message.GetPollCreationMessage().GetName() != "Lunch?" ||
+        sent[1].Message.GetImageMessage() == nil {
+        t.Errorf("expected the poll and the image to be sent, got %+v", sent)
+    }
+}
+
+func getPoll(t *testing.T, outbox *queue.Queue, id string) (int, pollStatus) {
+    t.Helper()
+
+    req := httptest.NewRequest(http.MethodGet, "/polls/"+id, nil)
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    var res struct {
+        Poll pollStatus `json:"poll"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &res)
+
+    return rec.Code, res.Poll
+}
+
+func TestHttpPolls(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    body := `[
+        {"recipient": "Ops", "kind": "poll", "poll": {"question": "Lunch?", "options": ["Pizza", "Sushi", "Salad"]}},
+        {"recipient": "Bob", "content": "not a poll"}
+    ]`
+    rec := post(t, outbox, "application/json", []byte(body))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+
+    sent := fake.Sent()[0]
+    creation := sent.Message.GetPollCreationMessage()
+    if sent.To != opsJID || creation.GetName() != "Lunch?" || len(creation.GetOptions()) != 3 {
+        t.Fatalf("unexpected poll %+v", sent)
+    }
+
+    carol := types.NewJID("5511999990003", types.DefaultUserServer)
+    now := time.Now()
+    fake.Emit(api.Vote(sent.ID, opsJID, aliceJID, now, "Pizza"))
+    fake.Emit(api.Vote(sent.ID, opsJID, bobJID, now, "Pizza", "Salad"))
+    fake.Emit(api.Vote(sent.ID, opsJID, carol, now, "Sushi"))
+    // Carol changes her mind, then an older update of her vote comes in late
+    fake.Emit(api.Vote(sent.ID, opsJID, carol, now.Add(time.Second), "Salad"))
+    fake.Emit(api.Vote(sent.ID, opsJID, carol, now.Add(-time.Second), "Sushi"))
+    // Votes on messages that aren't ours are ignored
+    fake.Emit(api.Vote("OTHER", opsJID, aliceJID, now, "Sushi"))
+
+    code, poll := getPoll(t, outbox, "1")
+    if code != http.StatusOK {
+        t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+    }
+    if poll.ID != 1 || poll.Status != queue.StatusSent || poll.Question != "Lunch?" || poll.Voters != 3 {
+        t.Errorf("unexpected poll %+v", poll)
+    }
+    votes := map[string]int{}
+    for _, option := range poll.Options {
+        votes[option.Name] = option.Votes
+    }
+    if votes["Pizza"] != 2 || votes["Sushi"] != 0 || votes["Salad"] != 2 {
+        t.Errorf("unexpected votes %v", votes)
+    }
+
+    if code, _ := getPoll(t, outbox, "2"); code != http.StatusNotFound {
+        t.Errorf("expected status %d for a message that is not a poll, got %d", http.StatusNotFound, code)
+    }
+    if code, _ := getPoll(t, outbox, "42"); code != http.StatusNotFound {
+        t.Errorf("expected status %d for unknown message, got %d", http.StatusNotFound, code)
+    }
+    if code, _ := getPoll(t, outbox, "abc"); code != http.StatusBadRequest {
+        t.Errorf("expected status %d for invalid ID, got %d", http.StatusBadRequest, code)
+    }
+}
+
+func TestHttpReactions(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    fake.SendErrFor[bobJID] = errors.New("offline")
+
+    body := `[{"recipient": "Alice", "content": "hello"}, {"recipient": "Bob", "content": "hi"}]`
+    post(t, outbox, "application/json", []byte(body))
+
+    body = `[
+        {"kind": "reaction", "reaction": {"message": 1, "emoji": "👍"}},
+        {"kind": "reaction", "reaction": {"message": 2, "emoji": "👍"}},
+        {"kind": "reaction", "reaction": {"message": 42, "emoji": "👍"}}
+    ]`
+    rec := post(t, outbox, "application/json", []byte(body))
+    res := decodeResponse(t, rec)
+    messages, _ := res["messages"].([]any)
+    if len(messages) != 3 {
+        t.Fatalf("expected 3 results, got %s", rec.Body.String())
+    }
+    statuses := []string{queue.StatusSent, queue.StatusFailed, queue.StatusFailed}
+    for i, status := range statuses {
+        result := messages[i].(map[string]any)
+        if result["status"] != status {
+            t.Errorf("reaction %d: expected status %s, got %v", i+1, status, result)
+        }
+    }
+    if errMsg, _ := messages[1].(map[string]any)["error"].(string); !strings.Contains(errMsg, static.NOT_SENT) {
+        t.Errorf("expected a reaction to an unsent message to fail with %q, got %q", static.NOT_SENT, errMsg)
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 2 {
+        t.Fatalf("expected the message and one reaction to be sent, got %d", len(sent))
+    }
+    reaction := sent[1].Message.GetReactionMessage()
+    if sent[1].To != aliceJID || reaction.GetKey().GetID() != string(sent[0].ID) || reaction.GetText() != "👍" {
+        t.Errorf("unexpected reaction %+v", sent[1])
+    }
+}
+
+func TestHttpReactionToScheduledMessage(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    post(t, outbox, "application/json", []byte(`[{"recipient": "Alice", "content": "later", "delay": "1h"}]`))
+
+    // The original endpoint waits for the messages, but not for the ones held back by a scheduled message
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    body := `[{"kind": "reaction", "reaction": {"message": 1, "emoji": "👍"}}, {"recipient": "Bob", "content": "now"}]`
+    req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)).WithContext(ctx)
+    req.Header.Set("Content-Type", "application/json")
+    rec := httptest.NewRecorder()
+    newMux(outbox).ServeHTTP(rec, req)
+
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    var res struct {
+        Messages []messageResult `json:"messages"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &res)
+    if len(res.Messages) != 2 || res.Messages[0].Status != queue.StatusQueued ||
+        res.Messages[1].Status != queue.StatusSent {
+        t.Errorf("expected the reaction to stay queued and the other message to be sent, got %+v", res.Messages)
+    }
+    if len(fake.Sent()) != 1 {
+        t.Errorf("expected only the other message to be sent, got %d", len(fake.Sent()))
+    }
+}
+
+func TestHttpReplies(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    post(t, outbox, "application/json", []byte(`[{"recipient": "Ops", "content": "Disk full on db1"}]`))
+
+    body := `[
+        {"recipient": "Ops", "content": "@Alice can you look?", "reply_to": 1, "mentions": ["Alice", "+5511999990002"]},
+        {"recipient": "Alice", "content": "Are you on it?", "reply_to": 1},
+        {"recipient": "Ops", "content": "hi", "mentions": ["Carol"]},
+        {"recipient": "Ops", "content": "hi", "reply_to": 42}
+    ]`
+    rec := post(t, outbox, "application/json", []byte(body))
+    res := decodeResponse(t, rec)
+    messages, _ := res["messages"].([]any)
+    if len(messages) != 4 {
+        t.Fatalf("expected 4 results, got %s", rec.Body.String())
+    }
+    statuses := []string{queue.StatusSent, queue.StatusSent, queue.StatusFailed, queue.StatusFailed}
+    for i, status := range statuses {
+        result := messages[i].(map[string]any)
+        if result["status"] != status {
+            t.Errorf("message %d: expected status %s, got %v", i+1, status, result)
+        }
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 3 {
+        t.Fatalf("expected 3 messages to be sent, got %d", len(sent))
+    }
+    text := sent[1].Message.GetExtendedTextMessage()
+    info := text.GetContextInfo()
+    if text.GetText() != "@5511999990001 can you look? @5511999990002" {
+        t.Errorf("unexpected text %q", text.GetText())
+    }
+    if info.GetStanzaID() != string(sent[0].ID) || info.GetParticipant() != api.FakeOwnID.String() ||
+        info.GetQuotedMessage().GetConversation() != "Disk full on db1" || info.RemoteJID != nil {
+        t.Errorf("unexpected reply context %v", info)
+    }
+    mentioned := []string{aliceJID.String(), bobJID.String()}
+    if strings.Join(info.GetMentionedJID(), ",") != strings.Join(mentioned, ",") {
+        t.Errorf("expected mentions %v, got %v", mentioned, info.GetMentionedJID())
+    }
+
+    // Replying in another chat quotes the message from the chat it was sent to
+    info = sent[2].Message.GetExtendedTextMessage().GetContextInfo()
+    if sent[2].To != aliceJID || info.GetStanzaID() != string(sent[0].ID) || info.GetRemoteJID() != opsJID.String() {
+        t.Errorf("unexpected private reply %+v", sent[2])
+    }
+}
+
+func TestWebhook(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    calls := make(chan webhookEvent, 16)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var event webhookEvent
+        json.NewDecoder(r.Body).Decode(&event)
+        calls <- event
+    }))
+    defer server.Close()
+    notifyWebhook(outbox, server.URL)
+
+    post(t, outbox, "text/yaml", []byte("- recipient: Alice\n  content: hello\n"))
+    fake.Emit(&events.Receipt{
+        MessageIDs: []types.MessageID{fake.Sent()[0].ID},
+        Timestamp:  time.Now(),
+        Type:       types.ReceiptTypeDelivered,
+    })
+
+    var statuses []string
+    timeout := time.After(5 * time.Second)
+    for len(statuses) < 4 {
+        select {
+        case event := <-calls:
+            if event.ID != 1 || event.Recipient != "Alice" {
+                t.Errorf("unexpected webhook event %+v", event)
+            }
+            statuses = append(statuses, event.Status)
+        case <-timeout:
+            t.Fatalf("webhook not called, got %v", statuses)
+        }
+    }
+
+    expected := []string{queue.StatusQueued, queue.StatusSending, queue.StatusSent, queue.StatusDelivered}
+    if strings.Join(statuses, ",") != strings.Join(expected, ",") {
+        t.Errorf("expected webhook statuses %v, got %v", expected, statuses)
+    }
+}
+
+func TestWebhookSlowAndFailing(t *testing.T) {
+    _, outbox := newTestEnv(t)
+
+    release := make(chan struct{})
+    var mu sync.Mutex
+    var events []webhookEvent
+    calls := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        calls++
+        call := calls
+        mu.Unlock()
+
+        // Stuck until every message was sent, then down for a couple of attempts
+        if call == 1 {
+            <-release
+        }
+        if call <= 3 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+
+        var event webhookEvent
+        json.NewDecoder(r.Body).Decode(&event)
+        mu.Lock()
+        events = append(events, event)
+        mu.Unlock()
+    }))
+    defer server.Close()
+    defer close(release)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    w := &webhook{
+        outbox:     outbox,
+        url:        server.URL,
+        client:     server.Client(),
+        backoff:    time.Millisecond,
+        maxBackoff: 5 * time.Millisecond,
+        poll:       10 * time.Millisecond,
+    }
+    err := w.start(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Far more changes than a subscription holds
+    var body strings.Builder
+    for i := 0; i < 50; i++ {
+        body.WriteString("- recipient: Alice\n  content: hello\n")
+    }
+    rec := post(t, outbox, "text/yaml", []byte(body.String()))
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+    }
+    release <- struct{}{}
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        mu.Lock()
+        n := len(events)
+        mu.Unlock()
+        if n >= 150 || time.Now().After(deadline) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    if len(events) != 150 {
+        t.Fatalf("expected every change of the 50 messages to be posted, got %d", len(events))
+    }
+    statuses := []string{queue.StatusQueued, queue.StatusSending, queue.StatusSent}
+    seen := map[int64]int{}
+    for _, event := range events {
+        if event.Status != statuses[seen[event.ID]] {
+            t.Fatalf("expected changes in order, got %s for message %d after %d changes", event.Status, event.ID,
+                seen[event.ID])
+        }
+        seen[event.ID]++
+    }
+}
+
+// Writes a file in a temporary folder and returns the event the watcher would emit for it
+func writeEvent(t *testing.T, name string, body []byte) watcher.Event {
+    t.Helper()
+
+    path := filepath.Join(t.TempDir(), name)
+    err := os.WriteFile(path, body, 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return watcher.Event{Op: watcher.Create, Path: path, FileInfo: info}
+}
+
+func TestWatchSendsFile(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    event := writeEvent(t, "messages.yml", []byte("- recipient: Bob\n  content: from a file\n"))
+    doEvent(event, outbox)
+
+    if item := waitItem(t, outbox, 1); item.Status != queue.StatusSent {
+        t.Fatalf("expected message to be sent, got %+v", item)
+    }
+
+    sent := fake.Sent()
+    if len(sent) != 1 || sent[0].To != bobJID || sent[0].Message.GetConversation() != "from a file" {
+        t.Fatalf("unexpected sent messages %v", sent)
+    }
+    if _, err := os.Stat(event.Path); err != nil {
+        t.Errorf("file should be kept without removeOnSend: %v", err)
+    }
+}
+
+func TestWatchSendsAttachmentPath(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+
+    event := writeEvent(t, "messages.yml", []byte("- recipient: Bob\n  attachment_path: media/report.pdf\n"))
+    cfg.Folder = filepath.Dir(event.Path)
+    err := os.Mkdir(filepath.Join(cfg.Folder, "media"), 0o755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.WriteFile(filepath.Join(cfg.Folder, "media", "report.pdf"), []byte("%PDF-1.4\n"), 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    doEvent(event, outbox)
+
+    if item := waitItem(t, outbox, 1); item.Status != queue.StatusSent {
+        t.Fatalf("expected message to be sent, got %+v", item)
+    }
+    if sent := fake.Sent(); len(sent) != 1 || sent[0].Message.GetDocumentMessage() == nil {
+        t.Errorf("expected a document, got %+v", sent)
+    }
+}
+
+func TestWatchRemovesOnSend(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    cfg.RemoveOnSend = true
+
+    event := writeEvent(t, "messages.json", utf16le(`[{"recipient": "Ops", "content": "bye"}]`))
+    doEvent(event, outbox)
+
+    if _, err := os.Stat(event.Path); !os.IsNotExist(err) {
+        t.Errorf("file should have been removed, stat returned %v", err)
+    }
+
+    waitItem(t, outbox, 1)
+    if len(fake.Sent()) != 1 {
+        t.Fatalf("expected one sent message, got %d", len(fake.Sent()))
+    }
+}
+
+func TestWatchRetriesFailedSends(t *testing.T) {
+    fake, outbox := newTestEnv(t)
+    fake.SendErr = errors.New("offline")
+
+    doEvent(writeEvent(t, "messages.yaml", []byte("- recipient: Alice\n  content: hi\n")), outbox)
+
+    item := waitItem(t, outbox, 1)
+    if item.Status != queue.StatusFailed || item.Attempts != 2 || item.LastError != "offline" {
+        t.Errorf("expected message to fail after 2 attempts, got %+v", item)
+    }
+}
+
+func TestWatchIgnoresFiles(t *testing.T) {
+    tests := []struct {
+        name string
+        file string
+        body string
+    }{
+        {name: "unknown extension", file: "notes.txt", body: "- recipient: Alice\n  content: hi\n"},
+        {name: "empty file", file: "empty.yaml", body: ""},
+        {name: "invalid content", file: "broken.yaml", body: "recipient: ["},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, outbox := newTestEnv(t)
+
+            doEvent(writeEvent(t, tt.file, []byte(tt.body)), outbox)
+            if _, err := outbox.Get(1); err == nil {
+                t.Errorf("expected nothing to be queued")
+            }
+        })
+    }
+}
+
+func TestSendMessageRecipientNotFound(t *testing.T) {
+    fake, _ := newTestEnv(t)
+
+    resolver := api.NewResolver(fake, api.ResolverOptions{})
+    _, err := sendMessage(parser.Message{Recipient: "Nobody", Content: "hi"}, fake, resolver, nil)
+    if err == nil || !strings.Contains(err.Error(), static.RECIPIENT_NOT_FOUND) {
+        t.Errorf("expected %q error, got %v", static.RECIPIENT_NOT_FOUND, err)
+    }
+}
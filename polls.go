@@ -0,0 +1,49 @@
+package main
+
+import (
+    "github.com/rs/zerolog/log"
+    "go.mau.fi/whatsmeow/types/events"
+
+    "github.com/watchzap/internal/api"
+    "github.com/watchzap/internal/polls"
+    "github.com/watchzap/internal/queue"
+)
+
+// Listens for votes on the polls we sent and records the latest one of each voter
+// Votes arrive as encrypted poll updates, which only the device that sent the poll can read
+func trackPollVotes(messenger api.Messenger, outbox *queue.Queue, store *polls.Store) {
+    messenger.AddEventHandler(func(evt any) {
+        msg, ok := evt.(*events.Message)
+        if !ok {
+            return
+        }
+        update := msg.Message.GetPollUpdateMessage()
+        if update == nil {
+            return
+        }
+
+        // Polls sent by someone else, or before the outbox existed, are none of our business
+        item, err := outbox.GetByWhatsappID(update.GetPollCreationMessageKey().GetID())
+        if err != nil || item.Message.Poll == nil {
+            return
+        }
+
+        vote, err := messenger.DecryptPollVote(msg)
+        if err != nil {
+            log.Warn().Err(err).Int64("id", item.ID).Msg("WZ: Could not decrypt poll vote")
+            return
+        }
+
+        voter := msg.Info.Sender.ToNonAD().String()
+        err = store.Record(item.ID, polls.Vote{
+            Voter:   voter,
+            Options: polls.OptionNames(*item.Message.Poll, vote.GetSelectedOptions()),
+            At:      msg.Info.Timestamp,
+        })
+        if err != nil {
+            log.Error().Err(err).Int64("id", item.ID).Msg("WZ: Failed recording poll vote")
+            return
+        }
+        log.Debug().Int64("id", item.ID).Str("voter", voter).Msg("WZ: Recorded poll vote")
+    })
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "github.com/rs/zerolog/log"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+
+    "github.com/watchzap/internal/api"
+    "github.com/watchzap/internal/queue"
+)
+
+// Status each receipt type moves a message to, the other receipt types say nothing about delivery
+var receiptStatus = map[types.ReceiptType]string{
+    types.ReceiptTypeDelivered: queue.StatusDelivered,
+    types.ReceiptTypeRead:      queue.StatusRead,
+    types.ReceiptTypePlayed:    queue.StatusPlayed,
+}
+
+// Listens for receipts of the messages we sent and records them in the outbox
+func trackReceipts(messenger api.Messenger, outbox *queue.Queue) {
+    messenger.AddEventHandler(func(evt any) {
+        receipt, ok := evt.(*events.Receipt)
+        if !ok {
+            return
+        }
+
+        status, ok := receiptStatus[receipt.Type]
+        if !ok {
+            return
+        }
+
+        err := outbox.MarkReceipt(receipt.MessageIDs, status, receipt.Timestamp)
+        if err != nil {
+            log.Error().Err(err).Str("status", status).Msg("WZ: Failed recording receipt")
+        }
+    })
+}
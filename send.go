@@ -0,0 +1,322 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/rs/zerolog/log"
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/types"
+    "google.golang.org/protobuf/proto"
+
+    "github.com/watchzap/internal/api"
+    "github.com/watchzap/internal/jobs"
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/queue"
+    "github.com/watchzap/internal/static"
+)
+
+// Turns the parsed messages into the ones to queue
+// Templates are rendered first, so errors point at the messages as they were written,
+// then attachment paths are resolved against dir, the folder of the watched file or empty for the other sources,
+// and messages sent to an alias are replaced by one message for each of its targets
+func prepare(messages *[]parser.Message, dir string) error {
+    err := templateStore.RenderAll(*messages)
+    if err != nil {
+        return err
+    }
+
+    for i := range *messages {
+        err := resolveAttachments(&(*messages)[i], dir)
+        if err != nil {
+            return fmt.Errorf("message %d: %w", i, err)
+        }
+    }
+
+    expanded := make([]parser.Message, 0, len(*messages))
+    for _, m := range *messages {
+        expanded = append(expanded, aliases.Expand(m)...)
+    }
+    *messages = expanded
+
+    return nil
+}
+
+// Replaces the attachment paths of m by the absolute paths of the files, checking they are allowed
+func resolveAttachments(m *parser.Message, dir string) error {
+    // Multipart requests replace their parts before getting here
+    if m.AttachmentPart != "" {
+        return errors.New(static.NO_MULTIPART)
+    }
+    if m.AttachmentPath != "" {
+        path, err := resolvePath(m.AttachmentPath, dir)
+        if err != nil {
+            return err
+        }
+        m.AttachmentPath = path
+    }
+
+    for i := range m.Attachments {
+        a := &m.Attachments[i]
+        if a.Part != "" {
+            return fmt.Errorf("attachment %d: %s", i, static.NO_MULTIPART)
+        }
+        if a.Path == "" {
+            continue
+        }
+
+        path, err := resolvePath(a.Path, dir)
+        if err != nil {
+            return fmt.Errorf("attachment %d: %w", i, err)
+        }
+        a.Path = path
+    }
+
+    return nil
+}
+
+// Returns the absolute path of an attachment
+// With a media root every path is relative to it and must stay inside it,
+// otherwise only watched files can use paths, relative to their folder and inside the watched folder
+// The files of the request being queued are where readMultipart wrote them, so they are used as they are
+func resolvePath(path string, dir string) (string, error) {
+    if uploads.holds(path) {
+        return path, nil
+    }
+    root, base := cfg.MediaRoot, cfg.MediaRoot
+    if root == "" {
+        if dir == "" {
+            return "", errors.New(static.NO_MEDIA_ROOT)
+        }
+        root, base = cfg.Folder, dir
+    }
+
+    return media.ResolvePath(root, base, path)
+}
+
+// A row of the outbox, messages with an attachments list get one for each attachment
+type queuedMessage struct {
+    ID      int64
+    Message parser.Message
+    // Position of the attachment in the attachments list of the message, from 1, or 0 without a list
+    Attachment int
+}
+
+// Stores the messages in the outbox and returns their rows in the same order
+// The attachments of a message are chained so each one waits for the previous to be done
+func enqueue(messages *[]parser.Message, outbox *queue.Queue) ([]queuedMessage, error) {
+    queued := make([]queuedMessage, 0, len(*messages))
+    for _, m := range *messages {
+        parts := m.Split()
+
+        // Reactions and replies wait for the message they refer to, which needs its WhatsApp ID first
+        var after int64
+        switch {
+        case m.Reaction != nil:
+            after = m.Reaction.Message
+        case m.ReplyTo != 0:
+            after = m.ReplyTo
+        }
+        for i, part := range parts {
+            id, err := outbox.EnqueueAfter(part, after)
+            if err != nil {
+                return queued, err
+            }
+            after = id
+
+            row := queuedMessage{ID: id, Message: part}
+            if len(m.Attachments) > 0 {
+                row.Attachment = i + 1
+            }
+            log.Debug().
+                Int64("id", id).
+                Str("recipient", m.To()).
+                Int("attachment", row.Attachment).
+                Msg("WZ: Queued message")
+            queued = append(queued, row)
+        }
+    }
+
+    return queued, nil
+}
+
+// Queues the message of a run of a recurring job
+// The time of the run is available to the template as .run, along with the vars of the job
+func runJob(job jobs.Job, at time.Time, outbox *queue.Queue) error {
+    m := job.Message
+    // Only content and templates are rendered, polls and attachments without caption are queued as they are
+    if m.Content != "" || m.Template != "" {
+        m.Vars = map[string]any{"run": at}
+        for k, v := range job.Message.Vars {
+            m.Vars[k] = v
+        }
+    }
+
+    messages := []parser.Message{m}
+    err := prepare(&messages, "")
+    if err != nil {
+        return err
+    }
+
+    _, err = enqueue(&messages, outbox)
+
+    return err
+}
+
+// Sends a message to its recipient, called by the queue worker
+// outbox is where reactions and replies find the message they refer to
+func sendMessage(
+    m parser.Message,
+    messenger api.Messenger,
+    resolver *api.Resolver,
+    outbox *queue.Queue,
+) (queue.Sent, error) {
+    if wait >= cfg.MsgLimit {
+        for t := cfg.TimeLimit; t > 0; t-- {
+            log.Info().Msgf("WZ: Waiting to prevent rate over limit...%v", t)
+            time.Sleep(time.Second * 1)
+        }
+        wait = 0
+    }
+
+    if m.MessageKind() == parser.KindReaction {
+        return sendReaction(m, messenger, outbox)
+    }
+
+    jid, err := resolver.Resolve(m)
+    if err != nil {
+        var recipientErr *api.RecipientError
+        if errors.As(err, &recipientErr) {
+            log.Info().Err(err).Str("recipient", m.To()).Msg("WZ: Could not resolve recipient")
+            return queue.Sent{}, queue.Permanent(err)
+        }
+        return queue.Sent{}, err
+    }
+
+    // Resolved before the attachment is uploaded, which would be for nothing if they fail
+    info, err := messageContext(&m, jid, messenger, resolver, outbox)
+    if err != nil {
+        log.Info().Err(err).Str("recipient", m.To()).Msg("WZ: Could not resolve the reply or mentions")
+        return queue.Sent{}, err
+    }
+
+    attachment := api.MediaSource(m).String()
+    sendMessage, err := api.GenerateMessage(messenger, mediaLoader, m)
+    if err != nil {
+        log.Error().Err(err).Str("recipient", m.To()).Str("attachment", attachment).Msg("WZ: Could not send attachment")
+        var sourceErr *media.SourceError
+        if errors.As(err, &sourceErr) {
+            return queue.Sent{}, queue.Permanent(err)
+        }
+        return queue.Sent{}, err
+    }
+    if info != nil {
+        sendMessage = api.SetContextInfo(sendMessage, info)
+    }
+
+    res, err := messenger.SendMessage(context.Background(), jid, sendMessage)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error sending message to recipient")
+        return queue.Sent{}, err
+    }
+    log.Info().
+        Str("recipient", m.To()).
+        Str("kind", m.MessageKind()).
+        Str("content", m.Content).
+        Str("attachment", attachment).
+        Msg("WZ: Sent message successfully")
+    wait++
+
+    return queue.Sent{WhatsappID: res.ID, Chat: jid.String()}, nil
+}
+
+// Reacts to a message we sent before, in the chat it was sent to
+func sendReaction(m parser.Message, messenger api.Messenger, outbox *queue.Queue) (queue.Sent, error) {
+    target, chat, err := sentMessage(outbox, m.Reaction.Message)
+    if err != nil {
+        log.Info().Err(err).Int64("target", m.Reaction.Message).Msg("WZ: Could not react to message")
+        return queue.Sent{}, err
+    }
+
+    reaction := messenger.BuildReaction(chat, types.EmptyJID, target.WhatsappID, m.Reaction.Emoji)
+    res, err := messenger.SendMessage(context.Background(), chat, reaction)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error sending reaction")
+        return queue.Sent{}, err
+    }
+    log.Info().
+        Int64("target", m.Reaction.Message).
+        Str("emoji", m.Reaction.Emoji).
+        Msg("WZ: Sent reaction successfully")
+    wait++
+
+    return queue.Sent{WhatsappID: res.ID, Chat: chat.String()}, nil
+}
+
+// Returns a message of the outbox along with the chat it was sent to
+// A message that is missing or was never sent can't be referred to, so that error is permanent
+func sentMessage(outbox *queue.Queue, id int64) (queue.Item, types.JID, error) {
+    item, err := outbox.Get(id)
+    if err != nil {
+        return queue.Item{}, types.JID{}, queue.Permanent(fmt.Errorf("message %d: %w", id, err))
+    }
+    if item.WhatsappID == "" {
+        return queue.Item{}, types.JID{}, queue.Permanent(fmt.Errorf("message %d: %s", id, static.NOT_SENT))
+    }
+
+    chat, err := types.ParseJID(item.Chat)
+    if err != nil {
+        return queue.Item{}, types.JID{}, queue.Permanent(fmt.Errorf("message %d: %w", id, err))
+    }
+
+    return item, chat, nil
+}
+
+// Builds the context of a message sent to chat: the message it quotes and the people it mentions, nil without either
+// Mentions are looked up like recipients, and written into the content of m the way WhatsApp highlights them
+func messageContext(
+    m *parser.Message,
+    chat types.JID,
+    messenger api.Messenger,
+    resolver *api.Resolver,
+    outbox *queue.Queue,
+) (*waE2E.ContextInfo, error) {
+    if m.ReplyTo == 0 && len(m.Mentions) == 0 {
+        return nil, nil
+    }
+
+    info := &waE2E.ContextInfo{}
+    for _, mention := range m.Mentions {
+        jid, err := resolver.ResolveMention(mention)
+        if err != nil {
+            var recipientErr *api.RecipientError
+            if errors.As(err, &recipientErr) {
+                return nil, queue.Permanent(fmt.Errorf("mention: %w", err))
+            }
+            return nil, err
+        }
+
+        m.Content = api.MentionText(m.Content, mention, jid)
+        info.MentionedJID = append(info.MentionedJID, jid.String())
+    }
+
+    if m.ReplyTo != 0 {
+        target, targetChat, err := sentMessage(outbox, m.ReplyTo)
+        if err != nil {
+            return nil, err
+        }
+
+        info.StanzaID = proto.String(target.WhatsappID)
+        info.Participant = proto.String(messenger.OwnID().String())
+        info.QuotedMessage = api.QuotedMessage(target.Message)
+        // Replying in another chat than the one of the message quotes it from there
+        if targetChat != chat {
+            info.RemoteJID = proto.String(targetChat.String())
+        }
+    }
+
+    return info, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/media"
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/queue"
+    "github.com/watchzap/internal/static"
+)
+
+// Form field holding the messages of a multipart/form-data request
+const messagesField = "messages"
+
+// Longest time between two cleanups of the uploads folder when no message wakes it up
+const uploadCleanup = time.Minute
+
+// A file part of a multipart/form-data request, written to the uploads folder
+type uploadedFile struct {
+    filename string
+    path     string
+}
+
+// Parts of multipart requests are written to files and queued by path, so the outbox doesn't keep a copy of them,
+// and each file is removed once no message left to send uses it
+type spool struct {
+    mu sync.Mutex
+    // Files of the requests still being read or queued, the outbox doesn't have their messages yet
+    open map[string]struct{}
+    // Only one cleanup looks at the folder at a time
+    cleaning sync.Mutex
+    wake     chan struct{}
+}
+
+// The uploaded files of every request
+var uploads = &spool{open: map[string]struct{}{}, wake: make(chan struct{}, 1)}
+
+// Returns the folder of the uploaded files, inside the media root when there is one and next to zap.db otherwise
+func uploadDir() string {
+    if cfg.MediaRoot != "" {
+        return filepath.Join(cfg.MediaRoot, ".uploads")
+    }
+
+    return "uploads"
+}
+
+// Returns whether the request is a multipart/form-data upload
+func isMultipart(r *http.Request) bool {
+    mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+    return err == nil && mediaType == "multipart/form-data"
+}
+
+// Reads the messages of a multipart/form-data request with their attachments
+// The messages field holds the messages in any supported format, every other part with a file name is an attachment
+// the messages refer to by its form name in attachment_part
+// Parts are streamed one at a time and each one is stopped at the attachment size limit
+// The files are held by the spool until released, and removed right away when the request fails
+func readMultipart(r *http.Request) ([]parser.Message, []string, error) {
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    files := map[string]uploadedFile{}
+    messages, err := readParts(reader, files)
+    paths := make([]string, 0, len(files))
+    for _, file := range files {
+        paths = append(paths, file.path)
+    }
+    if err != nil {
+        uploads.discard(paths)
+        return nil, nil, err
+    }
+
+    return messages, paths, nil
+}
+
+// Reads every part of a multipart/form-data request, adding the files written to files as it goes
+func readParts(reader *multipart.Reader, files map[string]uploadedFile) ([]parser.Message, error) {
+    var messages []parser.Message
+    found := false
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        if part.FormName() == messagesField {
+            messages, err = readMessagesPart(part)
+            if err != nil {
+                return nil, err
+            }
+            found = true
+            continue
+        }
+        // Plain form fields are not attachments
+        if part.FileName() == "" {
+            continue
+        }
+
+        name := part.FormName()
+        if _, ok := files[name]; ok {
+            return nil, fmt.Errorf("%s: %s", static.DUPLICATE_PART, name)
+        }
+        path, err := uploads.write(part, int64(cfg.MediaMaxSize)<<20)
+        if path != "" {
+            files[name] = uploadedFile{filename: part.FileName(), path: path}
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+    }
+
+    if !found {
+        return nil, errors.New(static.MISSING_MESSAGES)
+    }
+
+    for i := range messages {
+        err := attachParts(&messages[i], files)
+        if err != nil {
+            return nil, fmt.Errorf("message %d: %w", i, err)
+        }
+    }
+
+    return messages, nil
+}
+
+// Replaces the parts m refers to by the paths of their files, their file name being the default filename
+// The files stay until the messages are done, so the queue can retry them after a restart
+func attachParts(m *parser.Message, files map[string]uploadedFile) error {
+    if m.AttachmentPart != "" {
+        file, ok := files[m.AttachmentPart]
+        if !ok {
+            return fmt.Errorf("%s: %s", static.UNKNOWN_PART, m.AttachmentPart)
+        }
+        m.AttachmentPath = file.path
+        m.AttachmentPart = ""
+        if m.Filename == "" {
+            m.Filename = file.filename
+        }
+    }
+
+    for i := range m.Attachments {
+        a := &m.Attachments[i]
+        if a.Part == "" {
+            continue
+        }
+
+        file, ok := files[a.Part]
+        if !ok {
+            return fmt.Errorf("attachment %d: %s: %s", i, static.UNKNOWN_PART, a.Part)
+        }
+        a.Path = file.path
+        a.Part = ""
+        if a.Filename == "" {
+            a.Filename = file.filename
+        }
+    }
+
+    return nil
+}
+
+// Parses the messages field, by its Content-Type, or the extension of its file name, and as JSON otherwise
+func readMessagesPart(part *multipart.Part) ([]parser.Message, error) {
+    contentType := part.Header.Get("Content-Type")
+    p, err := parser.Default.ForContentType(contentType)
+    if err != nil {
+        p, err = parser.Default.ForFile(part.FileName())
+    }
+    if err != nil {
+        p, err = parser.Default.ForContentType("application/json")
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    body, err := io.ReadAll(part)
+    if err != nil {
+        return nil, err
+    }
+
+    messages, err := p.Read(body, requestCharset(contentType))
+    if err != nil {
+        log.Error().Err(err).Str("parser", p.Name).Msg("WZ: Error parsing the messages field")
+        return nil, err
+    }
+
+    return messages, nil
+}
+
+// Writes a file part to a new file of the uploads folder and returns its absolute path,
+// failing with media.ErrTooLarge as soon as it goes over limit bytes
+// The path is returned along with the error when the file was created, so the caller can discard it
+func (s *spool) write(part *multipart.Part, limit int64) (string, error) {
+    dir, err := filepath.Abs(uploadDir())
+    if err != nil {
+        return "", err
+    }
+    err = os.MkdirAll(dir, 0o700)
+    if err != nil {
+        return "", err
+    }
+
+    id := make([]byte, 16)
+    rand.Read(id)
+    // The extension is kept for the tools looking at the file, the name can't point outside the folder
+    path := filepath.Join(dir, hex.EncodeToString(id)+filepath.Ext(filepath.Base(part.FileName())))
+
+    s.mu.Lock()
+    s.open[path] = struct{}{}
+    s.mu.Unlock()
+
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+    if err != nil {
+        return path, err
+    }
+    n, err := io.Copy(file, io.LimitReader(part, limit+1))
+    closeErr := file.Close()
+    switch {
+    case err != nil:
+        return path, err
+    case closeErr != nil:
+        return path, closeErr
+    case n > limit:
+        return path, media.ErrTooLarge
+    }
+
+    return path, nil
+}
+
+// Reports whether path is a file of a request still being read or queued
+func (s *spool) holds(path string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, ok := s.open[path]
+
+    return ok
+}
+
+// Hands the files over to the outbox once their messages are queued, or when the request stopped
+// Files no message refers to are removed by the next cleanup, which is started right away
+func (s *spool) release(paths []string) {
+    if len(paths) == 0 {
+        return
+    }
+
+    s.mu.Lock()
+    for _, path := range paths {
+        delete(s.open, path)
+    }
+    s.mu.Unlock()
+
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Removes the files of a request that failed before queueing anything
+func (s *spool) discard(paths []string) {
+    for _, path := range paths {
+        err := os.Remove(path)
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            log.Warn().Err(err).Str("path", path).Msg("WZ: Failed removing uploaded file")
+        }
+    }
+    s.release(paths)
+}
+
+// Removes the files of dir no pending message of the outbox refers to
+func (s *spool) clean(outbox *queue.Queue, dir string) error {
+    s.cleaning.Lock()
+    defer s.cleaning.Unlock()
+
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return err
+    }
+    entries, err := os.ReadDir(dir)
+    if errors.Is(err, os.ErrNotExist) || len(entries) == 0 {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    // Files are released after their messages are queued, so a file that isn't open any more
+    // is already referred to by the pending messages read below
+    s.mu.Lock()
+    open := make(map[string]struct{}, len(s.open))
+    for path := range s.open {
+        open[path] = struct{}{}
+    }
+    s.mu.Unlock()
+
+    pending, err := outbox.Pending()
+    if err != nil {
+        return err
+    }
+    used := map[string]struct{}{}
+    for _, item := range pending {
+        used[item.Message.AttachmentPath] = struct{}{}
+        for _, a := range item.Message.Attachments {
+            used[a.Path] = struct{}{}
+        }
+    }
+
+    for _, entry := range entries {
+        path := filepath.Join(dir, entry.Name())
+        _, isOpen := open[path]
+        _, isUsed := used[path]
+        if isOpen || isUsed {
+            continue
+        }
+
+        err := os.Remove(path)
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            log.Warn().Err(err).Str("path", path).Msg("WZ: Failed removing uploaded file")
+            continue
+        }
+        log.Debug().Str("path", path).Msg("WZ: Removed uploaded file")
+    }
+
+    return nil
+}
+
+// Removes the uploaded files as the messages using them are done, until ctx is done
+// The folder is also looked at on start, for files left by a previous run, and every uploadCleanup
+func cleanUploads(ctx context.Context, outbox *queue.Queue) {
+    dir := uploadDir()
+    updates, unsubscribe := outbox.Subscribe()
+
+    go func() {
+        defer unsubscribe()
+        for {
+            err := uploads.clean(outbox, dir)
+            if err != nil {
+                log.Error().Err(err).Msg("WZ: Failed cleaning uploaded files")
+            }
+
+            // Updates are only read to know when to look again, the folder itself tells which files are left
+            timeout := time.After(uploadCleanup)
+            for wake := false; !wake; {
+                select {
+                case <-ctx.Done():
+                    return
+                case item := <-updates:
+                    wake = item.Done()
+                case <-uploads.wake:
+                    wake = true
+                case <-timeout:
+                    wake = true
+                }
+            }
+        }
+    }()
+}
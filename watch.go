@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/radovskyb/watcher"
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/parser"
+    "github.com/watchzap/internal/queue"
+)
+
+// Sets up a file watcher to monitor changes in a directory
+func watch(outbox *queue.Queue) {
+    w := watcher.New()
+    w.FilterOps(watcher.Create, watcher.Move, watcher.Write, watcher.Rename)
+    go func() {
+        for {
+            select {
+            case event := <-w.Event:
+                doEvent(event, outbox)
+            case err := <-w.Error:
+                log.Fatal().Err(err).Str("function", "watch").Msg("WZ: Failed getting folder event")
+            case <-w.Closed:
+                return
+            }
+        }
+    }()
+    if err := w.Add(cfg.Folder); err != nil {
+        log.Fatal().Err(err).Str("function", "watch").Msg("WZ: Error adding folder to watch")
+    }
+    log.Info().Str("folder", cfg.Folder).Msg("WZ: Watching folder every 100ms")
+    if err := w.Start(time.Millisecond * 100); err != nil {
+        log.Fatal().
+            Err(err).
+            Str("function", "watch").
+            Msg(fmt.Sprintf("Failed to watch folder %s", cfg.Folder))
+    }
+}
+
+// / Processes file events triggered by the watch function
+func doEvent(w watcher.Event, outbox *queue.Queue) {
+    if w.IsDir() {
+        return
+    }
+
+    p, err := parser.Default.ForFile(w.Path)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Error checking file extension")
+        return
+    }
+
+    f, err := os.Open(w.Path)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Failed opening file")
+        return
+    }
+
+    stat, err := f.Stat()
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Failed getting stat of file")
+        return
+    }
+    if stat.Size() == 0 {
+        log.Warn().Str("file", w.Name()).Str("path", w.Path).Msg("WZ: File content is empty")
+        return
+    }
+
+    body := make([]byte, stat.Size())
+    _, err = f.Read(body)
+    if err != nil {
+        log.Error().Err(err).Str("parser", "json").Msg("WZ: Error reading file")
+        return
+    }
+
+    err = f.Close()
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Could not close file")
+        return
+    }
+
+    parsed, err := p.Read(body, cfg.Charset)
+    if err != nil {
+        log.Error().Err(err).Str("parser", p.Name).Msg("WZ: Error parsing messages")
+        return
+    }
+    messages := &parsed
+
+    err = prepare(messages, filepath.Dir(w.Path))
+    if err != nil {
+        log.Error().Err(err).Str("file", w.Name()).Msg("WZ: Error preparing messages")
+        return
+    }
+
+    _, err = enqueue(messages, outbox)
+    if err != nil {
+        log.Error().Err(err).Msg("WZ: Could not queue messages")
+        return
+    }
+
+    // The messages are safe in the queue from here on, so the file is no longer needed
+    if cfg.RemoveOnSend {
+        err := os.Remove(w.Path)
+        if err != nil {
+            log.Warn().Err(err).Msg("WZ: Could not delete the file upon send")
+            return
+        }
+    }
+}
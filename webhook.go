@@ -0,0 +1,203 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/rs/zerolog/log"
+
+    "github.com/watchzap/internal/queue"
+)
+
+// Body of the requests sent to the webhook
+type webhookEvent struct {
+    ID         int64     `json:"id"`
+    Recipient  string    `json:"recipient"`
+    Status     string    `json:"status"`
+    Error      string    `json:"error,omitempty"`
+    WhatsappID string    `json:"whatsapp_id,omitempty"`
+    At         time.Time `json:"at"`
+}
+
+// How many status changes are read from the history at once
+const webhookBatch = 100
+
+// Posts the status changes of the outbox to a URL, one at a time and in order
+// Changes are read from the history of the outbox after a cursor kept in the database,
+// so a slow or unreachable webhook only delays them, even across restarts
+type webhook struct {
+    outbox *queue.Queue
+    url    string
+    client *http.Client
+    // Wait after the first failed post, doubled after every other one up to maxBackoff
+    backoff    time.Duration
+    maxBackoff time.Duration
+    // Longest time between two looks at the history when no change wakes the webhook up
+    poll time.Duration
+}
+
+// A post the webhook rejected, posting it again would only be rejected again
+type webhookRejected struct {
+    status string
+}
+
+func (e *webhookRejected) Error() string {
+    return "webhook rejected the event: " + e.status
+}
+
+// Posts every status change of the outbox to url until the process stops
+func notifyWebhook(outbox *queue.Queue, url string) {
+    w := &webhook{
+        outbox:     outbox,
+        url:        url,
+        client:     &http.Client{Timeout: 10 * time.Second},
+        backoff:    time.Second,
+        maxBackoff: 5 * time.Minute,
+        poll:       time.Second,
+    }
+
+    err := w.start(context.Background())
+    if err != nil {
+        log.Error().Err(err).Str("webhook", url).Msg("WZ: Failed reading the webhook cursor")
+    }
+}
+
+// Starts posting the changes made from the last one posted, or from now on the first time, until ctx is done
+// Each URL has its own cursor, so a new webhook doesn't get the changes made before it was set
+func (w *webhook) start(ctx context.Context) error {
+    name := "webhook " + w.url
+    seq, err := w.outbox.Cursor(name)
+    if err != nil {
+        return err
+    }
+
+    go w.run(ctx, name, seq)
+
+    return nil
+}
+
+// Posts the changes after seq as they come in, moving the cursor called name along
+func (w *webhook) run(ctx context.Context, name string, seq int64) {
+    wake := w.wakeUps(ctx)
+    for {
+        changes, err := w.outbox.Changes(seq, webhookBatch)
+        if err != nil {
+            log.Error().Err(err).Str("webhook", w.url).Msg("WZ: Failed reading status changes")
+        }
+
+        for _, change := range changes {
+            if !w.deliver(ctx, change) {
+                return
+            }
+
+            seq = change.Seq
+            err := w.outbox.SetCursor(name, seq)
+            if err != nil {
+                log.Error().Err(err).Str("webhook", w.url).Msg("WZ: Failed saving the webhook cursor")
+            }
+        }
+        if len(changes) == webhookBatch {
+            continue
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-wake:
+        case <-time.After(w.poll):
+        }
+    }
+}
+
+// Returns a channel signalled when items change, the changes themselves are read from the history
+// Signals coalesce, so the subscription is drained right away and never fills up
+func (w *webhook) wakeUps(ctx context.Context) <-chan struct{} {
+    updates, unsubscribe := w.outbox.Subscribe()
+    wake := make(chan struct{}, 1)
+
+    go func() {
+        defer unsubscribe()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-updates:
+                select {
+                case wake <- struct{}{}:
+                default:
+                }
+            }
+        }
+    }()
+
+    return wake
+}
+
+// Posts a change, retrying with backoff until it is accepted or rejected, returns false when ctx is done first
+func (w *webhook) deliver(ctx context.Context, change queue.Change) bool {
+    body, _ := json.Marshal(webhookEvent{
+        ID:         change.Item.ID,
+        Recipient:  change.Item.Message.To(),
+        Status:     change.Status,
+        Error:      change.Error,
+        WhatsappID: change.Item.WhatsappID,
+        At:         change.At,
+    })
+
+    wait := w.backoff
+    for attempt := 1; ; attempt++ {
+        err := postWebhook(ctx, w.client, w.url, body)
+        var rejected *webhookRejected
+        switch {
+        case err == nil:
+            return true
+        case errors.As(err, &rejected):
+            log.Warn().Err(err).Int64("id", change.Item.ID).Str("webhook", w.url).Msg("WZ: Webhook rejected event")
+            return true
+        }
+
+        log.Warn().
+            Err(err).
+            Int64("id", change.Item.ID).
+            Int("attempts", attempt).
+            Str("webhook", w.url).
+            Msg("WZ: Failed calling webhook")
+
+        select {
+        case <-ctx.Done():
+            return false
+        case <-time.After(wait):
+        }
+        wait = min(wait*2, w.maxBackoff)
+    }
+}
+
+// Posts body to url, 4xx answers other than 408 and 429 are a *webhookRejected
+func postWebhook(ctx context.Context, client *http.Client, url string, body []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    res, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    switch {
+    case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests:
+    case res.StatusCode >= 400 && res.StatusCode < 500:
+        return &webhookRejected{status: res.Status}
+    case res.StatusCode < 300:
+        return nil
+    }
+
+    return fmt.Errorf("webhook answered %s", res.Status)
+}